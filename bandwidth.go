@@ -0,0 +1,634 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// throttleChunk is the most a limited connection reads or writes at
+	// once
+	throttleChunk = 16 << 10
+	// minBurst is the least a limiter lets pass at once
+	minBurst = 4 << 10
+)
+
+// ParseBandwidthLimit parses a rate in bytes per second with an optional
+// k, m or g suffix, such as 512k.
+func ParseBandwidthLimit(s string) (int64, error) {
+	limit, err := parseSize(s)
+	if err != nil {
+		return 0, errors.Errorf("Invalid bandwidth limit %#v, expected a rate such as 10m", s)
+	}
+	return limit, nil
+}
+
+// limiter is a token bucket limiting the rate of the connections sharing
+// it.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	l := &limiter{rate: float64(rate), last: time.Now()}
+	l.tokens = l.burst()
+	return l
+}
+
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+}
+
+// burst is how much may pass at once, a tenth of a second's worth.
+func (l *limiter) burst() float64 {
+	return math.Max(l.rate/10, minBurst)
+}
+
+// wait blocks until n more bytes may pass. Callers take what they need
+// right away and sleep off the debt, so concurrent callers share the
+// rate in turn.
+func (l *limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledConn limits the traffic of a connection, in both directions,
+// to the rates of its limiters.
+type throttledConn struct {
+	net.Conn
+	limiters []*limiter
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.wait(n)
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		c.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *throttledConn) wait(n int) {
+	for _, l := range c.limiters {
+		l.wait(n)
+	}
+}
+
+// bandwidth holds the limiters of a Manager's traffic.
+type bandwidth struct {
+	mu     sync.Mutex
+	global *limiter
+	hosts  map[string]*limiter
+}
+
+// throttle routes the connections to a remote through the proxies of a
+// Manager that limit their bandwidth.
+type throttle struct {
+	mgr  *Manager
+	host string
+
+	// ssh is the address of an ssh remote
+	ssh string
+}
+
+// localProxies are the proxies the git executable connects to a limited
+// remote through.
+type localProxies struct {
+	// socks is the SOCKS proxy for http remotes, user:password@host:port
+	socks string
+
+	// sshHost and sshPort forward to an ssh remote, whose host key is
+	// known as sshAlias. If sshJump is set, they forward to the jump
+	// host, [user@]host, instead.
+	sshHost, sshPort string
+	sshAlias         string
+	sshJump          string
+}
+
+// limitBandwidth returns network routing the connections to the remote
+// at rawURL through the proxies that limit their bandwidth, if a limit
+// applies to it. Only http and ssh remotes are limited.
+func (mgr *Manager) limitBandwidth(rawURL string, network Network) Network {
+	if mgr.BandwidthLimit <= 0 && network.BandwidthLimit <= 0 {
+		return network
+	}
+	ep, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return network
+	}
+	t := &throttle{mgr: mgr, host: strings.ToLower(ep.Host)}
+	switch ep.Protocol {
+	case "http", "https":
+	case "ssh":
+		port := ep.Port
+		if port == 0 {
+			port = 22
+		}
+		t.ssh = net.JoinHostPort(ep.Host, strconv.Itoa(port))
+	default:
+		return network
+	}
+	network.throttle = t
+	return network
+}
+
+// localProxies starts the proxies for the git executable: the SOCKS proxy
+// for http remotes, or a forwarder to ssh remotes or their jump host.
+// Calling stop stops them once git is done.
+func (t *throttle) localProxies(network Network) (proxies localProxies, stop func(), err error) {
+	if t == nil {
+		return localProxies{}, func() {}, nil
+	}
+	if t.ssh == "" {
+		p, err := t.mgr.socksProxy()
+		if err != nil {
+			return localProxies{}, nil, err
+		}
+		return localProxies{socks: p.userinfo() + "@" + p.addr()}, p.close, nil
+	}
+
+	target, jump := t.ssh, ""
+	if network.SSHProxyJump != "" {
+		if strings.Contains(network.SSHProxyJump, ",") {
+			return localProxies{}, nil, errors.New("Bandwidth limits support a single sshProxyJump host")
+		}
+		jump, target = splitJumpHost(network.SSHProxyJump)
+	}
+	p, err := t.mgr.sshForward(t.host, target)
+	if err != nil {
+		return localProxies{}, nil, err
+	}
+	host, port, _ := net.SplitHostPort(p.addr())
+	return localProxies{sshHost: host, sshPort: port, sshAlias: hostKeyAlias(target), sshJump: jump}, p.close, nil
+}
+
+// splitJumpHost splits an ssh -J destination, [ssh://][user@]host[:port],
+// into [user@]host and the address to connect to.
+func splitJumpHost(spec string) (dest, addr string) {
+	spec = strings.TrimPrefix(spec, "ssh://")
+	user := ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user, spec = spec[:i+1], spec[i+1:]
+	}
+	host, port := spec, "22"
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		host, port = h, p
+	}
+	return user + host, net.JoinHostPort(host, port)
+}
+
+// hostKeyAlias returns the name ssh knows the host key of the server at
+// addr by.
+func hostKeyAlias(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// limiters returns the limiters for the traffic to host: the Manager's
+// and the host's, if set.
+func (mgr *Manager) limiters(host string) []*limiter {
+	b := &mgr.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limiters := []*limiter{}
+	if mgr.BandwidthLimit > 0 {
+		if b.global == nil {
+			b.global = newLimiter(mgr.BandwidthLimit)
+		}
+		b.global.setRate(mgr.BandwidthLimit)
+		limiters = append(limiters, b.global)
+	}
+	if limit := mgr.hostConfigFor(host).Network.BandwidthLimit; limit > 0 {
+		if b.hosts == nil {
+			b.hosts = map[string]*limiter{}
+		}
+		if b.hosts[host] == nil {
+			b.hosts[host] = newLimiter(limit)
+		}
+		b.hosts[host].setRate(limit)
+		limiters = append(limiters, b.hosts[host])
+	}
+	return limiters
+}
+
+// localProxy is a proxy on 127.0.0.1 serving one git command. Closing it
+// stops it and drops the connections it serves.
+type localProxy struct {
+	listener net.Listener
+
+	// user and password authenticate the clients of a SOCKS proxy
+	user, password string
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// startProxy starts a proxy serving its connections with handle. user and
+// password, if set, are the credentials of a SOCKS proxy.
+func startProxy(user, password string, handle func(p *localProxy, c net.Conn)) (*localProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error starting bandwidth limiting proxy")
+	}
+	p := &localProxy{listener: l, user: user, password: password, conns: map[net.Conn]bool{}}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !p.track(c) {
+				c.Close()
+				return
+			}
+			go func() {
+				defer p.untrack(c)
+				handle(p, c)
+			}()
+		}
+	}()
+	return p, nil
+}
+
+func (p *localProxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *localProxy) userinfo() string {
+	return p.user + ":" + p.password
+}
+
+func (p *localProxy) track(c net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.conns[c] = true
+	}
+	return !p.closed
+}
+
+func (p *localProxy) untrack(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
+
+// splice connects the client c to target until either is done.
+func (p *localProxy) splice(c, target net.Conn) {
+	if !p.track(target) {
+		c.Close()
+		target.Close()
+		return
+	}
+	defer p.untrack(target)
+	splice(c, target)
+}
+
+func (p *localProxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.listener.Close()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// socksProxy starts a SOCKS proxy, which only serves clients with its
+// credentials: the proxies of a daemon mustn't relay for anyone else.
+func (mgr *Manager) socksProxy() (*localProxy, error) {
+	credentials := make([]byte, 16)
+	if _, err := rand.Read(credentials); err != nil {
+		return nil, errors.Wrap(err, "Error starting bandwidth limiting proxy")
+	}
+	return startProxy("gomir", hex.EncodeToString(credentials), mgr.serveSOCKS)
+}
+
+// sshForward starts a forwarder to the ssh server at addr, whose traffic
+// is limited as that of host.
+func (mgr *Manager) sshForward(host, addr string) (*localProxy, error) {
+	return startProxy("", "", func(p *localProxy, c net.Conn) {
+		target, err := mgr.dialLimited(host, addr, false)
+		if err != nil {
+			c.Close()
+			return
+		}
+		p.splice(c, target)
+	})
+}
+
+// dialLimited connects to addr, limiting the traffic as that of host.
+// If proxied, it connects through the host's proxy, if it has one.
+func (mgr *Manager) dialLimited(host, addr string, proxied bool) (net.Conn, error) {
+	network := mgr.hostConfigFor(host).Network
+	var conn net.Conn
+	var err error
+	if p := network.proxyFor(host); proxied && p != "" {
+		conn, err = dialProxy(p, addr, network.ConnectTimeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, network.ConnectTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &throttledConn{Conn: conn, limiters: mgr.limiters(host)}, nil
+}
+
+// serveSOCKS serves a client of the SOCKS proxy p, connecting it to the
+// host it asks for.
+func (mgr *Manager) serveSOCKS(p *localProxy, c net.Conn) {
+	host, addr, err := readSOCKSRequest(c, p.user, p.password)
+	if err != nil {
+		c.Close()
+		return
+	}
+	target, err := mgr.dialLimited(host, addr, true)
+	if err != nil {
+		socksReply(c, 4) // Host unreachable
+		c.Close()
+		return
+	}
+	if err := socksReply(c, 0); err != nil {
+		c.Close()
+		target.Close()
+		return
+	}
+	p.splice(c, target)
+}
+
+// readSOCKSRequest takes a SOCKS5 client authenticating with user and
+// password through its handshake and returns the host and address it
+// connects to.
+func readSOCKSRequest(c net.Conn, user, password string) (host, addr string, err error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return "", "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", "", err
+	}
+	// Username and password authentication, RFC 1929
+	if head[0] != 5 || bytes.IndexByte(methods, 2) < 0 {
+		c.Write([]byte{5, 0xff})
+		return "", "", errors.New("Unsupported SOCKS client")
+	}
+	if _, err := c.Write([]byte{5, 2}); err != nil {
+		return "", "", err
+	}
+	if err := readSOCKSAuth(c, user, password); err != nil {
+		return "", "", err
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return "", "", err
+	}
+	if req[1] != 1 {
+		socksReply(c, 7) // Command not supported
+		return "", "", errors.New("Unsupported SOCKS command")
+	}
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case 3:
+		name := make([]byte, 1)
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", "", err
+		}
+		name = make([]byte, name[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		socksReply(c, 8) // Address type not supported
+		return "", "", errors.New("Unsupported SOCKS address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return "", "", err
+	}
+	host = strings.ToLower(host)
+	return host, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKSAuth checks the credentials a SOCKS5 client sends.
+func readSOCKSAuth(c net.Conn, user, password string) error {
+	// VER ULEN UNAME PLEN PASSWD
+	field := func() ([]byte, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(c, length); err != nil {
+			return nil, err
+		}
+		value := make([]byte, length[0])
+		_, err := io.ReadFull(c, value)
+		return value, err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(c, version); err != nil {
+		return err
+	}
+	gotUser, err := field()
+	if err != nil {
+		return err
+	}
+	gotPassword, err := field()
+	if err != nil {
+		return err
+	}
+	ok := subtle.ConstantTimeCompare(gotUser, []byte(user)) == 1
+	ok = subtle.ConstantTimeCompare(gotPassword, []byte(password)) == 1 && ok
+	if version[0] != 1 || !ok {
+		c.Write([]byte{1, 1})
+		return errors.New("Invalid SOCKS credentials")
+	}
+	_, err = c.Write([]byte{1, 0})
+	return err
+}
+
+func socksReply(c net.Conn, code byte) error {
+	_, err := c.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// dialProxy connects to addr through the proxy at rawURL: an http or
+// https proxy, with CONNECT, or a SOCKS proxy.
+func dialProxy(rawURL, addr string, timeout time.Duration) (net.Conn, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid proxy")
+	}
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		// curl's default proxy port
+		proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(u, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid proxy")
+		}
+		return dialer.Dial("tcp", addr)
+	default:
+		return nil, errors.Errorf("Unsupported proxy scheme %#v", u.Scheme)
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("Proxy refused to connect to %v: %v", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn is a connection whose reads start with what r buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// splice copies between a and b in both directions until both are done,
+// then closes them.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		closeWrite(dst)
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// closeWrite shuts down the writing side of c, or closes it if it can't.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
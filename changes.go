@@ -0,0 +1,530 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// ChangeFormat is a format of change reports.
+type ChangeFormat string
+
+// Change report formats
+const (
+	ChangeMarkdown ChangeFormat = "markdown"
+	ChangeHTML     ChangeFormat = "html"
+	ChangeJSON     ChangeFormat = "json"
+)
+
+// changeReportNames are the files that ChangeReportConfig writes for each
+// format.
+var changeReportNames = map[ChangeFormat]string{
+	ChangeMarkdown: "changes.md",
+	ChangeHTML:     "changes.html",
+	ChangeJSON:     "changes.json",
+}
+
+// ParseChangeFormat returns the change report format with the given name.
+func ParseChangeFormat(name string) (ChangeFormat, error) {
+	format := ChangeFormat(name)
+	if _, ok := changeReportNames[format]; !ok {
+		return "", errors.Errorf("Unknown change report format %#v, expected markdown, html or json", name)
+	}
+	return format, nil
+}
+
+// ChangeReport lists what the mirrors would push, the changes since their
+// last push, for reviewers approving a transfer.
+type ChangeReport struct {
+	Generated time.Time `json:"generated"`
+
+	// Mirrors are the mirrors with changes
+	Mirrors []*MirrorChanges `json:"mirrors"`
+}
+
+// MirrorChanges are the changes of a mirror since its last push.
+type MirrorChanges struct {
+	Mirror string `json:"mirror"`
+
+	// Pushed is false if the mirror was never pushed, so that its whole
+	// history is new
+	Pushed bool `json:"pushed"`
+
+	// Refs are the branches and other refs that moved, except tags
+	Refs []RefChanges `json:"refs"`
+
+	// NewTags are the new and moved tags, and DeletedTags the deleted
+	// ones
+	NewTags     []RefChange `json:"newTags"`
+	DeletedTags []RefChange `json:"deletedTags"`
+
+	// Commits counts the new commits of all refs, and Stat totals their
+	// changes
+	Commits int      `json:"commits"`
+	Stat    Diffstat `json:"stat"`
+}
+
+// IsZero reports whether nothing changed.
+func (c *MirrorChanges) IsZero() bool {
+	return len(c.Refs) == 0 && len(c.NewTags) == 0 && len(c.DeletedTags) == 0
+}
+
+// RefChanges describes a ref that moved and the new commits it brings,
+// newest first.
+type RefChanges struct {
+	RefChange
+	Commits []CommitSummary `json:"commits"`
+	Stat    Diffstat        `json:"stat"`
+}
+
+// CommitSummary describes a new commit.
+type CommitSummary struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Stat    Diffstat  `json:"stat"`
+}
+
+// Diffstat totals the changes of commits, compared to their first
+// parents. Merges count as no changes, as in git log --stat.
+type Diffstat struct {
+	Files      int `json:"files"`
+	Insertions int `json:"insertions"`
+	Deletions  int `json:"deletions"`
+}
+
+func (d Diffstat) String() string {
+	return fmt.Sprintf("%v files changed, %v insertions(+), %v deletions(-)", d.Files, d.Insertions, d.Deletions)
+}
+
+func (d *Diffstat) add(other Diffstat) {
+	d.Files += other.Files
+	d.Insertions += other.Insertions
+	d.Deletions += other.Deletions
+}
+
+// Changes returns the changes of the mirror since its last push.
+func (m *Mirror) Changes() (*MirrorChanges, error) {
+	pushed, err := m.PushedRefs()
+	if err != nil {
+		return nil, err
+	}
+	current, err := readRefs(m.GitDir)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := gogit.PlainOpen(m.GitDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening mirror")
+	}
+	h := newHistory(repo)
+	for _, hash := range pushed {
+		if err := h.markKnown(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := &MirrorChanges{
+		Mirror:      m.Path,
+		Pushed:      pushed != nil,
+		Refs:        []RefChanges{},
+		NewTags:     []RefChange{},
+		DeletedTags: []RefChange{},
+	}
+	summaries := map[plumbing.Hash]CommitSummary{}
+	for _, change := range diffRefs(pushed, current) {
+		if strings.HasPrefix(change.Ref, "refs/tags/") {
+			if change.New == "" {
+				changes.DeletedTags = append(changes.DeletedTags, change)
+			} else {
+				changes.NewTags = append(changes.NewTags, change)
+			}
+			continue
+		}
+
+		r := RefChanges{RefChange: change, Commits: []CommitSummary{}}
+		if change.New != "" {
+			if err := r.addCommits(h, summaries); err != nil {
+				return nil, errors.Wrapf(err, "Error listing the commits of %v", change.Ref)
+			}
+		}
+		changes.Refs = append(changes.Refs, r)
+	}
+
+	changes.Commits = len(summaries)
+	for _, summary := range summaries {
+		changes.Stat.add(summary.Stat)
+	}
+	return changes, nil
+}
+
+// addCommits adds the new commits of the ref to r, taking their summaries
+// from, and adding them to, summaries.
+func (r *RefChanges) addCommits(h *history, summaries map[plumbing.Hash]CommitSummary) error {
+	tip, err := h.peel(plumbing.NewHash(r.New))
+	if err != nil || tip.IsZero() {
+		return err
+	}
+	commits, err := h.newCommits(tip)
+	if err != nil {
+		return err
+	}
+	for _, commit := range commits {
+		summary, ok := summaries[commit.Hash]
+		if !ok {
+			if summary, err = summarizeCommit(commit); err != nil {
+				return err
+			}
+			summaries[commit.Hash] = summary
+		}
+		r.Commits = append(r.Commits, summary)
+		r.Stat.add(summary.Stat)
+	}
+	sort.SliceStable(r.Commits, func(i, j int) bool { return r.Commits[i].Date.After(r.Commits[j].Date) })
+	return nil
+}
+
+func summarizeCommit(commit *object.Commit) (CommitSummary, error) {
+	summary := CommitSummary{
+		Hash:    commit.Hash.String(),
+		Author:  commit.Author.Name,
+		Email:   commit.Author.Email,
+		Date:    commit.Author.When,
+		Subject: strings.TrimSpace(strings.SplitN(commit.Message, "\n", 2)[0]),
+	}
+	if commit.NumParents() > 1 {
+		return summary, nil
+	}
+	stats, err := commit.Stats()
+	if err == plumbing.ErrObjectNotFound {
+		// A partial mirror lacks the files its filter left out, and a
+		// shallow one the parents of its oldest commits
+		return summary, nil
+	} else if err != nil {
+		return summary, errors.Wrapf(err, "Error computing the changes of %v", commit.Hash)
+	}
+	for _, stat := range stats {
+		summary.Stat.Files++
+		summary.Stat.Insertions += stat.Addition
+		summary.Stat.Deletions += stat.Deletion
+	}
+	return summary, nil
+}
+
+// Changes returns the report of the changes of mirrors since their last
+// push.
+func (mgr *Manager) Changes(mirrors []*Mirror) (*ChangeReport, error) {
+	report := &ChangeReport{Generated: time.Now(), Mirrors: []*MirrorChanges{}}
+	for _, m := range mirrors {
+		changes, err := m.Changes()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error listing the changes of %v", m)
+		}
+		if !changes.IsZero() {
+			report.Mirrors = append(report.Mirrors, changes)
+		}
+	}
+	return report, nil
+}
+
+// Write writes the report to w in format.
+func (r *ChangeReport) Write(w io.Writer, format ChangeFormat) error {
+	switch format {
+	case ChangeMarkdown:
+		return r.writeMarkdown(w)
+	case ChangeHTML:
+		return changeReportTemplate.Execute(w, r)
+	case ChangeJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	return errors.Errorf("Unknown change report format %#v", format)
+}
+
+func (r *ChangeReport) writeMarkdown(w io.Writer) error {
+	p := &errWriter{w: w}
+	p.printf("# Changes since the last push\n\nGenerated %v, %v repositories with changes.\n", r.Generated.Format(time.RFC1123), len(r.Mirrors))
+	for _, m := range r.Mirrors {
+		p.printf("\n## %v\n\n%v new commits, %v", m.Mirror, m.Commits, m.Stat)
+		if !m.Pushed {
+			p.printf(", never pushed")
+		}
+		p.printf("\n")
+		for _, ref := range m.Refs {
+			p.printf("\n### %v (%v)\n\n", ref.Ref, describeRefChange(ref.RefChange))
+			if len(ref.Commits) == 0 {
+				p.printf("No new commits.\n")
+				continue
+			}
+			p.printf("| Commit | Author | Date | Subject |\n| --- | --- | --- | --- |\n")
+			for _, c := range ref.Commits {
+				p.printf("| %.7v | %v | %v | %v |\n", c.Hash, escapeMarkdownCell(c.Author), c.Date.Format("2006-01-02"), escapeMarkdownCell(c.Subject))
+			}
+			p.printf("\n%v new commits, %v\n", len(ref.Commits), ref.Stat)
+		}
+		if len(m.NewTags) > 0 || len(m.DeletedTags) > 0 {
+			p.printf("\n### Tags\n\n")
+			for _, tag := range m.NewTags {
+				p.printf("- %v: %v\n", strings.TrimPrefix(tag.Ref, "refs/tags/"), describeTagChange(tag))
+			}
+			for _, tag := range m.DeletedTags {
+				p.printf("- %v: deleted\n", strings.TrimPrefix(tag.Ref, "refs/tags/"))
+			}
+		}
+	}
+	return p.err
+}
+
+// describeRefChange describes how a ref changed: new, deleted or moved,
+// with the abbreviated hashes it moved between.
+func describeRefChange(c RefChange) string {
+	switch {
+	case c.Old == "":
+		return "new"
+	case c.New == "":
+		return "deleted"
+	}
+	return fmt.Sprintf("moved %v..%v", shortHash(c.Old), shortHash(c.New))
+}
+
+// describeTagChange describes a new or moved tag.
+func describeTagChange(c RefChange) string {
+	if c.Old == "" {
+		return "new at " + shortHash(c.New)
+	}
+	return describeRefChange(c)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.Replace(s, "|", `\|`, -1)
+}
+
+// errWriter formats to w, keeping the first error.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *errWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+var changeReportTemplate = template.Must(template.New("changes").Funcs(template.FuncMap{
+	"short":       shortHash,
+	"describe":    describeRefChange,
+	"describeTag": describeTagChange,
+	"tagName":     func(ref string) string { return strings.TrimPrefix(ref, "refs/tags/") },
+	"date":        func(t time.Time) string { return t.Format("2006-01-02") },
+	"time":        func(t time.Time) string { return t.Format(time.RFC1123) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Changes since the last push</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 0.5em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Changes since the last push</h1>
+<p>Generated {{time .Generated}}, {{len .Mirrors}} repositories with changes.</p>
+{{range .Mirrors}}
+<h2>{{.Mirror}}</h2>
+<p>{{.Commits}} new commits, {{.Stat}}{{if not .Pushed}}, never pushed{{end}}</p>
+{{range .Refs}}
+<h3>{{.Ref}} ({{describe .RefChange}})</h3>
+{{if .Commits}}
+<table>
+<tr><th>Commit</th><th>Author</th><th>Date</th><th>Subject</th></tr>
+{{range .Commits}}<tr><td><code>{{short .Hash}}</code></td><td>{{.Author}}</td><td>{{date .Date}}</td><td>{{.Subject}}</td></tr>
+{{end}}</table>
+<p>{{len .Commits}} new commits, {{.Stat}}</p>
+{{else}}
+<p>No new commits.</p>
+{{end}}
+{{end}}
+{{if or .NewTags .DeletedTags}}
+<h3>Tags</h3>
+<ul>
+{{range .NewTags}}<li>{{tagName .Ref}}: {{describeTag .}}</li>
+{{end}}{{range .DeletedTags}}<li>{{tagName .Ref}}: deleted</li>
+{{end}}</ul>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// FormatPatches writes the new commits of each ref in changes, the
+// mirror's changes, as a git format-patch series to a directory of dir
+// named after the ref, such as dir/refs/heads/master. Merges are left
+// out. It requires the git executable.
+//
+// cd <gitDir>
+// git format-patch --root --stdin -o <dir>/<ref> <new>  (for each ref, with the pushed commits on stdin)
+func (m *Mirror) FormatPatches(dir string, changes *MirrorChanges) error {
+	pushed, err := m.PushedRefs()
+	if err != nil {
+		return err
+	}
+	var exclude strings.Builder
+	seen := map[string]bool{}
+	for _, hash := range pushed {
+		if !seen[hash] {
+			seen[hash] = true
+			fmt.Fprintf(&exclude, "^%v\n", hash)
+		}
+	}
+
+	for _, ref := range changes.Refs {
+		if len(ref.Commits) == 0 {
+			continue
+		}
+		out := filepath.Join(dir, filepath.FromSlash(ref.Ref))
+		if err := os.RemoveAll(out); err != nil {
+			return errors.Wrap(err, "Error removing old patches")
+		}
+		cmd := exec.Command("git", "format-patch", "--root", "--stdin", "--quiet", "-o", out, ref.New)
+		cmd.Dir = m.GitDir
+		cmd.Stdin = strings.NewReader(exclude.String())
+		if err := runGit(cmd, nil); err != nil {
+			return errors.Wrapf(err, "Error formatting the patches of %v", ref.Ref)
+		}
+	}
+	return nil
+}
+
+// ChangeReportConfig writes a report of the changes since the last push
+// after each fetch run, configured in the changes section of the root's
+// gomir.config.
+type ChangeReportConfig struct {
+	// Dir is the directory receiving the reports, relative to the root
+	// (dir). Reports are off if it's empty.
+	Dir string
+
+	// Formats are the formats of the reports (format, may be repeated),
+	// markdown by default
+	Formats []ChangeFormat
+
+	// Patches also writes the new commits of each mirror as git
+	// format-patch series, to patches/<mirror>/<ref> in Dir (patches)
+	Patches bool
+}
+
+func readChangeReportConfig(options formatconfig.Options) (ChangeReportConfig, error) {
+	c := ChangeReportConfig{Dir: options.Get("dir")}
+	for _, name := range options.GetAll("format") {
+		format, err := ParseChangeFormat(name)
+		if err != nil {
+			return c, err
+		}
+		c.Formats = append(c.Formats, format)
+	}
+	if patches := options.Get("patches"); patches != "" {
+		var err error
+		if c.Patches, err = strconv.ParseBool(patches); err != nil {
+			return c, errors.Errorf("Invalid changes.patches %#v, expected true or false", patches)
+		}
+	}
+	return c, nil
+}
+
+// WriteChangeReport writes report to the files of config, relative to the
+// root, and the patches of its mirrors if configured.
+func (mgr *Manager) WriteChangeReport(report *ChangeReport, config ChangeReportConfig) error {
+	dir := config.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(mgr.Root, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Error creating change report directory")
+	}
+	formats := config.Formats
+	if len(formats) == 0 {
+		formats = []ChangeFormat{ChangeMarkdown}
+	}
+	for _, format := range formats {
+		if err := writeChangeReportFile(filepath.Join(dir, changeReportNames[format]), report, format); err != nil {
+			return err
+		}
+	}
+
+	if !config.Patches {
+		return nil
+	}
+	patches := filepath.Join(dir, "patches")
+	if err := os.RemoveAll(patches); err != nil {
+		return errors.Wrap(err, "Error removing old patches")
+	}
+	for _, changes := range report.Mirrors {
+		m := mgr.mirror(changes.Mirror)
+		if err := m.FormatPatches(filepath.Join(patches, changes.Mirror), changes); err != nil {
+			return errors.Wrapf(err, "Error writing the patches of %v", m)
+		}
+	}
+	return nil
+}
+
+func writeChangeReportFile(name string, report *ChangeReport, format ChangeFormat) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.Wrap(err, "Error writing change report")
+	}
+	if err := report.Write(f, format); err != nil {
+		f.Close()
+		return errors.Wrap(err, "Error writing change report")
+	}
+	return errors.Wrap(f.Close(), "Error writing change report")
+}
+
+// reportChanges writes the change report of the mirrors of a fetch run,
+// if configured, warning about errors.
+func (mgr *Manager) reportChanges(results Results) {
+	if mgr.ChangeReport.Dir == "" {
+		return
+	}
+	mirrors := []*Mirror{}
+	for _, r := range results {
+		mirrors = append(mirrors, r.Mirror)
+	}
+	report, err := mgr.Changes(mirrors)
+	if err == nil {
+		err = mgr.WriteChangeReport(report, mgr.ChangeReport)
+	}
+	if err != nil {
+		mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Error writing change report: %v", err)})
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMirror_Changes(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			upstream := f.newUpstream("project")
+			dest := f.path("destination", "project.git")
+			m := f.add(mgr, "file://"+upstream, "file://"+dest)
+
+			changes, err := m.Changes()
+			if err != nil {
+				t.Fatalf("Changes() error = %+v", err)
+			}
+			if changes.Pushed || changes.Commits != 1 || len(changes.Refs) != 2 {
+				t.Errorf("Changes() = %+v, want the whole history of a mirror never pushed", changes)
+			}
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			if changes, err := m.Changes(); err != nil || !changes.IsZero() {
+				t.Fatalf("Changes() = %+v, %v, want no changes after a push", changes, err)
+			}
+
+			old := f.refs(m.GitDir)["refs/heads/master"]
+			first := f.commitFile(upstream, "README.md", "# Project\n\nMirrored | reviewed\n")
+			second := f.commitFile(upstream, "README.md", "# Project\n")
+			f.git(upstream, "checkout", "-q", "-b", "topic")
+			topic := f.commit(upstream, "Start topic")
+			f.git(upstream, "checkout", "-q", "master")
+			f.git(upstream, "tag", "v2.0")
+			f.git(upstream, "tag", "-d", "v1.0")
+			if !fetch(mgr, m) {
+				t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+			}
+
+			changes, err = m.Changes()
+			if err != nil {
+				t.Fatalf("Changes() error = %+v", err)
+			}
+			if !changes.Pushed || changes.Commits != 3 || changes.Stat != (Diffstat{Files: 2, Insertions: 3, Deletions: 2}) {
+				t.Errorf("Changes() = %+v, want 3 commits changing 2 files", changes)
+			}
+			refs := map[string][]string{}
+			for _, r := range changes.Refs {
+				for _, c := range r.Commits {
+					refs[r.Ref] = append(refs[r.Ref], c.Hash)
+				}
+			}
+			want := map[string][]string{
+				"refs/heads/master": {second, first},
+				"refs/heads/topic":  {topic, second, first},
+			}
+			if !reflect.DeepEqual(refs, want) {
+				t.Errorf("Changes().Refs commits = %v, want %v", refs, want)
+			}
+			if master := changes.Refs[0]; master.Old != old || master.Commits[0].Subject != "Add README.md" || master.Commits[0].Author == "" {
+				t.Errorf("Changes().Refs[0] = %+v, want master moved from %v", master, old)
+			}
+			if len(changes.NewTags) != 1 || changes.NewTags[0].Ref != "refs/tags/v2.0" ||
+				len(changes.DeletedTags) != 1 || changes.DeletedTags[0].Ref != "refs/tags/v1.0" {
+				t.Errorf("Changes() tags = %+v and %+v, want v2.0 new and v1.0 deleted", changes.NewTags, changes.DeletedTags)
+			}
+		})
+	}
+}
+
+func TestChangeReport_Write(t *testing.T) {
+	report := &ChangeReport{Mirrors: []*MirrorChanges{{
+		Mirror: "github.com/pkg/errors.git",
+		Pushed: true,
+		Refs: []RefChanges{{
+			RefChange: RefChange{Ref: "refs/heads/master", Old: "30136e27e2ac8d167177e8a583aa4c3fea5be833", New: "614d223910a179a466c1767a985424175c39b465"},
+			Commits: []CommitSummary{{
+				Hash: "614d223910a179a466c1767a985424175c39b465", Author: "Dave", Subject: "Fix <nil> | errors",
+				Stat: Diffstat{Files: 1, Insertions: 2, Deletions: 1},
+			}},
+			Stat: Diffstat{Files: 1, Insertions: 2, Deletions: 1},
+		}},
+		NewTags:     []RefChange{{Ref: "refs/tags/v0.8.1", New: "614d223910a179a466c1767a985424175c39b465"}},
+		DeletedTags: []RefChange{{Ref: "refs/tags/v0.8.0", Old: "30136e27e2ac8d167177e8a583aa4c3fea5be833"}},
+		Commits:     1,
+		Stat:        Diffstat{Files: 1, Insertions: 2, Deletions: 1},
+	}}}
+
+	tests := []struct {
+		format ChangeFormat
+		want   []string
+	}{
+		{ChangeMarkdown, []string{
+			"## github.com/pkg/errors.git",
+			"### refs/heads/master (moved 30136e2..614d223)",
+			`| 614d223 | Dave | 0001-01-01 | Fix <nil> \| errors |`,
+			"1 new commits, 1 files changed, 2 insertions(+), 1 deletions(-)",
+			"- v0.8.1: new at 614d223",
+			"- v0.8.0: deleted",
+		}},
+		{ChangeHTML, []string{
+			"<h2>github.com/pkg/errors.git</h2>",
+			"<td>Fix &lt;nil&gt; | errors</td>",
+			"<li>v0.8.1: new at 614d223</li>",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := report.Write(&buf, tt.format); err != nil {
+				t.Fatalf("Write() error = %+v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("Write() lacks %q:\n%v", want, buf.String())
+				}
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf, ChangeJSON); err != nil {
+		t.Fatalf("Write() error = %+v", err)
+	}
+	got := &ChangeReport{}
+	if err := json.Unmarshal(buf.Bytes(), got); err != nil || !reflect.DeepEqual(got, report) {
+		t.Errorf("Write() JSON = %v, want %+v", buf.String(), report)
+	}
+}
+
+func TestManager_Fetch_changeReport(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	m := f.add(mgr, "file://"+upstream, "file://"+f.path("destination", "project.git"))
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	mgr.ChangeReport = ChangeReportConfig{Dir: "reports", Formats: []ChangeFormat{ChangeMarkdown, ChangeJSON}, Patches: true}
+
+	f.commitFile(upstream, "main.go", "package main\n")
+	f.commitFile(upstream, "main_test.go", "package main\n")
+	if _, err := mgr.Fetch(); err != nil {
+		t.Fatalf("Fetch() error = %+v", err)
+	}
+
+	markdown, err := ioutil.ReadFile(f.path("mirrors", "reports", "changes.md"))
+	if err != nil || !strings.Contains(string(markdown), "Add main_test.go") {
+		t.Errorf("changes.md = %s, %v, want the new commits", markdown, err)
+	}
+	if _, err := ioutil.ReadFile(f.path("mirrors", "reports", "changes.json")); err != nil {
+		t.Errorf("Error reading changes.json: %v", err)
+	}
+	patches, _ := filepath.Glob(f.path("mirrors", "reports", "patches", m.Path, "refs", "heads", "master", "*.patch"))
+	if len(patches) != 2 || !strings.HasSuffix(patches[1], "0002-Add-main_test.go.patch") {
+		t.Errorf("Patches = %v, want a series of 2", patches)
+	}
+}
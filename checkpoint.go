@@ -0,0 +1,197 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Selection chooses which mirrors an operation runs on, based on the
+// checkpoint of the previous run of that operation.
+type Selection int
+
+// Selections
+const (
+	// SelectAll runs on every mirror and starts a new checkpoint
+	SelectAll Selection = iota
+	// SelectUnfinished runs on the mirrors that did not succeed in the
+	// last run, including those it never got to
+	SelectUnfinished
+	// SelectFailed runs on the mirrors that failed in the last run
+	SelectFailed
+)
+
+// MirrorState is the progress of a single mirror within a run.
+type MirrorState string
+
+// Mirror states recorded in a checkpoint
+const (
+	StatePending   MirrorState = "pending"
+	StateSucceeded MirrorState = "succeeded"
+	StateFailed    MirrorState = "failed"
+)
+
+// Checkpoint records the progress of the last run of an operation. It is
+// saved in the root after every mirror finishes, so an interrupted run
+// can be resumed.
+type Checkpoint struct {
+	Op       Operation              `json:"op"`
+	Started  time.Time              `json:"started"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Mirrors  map[string]MirrorState `json:"mirrors"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// checkpointPath returns the path of the checkpoint of op's last run.
+func (mgr *Manager) checkpointPath(op Operation) string {
+	return filepath.Join(mgr.Root, fmt.Sprintf(".gomir-%v.checkpoint", op))
+}
+
+// Checkpoint returns the checkpoint of the last run of op, or nil if
+// there is none.
+func (mgr *Manager) Checkpoint(op Operation) (*Checkpoint, error) {
+	path := mgr.checkpointPath(op)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading checkpoint")
+	}
+
+	cp := &Checkpoint{path: path}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing checkpoint %v", path)
+	}
+	if cp.Mirrors == nil {
+		cp.Mirrors = map[string]MirrorState{}
+	}
+	return cp, nil
+}
+
+// openCheckpoint returns the checkpoint of the last run of op, or a new
+// one if there is none, to record the progress of runs that don't start
+// a new checkpoint.
+func (mgr *Manager) openCheckpoint(op Operation) (*Checkpoint, error) {
+	cp, err := mgr.Checkpoint(op)
+	if cp != nil || err != nil {
+		return cp, err
+	}
+	return &Checkpoint{
+		Op:      op,
+		Started: time.Now().UTC(),
+		Mirrors: map[string]MirrorState{},
+		path:    mgr.checkpointPath(op),
+	}, nil
+}
+
+// states returns a copy of the mirror states, or nil for a nil
+// checkpoint.
+func (cp *Checkpoint) states() map[string]MirrorState {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	states := map[string]MirrorState{}
+	for path, state := range cp.Mirrors {
+		states[path] = state
+	}
+	return states
+}
+
+// selectMirrors returns the mirrors op should run on and the checkpoint
+// to record its progress in.
+func (mgr *Manager) selectMirrors(op Operation, sel Selection, mirrors []*Mirror) ([]*Mirror, *Checkpoint, error) {
+	last, err := mgr.Checkpoint(op)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sel == SelectAll || (sel == SelectUnfinished && last == nil) {
+		cp := &Checkpoint{
+			Op:      op,
+			Started: time.Now().UTC(),
+			Mirrors: map[string]MirrorState{},
+			path:    mgr.checkpointPath(op),
+		}
+		for _, m := range mirrors {
+			cp.Mirrors[m.Path] = StatePending
+		}
+		return mirrors, cp, cp.save()
+	}
+	if last == nil {
+		return []*Mirror{}, nil, nil
+	}
+
+	selected := []*Mirror{}
+	for _, m := range mirrors {
+		state, ok := last.Mirrors[m.Path]
+		switch {
+		case sel == SelectUnfinished && (!ok || state != StateSucceeded),
+			sel == SelectFailed && state == StateFailed:
+			selected = append(selected, m)
+			last.Mirrors[m.Path] = StatePending
+		}
+	}
+	last.Finished = nil
+	return selected, last, last.save()
+}
+
+// record saves the outcome of an operation on m.
+func (cp *Checkpoint) record(m *Mirror, err error) error {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.Mirrors[m.Path] = StateSucceeded
+	if err != nil {
+		cp.Mirrors[m.Path] = StateFailed
+	}
+	return cp.saveLocked()
+}
+
+// finish marks the run as complete.
+func (cp *Checkpoint) finish() error {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	finished := time.Now().UTC()
+	cp.Finished = &finished
+	return cp.saveLocked()
+}
+
+func (cp *Checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.saveLocked()
+}
+
+// saveLocked replaces the checkpoint file, so an interruption leaves
+// either the old or the new checkpoint behind.
+func (cp *Checkpoint) saveLocked() error {
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Error encoding checkpoint")
+	}
+
+	return errors.Wrap(writeFileAtomic(cp.path, content), "Error writing checkpoint")
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestManager_forEach_checkpoint(t *testing.T) {
+	f := newFixture(t)
+	for _, name := range []string{"a.git", "b.git", "c.git", "d.git"} {
+		f.git(f.dir, "init", "-q", "--bare", f.path("mirrors", name))
+	}
+	mgr := f.manager("exec")
+
+	// run records the mirrors fn is called for, failing those in fail
+	run := func(sel Selection, fail ...string) []string {
+		t.Helper()
+		var mu sync.Mutex
+		ran := []string{}
+		_, err := mgr.forEach(OpPush, sel, func(m *Mirror) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, m.Path)
+			for _, name := range fail {
+				if m.Path == name {
+					return errors.New("failure")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("forEach() error = %+v", err)
+		}
+		sort.Strings(ran)
+		return ran
+	}
+
+	if got := run(SelectFailed); len(got) != 0 {
+		t.Errorf("SelectFailed without a checkpoint ran %v, want nothing", got)
+	}
+
+	run(SelectAll, "b.git", "c.git")
+	cp, err := mgr.Checkpoint(OpPush)
+	if err != nil || cp == nil {
+		t.Fatalf("Checkpoint() = %v, %v", cp, err)
+	}
+	want := map[string]MirrorState{"a.git": StateSucceeded, "b.git": StateFailed, "c.git": StateFailed, "d.git": StateSucceeded}
+	if !reflect.DeepEqual(cp.Mirrors, want) || cp.Finished == nil {
+		t.Errorf("Checkpoint() = %+v, want %v and finished", cp, want)
+	}
+
+	// Simulate a run interrupted before it got to d.git
+	cp.Mirrors["d.git"] = StatePending
+	if err := cp.save(); err != nil {
+		t.Fatalf("save() error = %+v", err)
+	}
+
+	if got, want := run(SelectFailed, "c.git"), []string{"b.git", "c.git"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectFailed ran %v, want %v", got, want)
+	}
+	if got, want := run(SelectUnfinished), []string{"c.git", "d.git"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectUnfinished ran %v, want %v", got, want)
+	}
+	if got := run(SelectUnfinished); len(got) != 0 {
+		t.Errorf("SelectUnfinished after everything succeeded ran %v, want nothing", got)
+	}
+	if got := run(SelectAll); len(got) != 4 {
+		t.Errorf("SelectAll ran %v, want every mirror", got)
+	}
+
+	if cp, _ := mgr.Checkpoint(OpFetch); cp != nil {
+		t.Errorf("Push wrote a fetch checkpoint")
+	}
+}
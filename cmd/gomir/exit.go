@@ -0,0 +1,95 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/blachniet/gomir"
+	"github.com/pkg/errors"
+)
+
+// Exit codes. These are documented in the README and in `gomir --help`;
+// schedulers rely on them, so don't renumber them.
+const (
+	// exitOK means everything succeeded
+	exitOK = 0
+	// exitFailure means the command failed, or every repository failed
+	exitFailure = 1
+	// exitPartialFailure means some, but not all, repositories failed
+	exitPartialFailure = 2
+	// exitConfigError means the arguments, flags or configuration are
+	// invalid
+	exitConfigError = 3
+	// exitLockContention means another gomir process is using the mirrors
+	exitLockContention = 4
+)
+
+const exitCodesHelp = `Exit codes:
+  0  Success
+  1  The command failed, or every repository failed
+  2  Some, but not all, repositories failed
+  3  Invalid arguments, flags or configuration
+  4  Another gomir process is using the mirrors`
+
+// exitError is an error that ends gomir with a specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the code gomir should exit with after err. Errors that
+// don't carry a code come from cobra rejecting the command line.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return exitConfigError
+}
+
+// failureCode returns exitLockContention if err was caused by another
+// gomir process holding a lock, otherwise code.
+func failureCode(err error, code int) int {
+	if _, ok := errors.Cause(err).(*gomir.LockError); ok {
+		return exitLockContention
+	}
+	return code
+}
+
+// resultsError summarizes the failed repositories of an operation, if any.
+// If they all failed because other gomir processes held their locks, it
+// exits with exitLockContention.
+func resultsError(name string, failed gomir.Results, total int) error {
+	locked := true
+	for _, r := range failed {
+		if failureCode(r.Err, exitFailure) != exitLockContention {
+			locked = false
+		}
+	}
+	switch {
+	case len(failed) == 0:
+		return nil
+	case locked:
+		return withExitCode(exitLockContention, fmt.Errorf("%v skipped %v of %v repos locked by another gomir process", name, len(failed), total))
+	case len(failed) == total:
+		return withExitCode(exitFailure, fmt.Errorf("%v failed for all %v repos", name, total))
+	default:
+		return withExitCode(exitPartialFailure, fmt.Errorf("%v failed for %v of %v repos", name, len(failed), total))
+	}
+}
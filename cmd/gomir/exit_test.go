@@ -0,0 +1,41 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blachniet/gomir"
+)
+
+func Test_exitCode(t *testing.T) {
+	failed := &gomir.Result{Err: errors.New("fetch failed")}
+	locked := &gomir.Result{Err: &gomir.LockError{Path: "project.git.lock"}}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Success", nil, exitOK},
+		{"UsageError", errors.New("unknown flag"), exitConfigError},
+		{"CommandFailed", withExitCode(exitFailure, errors.New("clone failed")), exitFailure},
+		{"NoFailures", resultsError("Fetch", nil, 3), exitOK},
+		{"SomeFailed", resultsError("Fetch", gomir.Results{failed}, 3), exitPartialFailure},
+		{"AllFailed", resultsError("Push", gomir.Results{failed, failed, failed}, 3), exitFailure},
+		{"SomeLocked", resultsError("Push", gomir.Results{locked}, 3), exitLockContention},
+		{"LockedAndFailed", resultsError("Push", gomir.Results{locked, failed}, 3), exitPartialFailure},
+		{"LockHeld", withExitCode(exitLockContention, errors.New("locked")), exitLockContention},
+		{"LockError", withExitCode(failureCode(&gomir.LockError{Path: ".gomir.lock"}, exitConfigError), errors.New("locked")), exitLockContention},
+		{"OtherError", withExitCode(failureCode(errors.New("fetch failed"), exitConfigError), errors.New("failed")), exitConfigError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
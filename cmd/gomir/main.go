@@ -0,0 +1,715 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+Gomir mirrors git repositories
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blachniet/gomir"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// TODO: Add support for controlling concurrency during fetch/push
+// TODO: Add documentation describing where repos are stored
+// TODO: Add documentation describing what to do if something goes wrong during a fetch/push
+
+// Set via ldflags
+var version string
+var gitCommit string
+var buildDate string
+
+func main() {
+	mgr := gomir.NewManager(".")
+	mgr.OnEvent = printEvent
+
+	var backendName string
+	var lockWait time.Duration
+	var metricsTextfile string
+	var metricsListen string
+	var reportDir string
+	var progressMode string
+	var bandwidthLimit string
+	// loadConfig reads gomir.config and applies the flags overriding it
+	loadConfig := func() error {
+		if err := mgr.LoadConfig(); err != nil {
+			return err
+		}
+		if reportDir != "" {
+			mgr.RunReportDir = reportDir
+		}
+		if bandwidthLimit != "" {
+			limit, err := gomir.ParseBandwidthLimit(bandwidthLimit)
+			if err != nil {
+				return err
+			}
+			mgr.BandwidthLimit = limit
+		}
+		return nil
+	}
+	rootCmd := &cobra.Command{
+		Use:           "gomir",
+		Long:          "Mirror Git repositories between two disconnected networks\n\n" + exitCodesHelp,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The command line was valid, so further errors don't warrant
+			// printing usage
+			cmd.SilenceUsage = true
+
+			if err := validateProgressMode(progressMode); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			mgr.LockWait = lockWait
+			if err := loadConfig(); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			if metricsTextfile != "" || metricsListen != "" {
+				if err := mgr.LoadMetrics(); err != nil {
+					return withExitCode(exitConfigError, err)
+				}
+			}
+
+			var err error
+			mgr.Backend, err = gomir.NewGitBackend(backendName)
+			return withExitCode(exitConfigError, err)
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(&backendName, "backend", "exec",
+		"Git implementation to use: exec (the git executable) or go-git (built in)")
+	rootCmd.PersistentFlags().DurationVar(&lockWait, "wait", 0,
+		"How long to wait for another gomir process to release the mirrors, e.g. 5m")
+	rootCmd.PersistentFlags().StringVar(&metricsTextfile, "metrics-textfile", "",
+		"Write Prometheus metrics to this file for node exporter's textfile collector")
+	rootCmd.PersistentFlags().StringVar(&reportDir, "report-dir", "",
+		"Write an HTML report of each fetch and push run to this directory")
+	rootCmd.PersistentFlags().StringVar(&progressMode, "progress", progressAuto,
+		"How fetch and push show progress: auto (live on a terminal), plain (printed every 10s) or none")
+	rootCmd.PersistentFlags().StringVar(&bandwidthLimit, "bandwidth-limit", "",
+		"Limit the traffic with http and ssh remotes to this many bytes per second, e.g. 2m")
+
+	var addOpts gomir.MirrorOptions
+	var fetchCredentials, pushCredentials, hooks []string
+	addCmd := &cobra.Command{
+		Use:   "add <fetchURL> <pushURL> [<localDest>]",
+		Short: "Add a repository to mirror",
+		Long: `Add a repository to mirror.
+
+Credentials for the source and the destination are given as key=value
+settings with --fetch-credential and --push-credential, for example
+--push-credential sshKey=/etc/gomir/deploy_key. The keys are sshKey,
+knownHosts, username, tokenEnv, tokenFile, sslCert and sslKey. Tokens are
+read from the named environment variable or file whenever gomir connects,
+so they are never stored with the mirror. Credentials for every repository
+on a host may be set in gomir.config instead, see the README.
+
+Hooks are shell commands run before and after each operation on the
+mirror, given as key=command settings with --hook, for example
+--hook postFetch=./scan.sh. The keys are preAdd, postAdd, preFetch,
+postFetch, prePush and postPush. A failing pre hook aborts the operation.`,
+		Args: cobra.RangeArgs(2, 3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			localDest := ""
+			if len(args) == 3 {
+				localDest = args[2]
+			}
+			if err := parseCredentials(&addOpts.FetchCredentials, fetchCredentials); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			if err := parseCredentials(&addOpts.PushCredentials, pushCredentials); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			if err := parseHooks(&addOpts.Hooks, hooks); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			_, err := mgr.Add(args[0], args[1], localDest, addOpts)
+			return withExitCode(failureCode(err, exitFailure), err)
+		},
+	}
+	addCmd.Flags().IntVar(&addOpts.Depth, "depth", 0,
+		"Only mirror this many commits from the tip of each ref")
+	addCmd.Flags().StringVar(&addOpts.ShallowSince, "shallow-since", "",
+		"Only mirror commits newer than this date")
+	addCmd.Flags().StringVar(&addOpts.Filter, "filter", "",
+		"Leave objects matching this partial clone filter out of the mirror, e.g. blob:limit=1m")
+	addCmd.Flags().StringVar(&addOpts.FetchSchedule, "fetch-schedule", "",
+		"When the daemon fetches this repository: an interval, a cron expression or never")
+	addCmd.Flags().StringVar(&addOpts.PushSchedule, "push-schedule", "",
+		"When the daemon pushes this repository: an interval, a cron expression or never")
+	addCmd.Flags().StringArrayVar(&fetchCredentials, "fetch-credential", nil,
+		"Credential setting for the source as key=value, may be repeated")
+	addCmd.Flags().StringArrayVar(&pushCredentials, "push-credential", nil,
+		"Credential setting for the destination as key=value, may be repeated")
+	addCmd.Flags().StringArrayVar(&hooks, "hook", nil,
+		"Hook run before or after an operation as key=command, may be repeated")
+
+	var fetchSel selectionFlags
+	fetchCmd := &cobra.Command{
+		Use:   "fetch",
+		Short: "Fetch changes for all mirroed repositories",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sel, err := fetchSel.selection()
+			if err != nil {
+				return err
+			}
+			return report("Fetch", withProgress(mgr, progressMode, "Fetch", func() (gomir.Results, error) {
+				return mgr.FetchSelected(sel)
+			}))
+		},
+	}
+	fetchSel.register(fetchCmd, "fetch")
+
+	var pushSel selectionFlags
+	pushCmd := &cobra.Command{
+		Use:   "push",
+		Short: "Push changes for all mirrored repositories",
+		Long: `Push changes for all mirrored repositories to each of their destinations.
+
+With --dest, only the named destinations are pushed; repositories without
+any of them are skipped.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sel, err := pushSel.selection()
+			if err != nil {
+				return err
+			}
+			return report("Push", withProgress(mgr, progressMode, "Push", func() (gomir.Results, error) {
+				return mgr.PushSelected(sel)
+			}))
+		},
+	}
+	pushSel.register(pushCmd, "push")
+	pushCmd.Flags().StringArrayVar(&mgr.PushDestinations, "dest", nil,
+		"Only push to the destination with this name, may be repeated")
+
+	var destRefs, destMap, destCredentials []string
+	destCmd := &cobra.Command{
+		Use:   "destination",
+		Short: "Manage the destinations a repository is pushed to",
+		Long: `Manage the destinations a repository is pushed to.
+
+Every repository pushes to the origin destination given to gomir add, and to
+any number of named destinations added here.`,
+	}
+	destAddCmd := &cobra.Command{
+		Use:   "add <localDest> <name> <pushURL>",
+		Short: "Add or replace a destination of a repository",
+		Long: `Add or replace a destination of a repository.
+
+By default every ref is pushed. With --ref, only the refs matching the given
+names or patterns are pushed, such as --ref 'refs/heads/*' --ref 'refs/tags/v*'.
+With --map, the matching refs are pushed under another name, such as
+--map 'refs/heads/*:refs/heads/mirror/*' or
+--map refs/heads/main:refs/heads/upstream-main. Refs on the destination that
+match neither are left alone. Use gomir destination preview to check the
+result. Credentials are given as with gomir add --push-credential.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			dest := gomir.Destination{Name: args[1], URL: args[2], Refs: destRefs, Map: destMap}
+			if err := parseCredentials(&dest.Credentials, destCredentials); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			return withExitCode(exitConfigError, m.SetDestination(dest))
+		},
+	}
+	destAddCmd.Flags().StringArrayVar(&destRefs, "ref", nil,
+		"Only push refs matching this name or pattern, may be repeated")
+	destAddCmd.Flags().StringArrayVar(&destMap, "map", nil,
+		"Push refs matching the source side of this source:destination rule to the destination side, may be repeated")
+	destAddCmd.Flags().StringArrayVar(&destCredentials, "credential", nil,
+		"Credential setting for the destination as key=value, may be repeated")
+	destRemoveCmd := &cobra.Command{
+		Use:   "remove <localDest> <name>",
+		Short: "Stop pushing a repository to a destination",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			return withExitCode(exitConfigError, m.RemoveDestination(args[1]))
+		},
+	}
+	destListCmd := &cobra.Command{
+		Use:   "list <localDest>",
+		Short: "List the destinations of a repository",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			dests, err := m.Destinations()
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			for _, d := range dests {
+				refs := "all refs"
+				if !d.IsMirror() {
+					refs = strings.Join(append(append([]string{}, d.Refs...), d.Map...), " ")
+				}
+				fmt.Printf("%v\t%v\t%v\n", d.Name, gomir.Redact(d.URL), refs)
+			}
+			return nil
+		},
+	}
+	destPreviewCmd := &cobra.Command{
+		Use:   "preview <localDest> [<name>...]",
+		Short: "Show where the refs of a repository are pushed",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			dests, err := m.Destinations()
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			for _, d := range dests {
+				if len(args) > 1 && !contains(args[1:], d.Name) {
+					continue
+				}
+				mappings, err := m.MapRefs(d)
+				if err != nil {
+					return withExitCode(exitConfigError, err)
+				}
+				for _, mapping := range mappings {
+					fmt.Printf("%v\t%v -> %v\n", d.Name, mapping.Src, mapping.Dst)
+				}
+			}
+			return nil
+		},
+	}
+	destCmd.AddCommand(destAddCmd, destRemoveCmd, destListCmd, destPreviewCmd)
+
+	var sourceNamespace string
+	var sourceCredentials []string
+	sourceCmd := &cobra.Command{
+		Use:   "source",
+		Short: "Manage the sources a repository is fetched from",
+		Long: `Manage the sources a repository is fetched from.
+
+Every repository fetches from the origin source given to gomir add. Named
+sources added here are fetched alongside it, each into its own namespace: the
+branches and tags of a source with the namespace vendor become
+refs/heads/vendor/* and refs/tags/vendor/*. The refs of all sources are
+pushed together.`,
+	}
+	sourceAddCmd := &cobra.Command{
+		Use:   "add <localDest> <name> <fetchURL>",
+		Short: "Add or replace a source of a repository",
+		Long: `Add or replace a source of a repository.
+
+Every source but origin needs a --namespace. Setting one for origin renames
+its refs as well, after which origin only contributes its branches and tags.
+Credentials are given as with gomir add --fetch-credential.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			source := gomir.Source{Name: args[1], URL: args[2], Namespace: sourceNamespace}
+			if err := parseCredentials(&source.Credentials, sourceCredentials); err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			return withExitCode(exitConfigError, m.SetSource(source))
+		},
+	}
+	sourceAddCmd.Flags().StringVar(&sourceNamespace, "namespace", "",
+		"Fetch the source's branches and tags into this namespace, e.g. vendor")
+	sourceAddCmd.Flags().StringArrayVar(&sourceCredentials, "credential", nil,
+		"Credential setting for the source as key=value, may be repeated")
+	sourceRemoveCmd := &cobra.Command{
+		Use:   "remove <localDest> <name>",
+		Short: "Stop fetching a repository from a source",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			return withExitCode(exitConfigError, m.RemoveSource(args[1]))
+		},
+	}
+	sourceListCmd := &cobra.Command{
+		Use:   "list <localDest>",
+		Short: "List the sources of a repository",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := mgr.Mirror(args[0])
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			sources, err := m.Sources()
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			for _, s := range sources {
+				refs := "all refs"
+				if s.Namespace != "" {
+					refs = fmt.Sprintf("refs/heads/%v/* refs/tags/%v/*", s.Namespace, s.Namespace)
+				}
+				fmt.Printf("%v\t%v\t%v\n", s.Name, gomir.Redact(s.URL), refs)
+			}
+			return nil
+		},
+	}
+	sourceCmd.AddCommand(sourceAddCmd, sourceRemoveCmd, sourceListCmd)
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List mirrored repositories",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mirrors, err := mgr.List()
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			for _, m := range mirrors {
+				fmt.Println(m)
+			}
+			return nil
+		},
+	}
+
+	var changesFormat, changesOutput, changesPatches string
+	changesCmd := &cobra.Command{
+		Use:   "changes [<localDest>...]",
+		Short: "Report the changes each repository would push",
+		Long: `Report the changes of each repository since its last push: the refs that
+moved, the new commits of each with their author, date and subject, the new
+and deleted tags, and how many lines the commits change.
+
+The report covers every repository, or the given ones, in Markdown, HTML or
+JSON. With --patches, the new commits of each ref are also written as a git
+format-patch series for line-by-line review, to
+<dir>/<localDest>/refs/heads/<branch>. gomir fetch can write the report
+automatically, see the README.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, err := gomir.ParseChangeFormat(changesFormat)
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			mirrors, err := selectMirrors(mgr, args)
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			report, err := mgr.Changes(mirrors)
+			if err != nil {
+				return withExitCode(exitFailure, err)
+			}
+			if err := writeChangeReport(report, format, changesOutput); err != nil {
+				return withExitCode(exitFailure, err)
+			}
+			if changesPatches == "" {
+				return nil
+			}
+			for _, changes := range report.Mirrors {
+				m, err := mgr.Mirror(changes.Mirror)
+				if err != nil {
+					return withExitCode(exitFailure, err)
+				}
+				if err := m.FormatPatches(filepath.Join(changesPatches, changes.Mirror), changes); err != nil {
+					return withExitCode(exitFailure, err)
+				}
+			}
+			return nil
+		},
+	}
+	changesCmd.Flags().StringVar(&changesFormat, "format", "markdown",
+		"Report format: markdown, html or json")
+	changesCmd.Flags().StringVarP(&changesOutput, "output", "o", "",
+		"Write the report to this file instead of stdout")
+	changesCmd.Flags().StringVar(&changesPatches, "patches", "",
+		"Also write the new commits as git format-patch series to this directory")
+
+	var shutdownTimeout time.Duration
+	daemon := gomir.NewDaemon(mgr)
+	daemon.LoadConfig = loadConfig
+	daemonCmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Fetch and push repositories on a schedule",
+		Long: `Fetch and push repositories on a schedule until interrupted.
+
+Schedules are intervals, such as 30m or 6h, or cron expressions with five
+fields (minute, hour, day of month, month, day of week), such as "0 2 * * *".
+Repositories may override the default schedules, see gomir add --help.
+
+Send SIGHUP to reload gomir.config, the repositories and their schedules
+once the running operations finish. If gomir.config is invalid, the error is
+reported and the current configuration kept. On SIGINT or SIGTERM, gomir
+stops scheduling and waits for running operations to finish, cancelling them
+after the shutdown timeout or on a second signal.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if daemon.FetchSchedule == "" && daemon.PushSchedule == "" {
+				fmt.Println("No default schedules, only repositories with their own schedules will be mirrored")
+			}
+			for _, schedule := range []string{daemon.FetchSchedule, daemon.PushSchedule} {
+				if schedule != "" {
+					if _, err := gomir.ParseSchedule(schedule); err != nil {
+						return withExitCode(exitConfigError, err)
+					}
+				}
+			}
+			err := runDaemon(mgr, daemon, shutdownTimeout, metricsListen)
+			return withExitCode(failureCode(err, exitFailure), err)
+		},
+	}
+	daemonCmd.Flags().StringVar(&daemon.FetchSchedule, "fetch-schedule", "",
+		"Default schedule for fetching repositories")
+	daemonCmd.Flags().StringVar(&daemon.PushSchedule, "push-schedule", "",
+		"Default schedule for pushing repositories")
+	daemonCmd.Flags().DurationVar(&daemon.Jitter, "jitter", 0,
+		"Delay each scheduled run by a random duration up to this long")
+	daemonCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", time.Minute,
+		"How long to wait for running operations when shutting down")
+	daemonCmd.Flags().StringVar(&metricsListen, "metrics-listen", "",
+		"Serve Prometheus metrics at /metrics on this address, e.g. :9540")
+
+	var webhookListen, webhookSecretFile string
+	webhook := gomir.NewWebhookHandler(mgr, "")
+	webhookCmd := &cobra.Command{
+		Use:   "webhook",
+		Short: "Fetch repositories when GitHub, GitLab or Gitea report a push",
+		Long: `Receive push webhooks from GitHub, GitLab and Gitea and fetch the repository
+whose origin matches the pushed repository.
+
+Configure the webhook to send push events as JSON to this server, with a
+secret. GitHub and Gitea sign the events with the secret; GitLab sends it as
+a token. Provide the secret in the GOMIR_WEBHOOK_SECRET environment variable
+or with --secret-file.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secret, err := webhookSecret(webhookSecretFile)
+			if err != nil {
+				return withExitCode(exitConfigError, err)
+			}
+			webhook.Secret = secret
+			return withExitCode(exitConfigError, runWebhook(mgr, webhook, webhookListen, shutdownTimeout))
+		},
+	}
+	webhookCmd.Flags().StringVar(&webhookListen, "listen", ":8080",
+		"Address to receive webhooks on")
+	webhookCmd.Flags().StringVar(&webhookSecretFile, "secret-file", "",
+		"Read the webhook secret from this file instead of GOMIR_WEBHOOK_SECRET")
+	webhookCmd.Flags().BoolVar(&webhook.Push, "push", false,
+		"Push repositories after fetching them")
+	webhookCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", time.Minute,
+		"How long to wait for a running operation when shutting down")
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Show gomir version information",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("  Version:    %v\n", version)
+			fmt.Printf("  Git commit: %v\n", gitCommit)
+			fmt.Printf("  Built:      %v\n", buildDate)
+		},
+	}
+
+	rootCmd.AddCommand(addCmd, fetchCmd, pushCmd, sourceCmd, destCmd, listCmd, changesCmd, daemonCmd, webhookCmd, versionCmd)
+	err := rootCmd.Execute()
+	if metricsErr := writeMetrics(mgr, metricsTextfile); metricsErr != nil {
+		color.Red("Error: %v", gomir.Redact(metricsErr.Error()))
+	}
+	if err != nil {
+		color.Red("Error: %v", gomir.Redact(err.Error()))
+		os.Exit(exitCode(err))
+	}
+}
+
+// webhookSecret reads the webhook secret from path, or from the
+// environment if path is empty.
+func webhookSecret(path string) (string, error) {
+	secret := os.Getenv("GOMIR_WEBHOOK_SECRET")
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(content))
+	}
+	if secret == "" {
+		return "", errors.New("A webhook secret is required, set GOMIR_WEBHOOK_SECRET or use --secret-file")
+	}
+	gomir.AddSecret(secret)
+	return secret, nil
+}
+
+// selectMirrors returns the mirrors at paths, or every mirror if there are
+// none.
+func selectMirrors(mgr *gomir.Manager, paths []string) ([]*gomir.Mirror, error) {
+	if len(paths) == 0 {
+		return mgr.List()
+	}
+	mirrors := []*gomir.Mirror{}
+	for _, path := range paths {
+		m, err := mgr.Mirror(path)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
+
+// writeChangeReport writes report in format to the file output, or to
+// stdout if output is empty.
+func writeChangeReport(report *gomir.ChangeReport, format gomir.ChangeFormat, output string) error {
+	if output == "" {
+		return report.Write(os.Stdout, format)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeMetrics saves the metrics collected during the command, if any,
+// and writes them to textfile if set.
+func writeMetrics(mgr *gomir.Manager, textfile string) error {
+	if mgr.Metrics == nil {
+		return nil
+	}
+	if err := mgr.SaveMetrics(); err != nil {
+		return err
+	}
+	if textfile == "" {
+		return nil
+	}
+	return mgr.Metrics.WriteTextfile(textfile)
+}
+
+// report runs an operation across all mirrors and returns an error if any
+// of them failed.
+func report(name string, run func() (gomir.Results, error)) error {
+	results, err := run()
+	if err != nil {
+		return withExitCode(failureCode(err, exitConfigError), err)
+	}
+
+	if len(results) == 0 {
+		fmt.Printf("%v: no repositories selected\n", name)
+	}
+
+	failed := results.Failed()
+	for _, r := range failed {
+		color.Red("%v: %v", r.Mirror, r.Err)
+	}
+	return resultsError(name, failed, len(results))
+}
+
+// selectionFlags are the flags choosing which repositories fetch and push
+// run on.
+type selectionFlags struct {
+	resume bool
+	failed bool
+}
+
+func (f *selectionFlags) register(cmd *cobra.Command, name string) {
+	cmd.Flags().BoolVar(&f.resume, "resume", false,
+		fmt.Sprintf("Only %v repositories that did not succeed in the last %v", name, name))
+	cmd.Flags().BoolVar(&f.failed, "failed", false,
+		fmt.Sprintf("Only %v repositories that failed in the last %v", name, name))
+}
+
+func (f *selectionFlags) selection() (gomir.Selection, error) {
+	switch {
+	case f.resume && f.failed:
+		return gomir.SelectAll, withExitCode(exitConfigError, errors.New("--resume and --failed can't be combined"))
+	case f.resume:
+		return gomir.SelectUnfinished, nil
+	case f.failed:
+		return gomir.SelectFailed, nil
+	}
+	return gomir.SelectAll, nil
+}
+
+func printEvent(e gomir.Event) {
+	if e.Type == gomir.EventWarning {
+		if e.Mirror == nil {
+			color.Yellow("[!] %v", e.Message)
+		} else {
+			color.Yellow("[!] %v: %v", e.Mirror, e.Message)
+		}
+		return
+	}
+	if e.Type == gomir.EventDestinationFinished {
+		if e.Err == nil {
+			color.Green("[✔] %v -> %v", e.Mirror, e.Destination)
+		} else {
+			color.Red("[X] %v -> %v", e.Mirror, e.Destination)
+		}
+		return
+	}
+	if e.Type != gomir.EventFinished || e.Op == gomir.OpAdd {
+		return
+	}
+
+	if e.Err == nil {
+		color.Green("[✔] %v", e.Mirror)
+	} else {
+		color.Red("[X] %v", e.Mirror)
+	}
+}
+
+// parseCredentials applies key=value credential settings to creds.
+func parseCredentials(creds *gomir.Credentials, settings []string) error {
+	for _, setting := range settings {
+		i := strings.Index(setting, "=")
+		if i < 0 {
+			return fmt.Errorf("Credential setting %#v must be key=value", setting)
+		}
+		if err := creds.SetCredential(setting[:i], setting[i+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHooks applies key=command hook settings to hooks.
+func parseHooks(hooks *gomir.Hooks, settings []string) error {
+	for _, setting := range settings {
+		i := strings.Index(setting, "=")
+		if i < 0 {
+			return fmt.Errorf("Hook setting %#v must be key=command", setting)
+		}
+		if err := hooks.SetHook(setting[:i], setting[i+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blachniet/gomir"
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// The ways fetch and push show their progress, chosen with --progress.
+const (
+	progressAuto  = "auto"
+	progressPlain = "plain"
+	progressNone  = "none"
+)
+
+const (
+	// ttyRefresh is how often the live display redraws
+	ttyRefresh = 200 * time.Millisecond
+	// plainRefresh is how often the plain display prints the state of a
+	// run
+	plainRefresh = 10 * time.Second
+	// maxProgressMirrors is how many running mirrors the display lists
+	maxProgressMirrors = 10
+)
+
+// validateProgressMode returns an error if mode isn't one of --progress.
+func validateProgressMode(mode string) error {
+	switch mode {
+	case progressAuto, progressPlain, progressNone:
+		return nil
+	}
+	return fmt.Errorf("Unknown progress mode %#v, want auto, plain or none", mode)
+}
+
+// withProgress returns run, showing the progress of the mirrors while it
+// runs as mode asks: redrawn in place on a terminal, or printed every
+// so often otherwise.
+func withProgress(mgr *gomir.Manager, mode, name string, run func() (gomir.Results, error)) func() (gomir.Results, error) {
+	return func() (gomir.Results, error) {
+		if mode == progressNone {
+			return run()
+		}
+		tty := isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd())
+		if mode == progressAuto && !tty {
+			mode = progressPlain
+		}
+		d := &progressDisplay{
+			out:      color.Output,
+			live:     mode == progressAuto,
+			name:     name,
+			print:    printEvent,
+			limit:    mgr.BandwidthLimit,
+			width:    func() int { return terminalWidth(os.Stdout.Fd()) },
+			interval: plainRefresh,
+		}
+		if d.live {
+			d.interval = ttyRefresh
+		}
+
+		onEvent := mgr.OnEvent
+		mgr.OnEvent = d.event
+		d.start()
+		defer func() {
+			d.stop()
+			mgr.OnEvent = onEvent
+		}()
+		return run()
+	}
+}
+
+// progressDisplay shows how far a fetch or push run is: how many mirrors
+// are queued, running, done and failed, and the transfer of each running
+// mirror.
+type progressDisplay struct {
+	out   io.Writer
+	live  bool
+	name  string
+	print func(gomir.Event)
+	width func() int
+
+	// limit is the bandwidth limit of the Manager, shown with the
+	// throughput
+	limit int64
+
+	// interval is how often the display refreshes
+	interval time.Duration
+
+	mu      sync.Mutex
+	queued  int
+	done    int
+	failed  int
+	running []*transfer
+	// drawn is how many lines of the live display are on the terminal
+	drawn int
+
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+// transfer is the state of a running mirror.
+type transfer struct {
+	mirror   *gomir.Mirror
+	started  time.Time
+	progress gomir.Progress
+}
+
+func (d *progressDisplay) start() {
+	d.quit = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.refresh()
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops refreshing and takes the live display off the terminal.
+func (d *progressDisplay) stop() {
+	close(d.quit)
+	<-d.stopped
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+}
+
+func (d *progressDisplay) event(e gomir.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch e.Type {
+	case gomir.EventQueued:
+		d.queued++
+		return
+	case gomir.EventStarted:
+		if d.queued > 0 {
+			d.queued--
+		}
+		d.running = append(d.running, &transfer{mirror: e.Mirror, started: time.Now()})
+		return
+	case gomir.EventProgress:
+		if t := d.transfer(e.Mirror); t != nil {
+			t.progress = e.Progress
+		}
+		return
+	case gomir.EventFinished:
+		for i, t := range d.running {
+			if t.mirror == e.Mirror {
+				d.running = append(d.running[:i], d.running[i+1:]...)
+				break
+			}
+		}
+		if e.Err == nil {
+			d.done++
+		} else {
+			d.failed++
+		}
+	}
+
+	// Print the event above the live display
+	d.clear()
+	d.print(e)
+	if d.live {
+		d.draw()
+	}
+}
+
+func (d *progressDisplay) transfer(m *gomir.Mirror) *transfer {
+	for _, t := range d.running {
+		if t.mirror == m {
+			return t
+		}
+	}
+	return nil
+}
+
+func (d *progressDisplay) refresh() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.live {
+		d.clear()
+	}
+	d.draw()
+}
+
+// clear erases the lines of the live display.
+func (d *progressDisplay) clear() {
+	if d.drawn == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for i := 0; i < d.drawn; i++ {
+		buf.WriteString("\x1b[1A\x1b[2K")
+	}
+	d.out.Write(buf.Bytes())
+	d.drawn = 0
+}
+
+// draw writes the state of the run, one line for the whole run and one
+// for each running mirror.
+func (d *progressDisplay) draw() {
+	if d.queued+len(d.running)+d.done+d.failed == 0 {
+		return
+	}
+	var rate float64
+	for _, t := range d.running {
+		if !t.progress.Done {
+			rate += t.progress.Rate
+		}
+	}
+	summary := fmt.Sprintf("%v: %v queued, %v running, %v done, %v failed",
+		d.name, d.queued, len(d.running), d.done, d.failed)
+	switch {
+	case d.limit > 0:
+		summary += fmt.Sprintf(", %v/s (limit %v/s)", formatBytes(rate), formatBytes(float64(d.limit)))
+	case rate > 0:
+		summary += fmt.Sprintf(", %v/s", formatBytes(rate))
+	}
+	lines := []string{summary}
+	for i, t := range d.running {
+		if i == maxProgressMirrors {
+			lines = append(lines, fmt.Sprintf("  ... and %v more", len(d.running)-i))
+			break
+		}
+		lines = append(lines, "  "+describeTransfer(t))
+	}
+
+	// Leave the last column free, so terminals don't wrap the lines
+	width := 0
+	if d.live {
+		width = d.width() - 1
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(truncate(line, width))
+		buf.WriteString("\n")
+	}
+	d.out.Write(buf.Bytes())
+	if d.live {
+		d.drawn = len(lines)
+	}
+}
+
+// describeTransfer describes how far a running mirror is, for example
+// "github.com/spf13/cobra.git (1m5s): Receiving objects 45% (450/1000),
+// 1.2 MiB at 600.0 KiB/s, 2s left".
+func describeTransfer(t *transfer) string {
+	s := fmt.Sprintf("%v (%v)", t.mirror, time.Since(t.started).Round(time.Second))
+	p := t.progress
+	if p.Phase == "" {
+		return s
+	}
+	s += fmt.Sprintf(": %v %v%% (%v/%v)", p.Phase, p.Percent, p.Objects, p.TotalObjects)
+	if p.Bytes > 0 {
+		s += ", " + formatBytes(float64(p.Bytes))
+		if p.Rate > 0 && !p.Done {
+			s += fmt.Sprintf(" at %v/s", formatBytes(p.Rate))
+		}
+	}
+	if left := p.Remaining(); left > 0 {
+		s += fmt.Sprintf(", %v left", left.Round(time.Second))
+	}
+	return s
+}
+
+// formatBytes formats a size in the binary units git uses.
+func formatBytes(n float64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB"}
+	unit := "TiB"
+	for _, u := range units {
+		if n < 1024 {
+			unit = u
+			break
+		}
+		n /= 1024
+	}
+	if unit == "bytes" {
+		return fmt.Sprintf("%.0f bytes", n)
+	}
+	return fmt.Sprintf("%.1f %v", n, unit)
+}
+
+// truncate cuts s to width characters, if width is set.
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if width <= 0 || len(runes) <= width {
+		return s
+	}
+	return string(runes[:width])
+}
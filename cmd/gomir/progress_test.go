@@ -0,0 +1,98 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/blachniet/gomir"
+)
+
+func Test_progressDisplay(t *testing.T) {
+	a := &gomir.Mirror{Path: "github.com/spf13/cobra.git"}
+	b := &gomir.Mirror{Path: "github.com/pkg/errors.git"}
+	c := &gomir.Mirror{Path: "github.com/fatih/color.git"}
+	events := []gomir.Event{
+		{Type: gomir.EventQueued, Mirror: a},
+		{Type: gomir.EventQueued, Mirror: b},
+		{Type: gomir.EventQueued, Mirror: c},
+		{Type: gomir.EventStarted, Mirror: a},
+		{Type: gomir.EventStarted, Mirror: b},
+		{Type: gomir.EventProgress, Mirror: a, Progress: gomir.Progress{
+			Phase: "Receiving objects", Percent: 50, Objects: 500, TotalObjects: 1000, Bytes: 2 << 20, Rate: 1 << 20,
+		}},
+		{Type: gomir.EventFinished, Mirror: b, Err: errors.New("unreachable")},
+	}
+
+	tests := []struct {
+		name  string
+		live  bool
+		limit int64
+		want  []string
+		width int
+	}{
+		{"Plain", false, 0, []string{
+			"[X] github.com/pkg/errors.git\n" +
+				"Fetch: 1 queued, 1 running, 0 done, 1 failed, 1.0 MiB/s\n" +
+				"  github.com/spf13/cobra.git (0s): Receiving objects 50% (500/1000), 2.0 MiB at 1.0 MiB/s, 2s left\n",
+		}, 200},
+		{"Limited", false, 2 << 20, []string{
+			"[X] github.com/pkg/errors.git\n" +
+				"Fetch: 1 queued, 1 running, 0 done, 1 failed, 1.0 MiB/s (limit 2.0 MiB/s)\n" +
+				"  github.com/spf13/cobra.git (0s): Receiving objects 50% (500/1000), 2.0 MiB at 1.0 MiB/s, 2s left\n",
+		}, 200},
+		{"Live", true, 0, []string{
+			"[X] github.com/pkg/errors.git\n" +
+				"Fetch: 1 queued, 1 running, 0 done, 1 failed, 1.0 MiB/s\n" +
+				"  github.com/spf13/cobra.git (0s): Receiving objects 50% (500/1000), 2.0 MiB at 1.0 MiB/s, 2s left\n",
+			"\x1b[1A\x1b[2K\x1b[1A\x1b[2KFetch: 1 queued, 1 running, 0 done, 1 failed, 1.\n" +
+				"  github.com/spf13/cobra.git (0s): Receiving obj\n",
+		}, 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := &progressDisplay{
+				out:   &out,
+				live:  tt.live,
+				name:  "Fetch",
+				limit: tt.limit,
+				print: func(e gomir.Event) {
+					if e.Type == gomir.EventFinished {
+						out.WriteString("[X] " + e.Mirror.String() + "\n")
+					}
+				},
+				width: func() int { return 201 },
+			}
+			for _, e := range events {
+				d.event(e)
+			}
+			if !tt.live {
+				d.refresh()
+			}
+			if got := out.String(); got != tt.want[0] {
+				t.Errorf("Output = %q, want %q", got, tt.want[0])
+			}
+			if !tt.live {
+				return
+			}
+
+			out.Reset()
+			d.width = func() int { return tt.width + 1 }
+			d.refresh()
+			if got := out.String(); got != tt.want[1] {
+				t.Errorf("Redrawn output = %q, want %q", got, tt.want[1])
+			}
+			out.Reset()
+			d.clear()
+			if got := out.String(); strings.Count(got, "\x1b[2K") != 2 {
+				t.Errorf("Cleared output = %q, want 2 lines erased", got)
+			}
+		})
+	}
+}
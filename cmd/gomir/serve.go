@@ -0,0 +1,105 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/blachniet/gomir"
+)
+
+// runDaemon runs daemon until SIGINT or SIGTERM, reloading it on SIGHUP.
+// If metricsListen is set, metrics are served there meanwhile.
+func runDaemon(mgr *gomir.Manager, daemon *gomir.Daemon, shutdownTimeout time.Duration, metricsListen string) error {
+	if metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mgr.Metrics)
+		closeServer, err := serveHTTP(metricsListen, mux)
+		if err != nil {
+			return err
+		}
+		defer closeServer()
+	}
+
+	ctx, cleanup := handleSignals(mgr, shutdownTimeout, func() {
+		fmt.Println("Reloading configuration and repositories")
+		daemon.Reload()
+	})
+	defer cleanup()
+	return daemon.Run(ctx)
+}
+
+// runWebhook receives webhooks on listen until SIGINT or SIGTERM.
+func runWebhook(mgr *gomir.Manager, handler *gomir.WebhookHandler, listen string, shutdownTimeout time.Duration) error {
+	ctx, cleanup := handleSignals(mgr, shutdownTimeout, nil)
+	defer cleanup()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	closeServer, err := serveHTTP(listen, mux)
+	if err != nil {
+		return err
+	}
+	defer closeServer()
+
+	fmt.Printf("Receiving webhooks on %v\n", listen)
+	handler.Run(ctx)
+	return nil
+}
+
+// serveHTTP serves handler on addr in the background until the returned
+// function is called.
+func serveHTTP(addr string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(listener)
+	return func() { srv.Close() }, nil
+}
+
+// handleSignals calls reload, if set, on SIGHUP. The returned context is
+// done on the first SIGINT or SIGTERM; the git operations of mgr are
+// cancelled shutdownTimeout later or on a second signal.
+func handleSignals(mgr *gomir.Manager, shutdownTimeout time.Duration, reload func()) (context.Context, func()) {
+	gitCtx, cancelGit := context.WithCancel(context.Background())
+	mgr.Context = gitCtx
+	ctx, stop := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if reload != nil {
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+	go func() {
+		for sig := range signals {
+			switch {
+			case sig == syscall.SIGHUP:
+				reload()
+			case ctx.Err() == nil:
+				fmt.Printf("Shutting down, waiting up to %v for running operations\n", shutdownTimeout)
+				stop()
+				time.AfterFunc(shutdownTimeout, cancelGit)
+			default:
+				fmt.Println("Cancelling running operations")
+				cancelGit()
+			}
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		stop()
+		cancelGit()
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// terminalWidth returns the width of the console fd refers to, or 80 if
+// it can't tell.
+func terminalWidth(fd uintptr) int {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(fd), &info); err != nil {
+		return 80
+	}
+	return int(info.Window.Right-info.Window.Left) + 1
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// ConfigName is the name of the file in a Manager's root that configures
+// gomir as a whole. It uses git's config syntax, so it may be edited with
+// git:
+//
+//	git config --file gomir.config notify.ops.type smtp
+const ConfigName = "gomir.config"
+
+// LoadConfig applies the configuration in the root's gomir.config file,
+// if there is one. If the file is invalid, the current configuration is
+// kept as a whole.
+func (mgr *Manager) LoadConfig() error {
+	path := filepath.Join(mgr.Root, ConfigName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error opening gomir config")
+	}
+	defer f.Close()
+
+	cfg := formatconfig.New()
+	if err := formatconfig.NewDecoder(f).Decode(cfg); err != nil {
+		return errors.Wrapf(err, "Error parsing %v", path)
+	}
+
+	notifications, err := parseNotifications(cfg.Section("notify"))
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+	hosts, err := parseHosts(cfg.Section("host"))
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+
+	policy, err := readPolicy(cfg.Section("policy").Options)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+	secrets := cfg.Section("secrets")
+	if policy.Secrets, err = readSecretScan(secrets, secrets.Options); err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+	if policy.Signatures, err = readSignaturePolicy(cfg.Section("signatures").Options); err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+
+	var bandwidthLimit int64
+	if limit := cfg.Section("bandwidth").Options.Get("limit"); limit != "" {
+		if bandwidthLimit, err = ParseBandwidthLimit(limit); err != nil {
+			return errors.Wrapf(err, "Invalid %v", path)
+		}
+	}
+	changeReport, err := readChangeReportConfig(cfg.Section("changes").Options)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid %v", path)
+	}
+
+	patterns := cfg.Section("redact").Options.GetAll("pattern")
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.Wrapf(err, "Invalid redact.pattern in %v", path)
+		}
+	}
+	for _, pattern := range patterns {
+		AddRedactPattern(pattern)
+	}
+
+	mgr.Notifications = notifications
+	mgr.Hosts = hosts
+	mgr.Hooks = readHooks(cfg.Section("hook").Options)
+	mgr.Policy = policy
+	mgr.RunReportDir = cfg.Section("report").Options.Get("dir")
+	mgr.BandwidthLimit = bandwidthLimit
+	mgr.ChangeReport = changeReport
+	return nil
+}
+
+// HostConfig holds the settings for the remotes on a host.
+type HostConfig struct {
+	// Credentials authenticate to the host's remotes, unless a mirror
+	// sets its own
+	Credentials Credentials
+
+	// Network configures the connections to the host's remotes
+	Network Network
+}
+
+// parseHosts reads the host.<name>.* settings of the gomir config. Names
+// may be host names, domains such as "*.example.com", or "*" for every
+// host:
+//
+//	[host "github.com"]
+//		sshKey = /etc/gomir/github_deploy_key
+//		knownHosts = /etc/gomir/known_hosts
+//		proxy = http://proxy.example.com:3128
+//	[host "git.example.com"]
+//		username = mirror-bot
+//		tokenFile = /etc/gomir/example.token   # or tokenEnv = NAME
+//		sslCert = /etc/gomir/client.pem
+//		sslKey = /etc/gomir/client.key
+//		caBundle = /etc/gomir/example-ca.pem
+//		sshProxyJump = bastion.example.com
+//	[host "*"]
+//		connectTimeout = 30s
+//		lowSpeedLimit = 1000
+//		lowSpeedTime = 1m
+//		bandwidthLimit = 2m
+func parseHosts(section *formatconfig.Section) (map[string]HostConfig, error) {
+	hosts := map[string]HostConfig{}
+	for _, sub := range section.Subsections {
+		host := HostConfig{Credentials: readCredentials(sub)}
+		if err := host.Credentials.validate(); err != nil {
+			return nil, errors.Wrapf(err, "host.%v", sub.Name)
+		}
+		network, err := readNetwork(sub)
+		if err != nil {
+			return nil, errors.Wrapf(err, "host.%v", sub.Name)
+		}
+		host.Network = network
+		hosts[strings.ToLower(sub.Name)] = host
+	}
+	return hosts, nil
+}
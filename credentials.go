@@ -0,0 +1,237 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/pkg/errors"
+)
+
+// defaultTokenUsername is sent with tokens when no username is set. The
+// big hosting services accept any username with an access token.
+const defaultTokenUsername = "git"
+
+// Credentials authenticate gomir to a remote instead of the operator's
+// SSH agent and git credential helpers. They name the files and
+// environment variables holding secrets rather than the secrets
+// themselves, so that no secret ends up in a config file.
+type Credentials struct {
+	// SSHKey is the path of the private key for ssh remotes (sshKey)
+	SSHKey string
+
+	// KnownHosts is the path of the known_hosts file that verifies the
+	// host keys of ssh remotes (knownHosts)
+	KnownHosts string
+
+	// Username is sent with the token to http remotes (username),
+	// "git" if empty
+	Username string
+
+	// TokenEnv and TokenFile name the environment variable or the file
+	// holding the password or access token for http remotes (tokenEnv,
+	// tokenFile). At most one of them may be set.
+	TokenEnv  string
+	TokenFile string
+
+	// SSLCert and SSLKey are the paths of a client certificate and its
+	// private key for https remotes (sslCert, sslKey). SSLKey may be
+	// empty if SSLCert holds both.
+	SSLCert string
+	SSLKey  string
+}
+
+// IsZero reports whether no credentials are set.
+func (c Credentials) IsZero() bool {
+	return c == Credentials{}
+}
+
+func (c Credentials) validate() error {
+	if c.TokenEnv != "" && c.TokenFile != "" {
+		return errors.New("Set either tokenEnv or tokenFile, not both")
+	}
+	if c.SSLKey != "" && c.SSLCert == "" {
+		return errors.New("sslKey needs an sslCert")
+	}
+	return nil
+}
+
+// or returns c completed by the settings of fallback that c leaves
+// empty. The token and the client certificate are taken as a whole, so
+// that a token file doesn't mix with a fallback token variable.
+func (c Credentials) or(fallback Credentials) Credentials {
+	if c.SSHKey == "" {
+		c.SSHKey = fallback.SSHKey
+	}
+	if c.KnownHosts == "" {
+		c.KnownHosts = fallback.KnownHosts
+	}
+	if c.Username == "" {
+		c.Username = fallback.Username
+	}
+	if c.TokenEnv == "" && c.TokenFile == "" {
+		c.TokenEnv, c.TokenFile = fallback.TokenEnv, fallback.TokenFile
+	}
+	if c.SSLCert == "" {
+		c.SSLCert, c.SSLKey = fallback.SSLCert, fallback.SSLKey
+	}
+	return c
+}
+
+// username returns the username to send with the token.
+func (c Credentials) username() string {
+	if c.Username == "" {
+		return defaultTokenUsername
+	}
+	return c.Username
+}
+
+// token reads the token, or returns "" if none is configured. The token
+// is registered with AddSecret.
+func (c Credentials) token() (token string, err error) {
+	defer func() { AddSecret(token) }()
+
+	switch {
+	case c.TokenEnv != "":
+		token := os.Getenv(c.TokenEnv)
+		if token == "" {
+			return "", errors.Errorf("Environment variable %v holding the token is not set", c.TokenEnv)
+		}
+		return token, nil
+	case c.TokenFile != "":
+		content, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "Error reading token")
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return "", errors.Errorf("Token file %v is empty", c.TokenFile)
+		}
+		return token, nil
+	}
+	return "", nil
+}
+
+// credentialKeys maps the config keys of Credentials to their fields.
+func (c *Credentials) credentialKeys() map[string]*string {
+	return map[string]*string{
+		"sshKey":     &c.SSHKey,
+		"knownHosts": &c.KnownHosts,
+		"username":   &c.Username,
+		"tokenEnv":   &c.TokenEnv,
+		"tokenFile":  &c.TokenFile,
+		"sslCert":    &c.SSLCert,
+		"sslKey":     &c.SSLKey,
+	}
+}
+
+// SetCredential sets the credential setting named by its config key,
+// such as "sshKey".
+func (c *Credentials) SetCredential(key, value string) error {
+	field, ok := c.credentialKeys()[key]
+	if !ok {
+		return errors.Errorf("Unknown credential setting %#v", key)
+	}
+	*field = value
+	return nil
+}
+
+func readCredentials(sub *formatconfig.Subsection) Credentials {
+	var c Credentials
+	for key, field := range c.credentialKeys() {
+		*field = sub.Option(key)
+	}
+	return c
+}
+
+// writeCredentials stores c in the subsection name of section, which is
+// removed once it holds no settings.
+func writeCredentials(section *formatconfig.Section, name string, c Credentials) {
+	sub := section.Subsection(name)
+	for key, field := range c.credentialKeys() {
+		if *field != "" {
+			sub.SetOption(key, *field)
+		} else {
+			sub.RemoveOption(key)
+		}
+	}
+	if len(sub.Options) == 0 {
+		section.RemoveSubsection(name)
+	}
+}
+
+// goGitAuth returns the go-git equivalent of creds for the remote at
+// rawURL, or nil to connect without authentication.
+func goGitAuth(rawURL string, creds Credentials) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ep.Protocol {
+	case "ssh":
+		if creds.SSHKey == "" && creds.KnownHosts == "" {
+			return nil, nil
+		}
+		user := ep.User
+		if user == "" {
+			user = defaultTokenUsername
+		}
+
+		if creds.SSHKey != "" {
+			keys, err := gitssh.NewPublicKeysFromFile(user, creds.SSHKey, "")
+			if err != nil {
+				return nil, errors.Wrap(err, "Error reading SSH key")
+			}
+			if creds.KnownHosts != "" {
+				if keys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(creds.KnownHosts); err != nil {
+					return nil, errors.Wrap(err, "Error reading known hosts")
+				}
+			}
+			return keys, nil
+		}
+
+		agent, err := gitssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error connecting to SSH agent")
+		}
+		if agent.HostKeyCallback, err = gitssh.NewKnownHostsCallback(creds.KnownHosts); err != nil {
+			return nil, errors.Wrap(err, "Error reading known hosts")
+		}
+		return agent, nil
+
+	case "http", "https":
+		token, err := creds.token()
+		if err != nil || token == "" {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: creds.username(), Password: token}, nil
+	}
+	return nil, nil
+}
+
+// goGitClientCert reads the client certificate and key of creds, if set.
+func goGitClientCert(creds Credentials) (cert, key []byte, err error) {
+	if creds.SSLCert == "" {
+		return nil, nil, nil
+	}
+	if cert, err = ioutil.ReadFile(creds.SSLCert); err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading client certificate")
+	}
+	if creds.SSLKey == "" {
+		// tls.X509KeyPair finds the key among the certificates
+		return cert, cert, nil
+	}
+	if key, err = ioutil.ReadFile(creds.SSLKey); err != nil {
+		return nil, nil, errors.Wrap(err, "Error reading client key")
+	}
+	return cert, key, nil
+}
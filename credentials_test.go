@@ -0,0 +1,146 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+func TestCredentials_or(t *testing.T) {
+	host := Credentials{SSHKey: "/host/key", Username: "host", TokenEnv: "HOST_TOKEN", SSLCert: "/host/cert", SSLKey: "/host/key.pem"}
+	tests := []struct {
+		name string
+		own  Credentials
+		want Credentials
+	}{
+		{"none", Credentials{}, host},
+		{"own token", Credentials{TokenFile: "/own/token"},
+			Credentials{SSHKey: "/host/key", Username: "host", TokenFile: "/own/token", SSLCert: "/host/cert", SSLKey: "/host/key.pem"}},
+		{"own cert", Credentials{SSLCert: "/own/both.pem"},
+			Credentials{SSHKey: "/host/key", Username: "host", TokenEnv: "HOST_TOKEN", SSLCert: "/own/both.pem"}},
+		{"own key", Credentials{SSHKey: "/own/key", KnownHosts: "/own/known_hosts"},
+			Credentials{SSHKey: "/own/key", KnownHosts: "/own/known_hosts", Username: "host", TokenEnv: "HOST_TOKEN", SSLCert: "/host/cert", SSLKey: "/host/key.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.own.or(host); got != tt.want {
+				t.Errorf("or() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_goGitAuth(t *testing.T) {
+	t.Setenv("GOMIR_TEST_TOKEN", "s3cret")
+	creds := Credentials{Username: "bot", TokenEnv: "GOMIR_TEST_TOKEN"}
+
+	auth, err := goGitAuth("https://git.example.com/project.git", creds)
+	if err != nil {
+		t.Fatalf("goGitAuth() error = %+v", err)
+	}
+	if want := (&githttp.BasicAuth{Username: "bot", Password: "s3cret"}); !reflect.DeepEqual(auth, want) {
+		t.Errorf("goGitAuth() = %#v, want %#v", auth, want)
+	}
+
+	if auth, err := goGitAuth("file:///srv/project.git", creds); auth != nil || err != nil {
+		t.Errorf("goGitAuth() = %v, %v for a local remote, want no auth", auth, err)
+	}
+}
+
+func TestManager_credentials(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			testCredentials(t, backendName)
+		})
+	}
+}
+
+// testCredentials mirrors between two servers on the same host that
+// require different accounts: the source's comes from the host's
+// settings, the destination's from the mirror's.
+func testCredentials(t *testing.T, backendName string) {
+	f := newFixture(t)
+	mgr := f.manager(backendName)
+
+	upstream := f.newUpstream("project")
+	f.git(f.dir, "clone", "-q", "--bare", upstream, f.path("upstream-bare", "project.git"))
+	fetchURL := f.serveSmartHTTPAuth(f.path("upstream-bare"), "reader", "source-token") + "/project.git"
+	dest := f.path("destination", "project.git")
+	f.git(f.dir, "init", "-q", "--bare", dest)
+	pushURL := f.serveSmartHTTPAuth(f.path("destination"), "writer", "destination-token") + "/project.git"
+
+	// The operator's credential helper knows a different account
+	globalConfig := f.path("gitconfig")
+	helper := "[credential]\n\thelper = \"!f() { echo username=operator; echo password=wrong; }; f\"\n"
+	if err := ioutil.WriteFile(globalConfig, []byte(helper), 0644); err != nil {
+		t.Fatalf("Error writing git config: %+v", err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", globalConfig)
+
+	if _, err := mgr.Add(fetchURL, pushURL, "denied", MirrorOptions{}); err == nil {
+		t.Fatalf("Add() succeeded without credentials")
+	}
+
+	t.Setenv("GOMIR_TEST_SOURCE_TOKEN", "source-token")
+	mgr.Hosts = map[string]HostConfig{
+		"127.0.0.1": {Credentials: Credentials{Username: "reader", TokenEnv: "GOMIR_TEST_SOURCE_TOKEN"}},
+	}
+	tokenFile := f.path("destination.token")
+	if err := ioutil.WriteFile(tokenFile, []byte("destination-token\n"), 0600); err != nil {
+		t.Fatalf("Error writing token: %+v", err)
+	}
+	opts := MirrorOptions{PushCredentials: Credentials{Username: "writer", TokenFile: tokenFile}}
+
+	m, err := mgr.Add(fetchURL, pushURL, "project", opts)
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	f.commit(upstream, "Second commit")
+	f.git(upstream, "push", "-q", f.path("upstream-bare", "project.git"), "master")
+	if !fetch(mgr, m) || !push(mgr, m) {
+		t.Fatalf("Mirroring failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(f.path("upstream-bare", "project.git"), dest)
+
+	config, err := ioutil.ReadFile(filepath.Join(m.GitDir, "config"))
+	if err != nil {
+		t.Fatalf("Error reading mirror config: %+v", err)
+	}
+	for _, secret := range []string{"source-token", "destination-token", "GOMIR_TEST_SOURCE_TOKEN"} {
+		if strings.Contains(string(config), secret) {
+			t.Errorf("Mirror config contains %v:\n%s", secret, config)
+		}
+	}
+}
+
+func TestManager_LoadConfig_hosts(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	config := "[host \"GitHub.com\"]\n\tsshKey = /keys/github\n\tknownHosts = /keys/known_hosts\n"
+	if err := ioutil.WriteFile(f.path("mirrors", ConfigName), []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %+v", err)
+	}
+	if err := mgr.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %+v", err)
+	}
+	want := map[string]HostConfig{"github.com": {Credentials: Credentials{SSHKey: "/keys/github", KnownHosts: "/keys/known_hosts"}}}
+	if !reflect.DeepEqual(mgr.Hosts, want) {
+		t.Errorf("Hosts = %+v, want %+v", mgr.Hosts, want)
+	}
+
+	config = "[host \"github.com\"]\n\ttokenEnv = TOKEN\n\ttokenFile = /keys/token\n"
+	if err := ioutil.WriteFile(f.path("mirrors", ConfigName), []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %+v", err)
+	}
+	if err := mgr.LoadConfig(); err == nil {
+		t.Errorf("LoadConfig() accepted two token sources")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// neverSchedule disables an operation for a mirror, overriding the
+// daemon's default schedule.
+const neverSchedule = "never"
+
+// Daemon fetches and pushes mirrors on their schedules. Mirrors may set
+// their own schedules in their options; the others use the daemon's
+// defaults.
+type Daemon struct {
+	Manager *Manager
+
+	// FetchSchedule and PushSchedule are the default schedules, in the
+	// format accepted by ParseSchedule. Empty doesn't run the operation
+	// for mirrors without a schedule of their own.
+	FetchSchedule string
+	PushSchedule  string
+
+	// Jitter delays every scheduled run by a random duration up to
+	// Jitter, so mirrors on the same schedule don't all start at once
+	Jitter time.Duration
+
+	// LoadConfig, if set, reads the configuration again on Reload, once
+	// no batch is running. If it fails, the current configuration is
+	// kept.
+	LoadConfig func() error
+
+	reload chan struct{}
+}
+
+// NewDaemon returns a Daemon for the mirrors of mgr.
+func NewDaemon(mgr *Manager) *Daemon {
+	return &Daemon{
+		Manager: mgr,
+		reload:  make(chan struct{}, 1),
+	}
+}
+
+// Reload makes a running daemon list the mirrors and read their schedules
+// again, for example after mirrors were added, and read its configuration
+// again with LoadConfig.
+func (d *Daemon) Reload() {
+	select {
+	case d.reload <- struct{}{}:
+	default:
+		// A reload is already pending
+	}
+}
+
+// job is an operation scheduled for a mirror.
+type job struct {
+	op   Operation
+	path string
+}
+
+// scheduled is a job's schedule and the next time it runs.
+type scheduled struct {
+	mirror   *Mirror
+	schedule string
+	sched    Schedule
+	next     time.Time
+}
+
+// Run runs the scheduled operations until ctx is done. Operations run one
+// batch at a time: every job due at the same time for the same operation
+// runs concurrently, holding the root lock like Fetch and Push do. When
+// ctx is done, Run waits for the running batch to finish; cancel the
+// Manager's Context to abort it.
+func (d *Daemon) Run(ctx context.Context) error {
+	for _, schedule := range []string{d.FetchSchedule, d.PushSchedule} {
+		if schedule != "" {
+			if _, err := ParseSchedule(schedule); err != nil {
+				return err
+			}
+		}
+	}
+
+	jobs, err := d.load(nil, time.Now())
+	if err != nil {
+		return err
+	}
+
+	queue := []job{}
+	busy := map[job]bool{}
+	done := make(chan []job)
+	running := false
+	// reloading is set while a reload waits for the running batch, which
+	// uses the configuration
+	reloading := false
+	for {
+		if reloading && !running {
+			jobs = d.reloadJobs(jobs)
+			reloading = false
+		}
+		if ctx.Err() == nil && !running && len(queue) > 0 {
+			var batch []job
+			batch, queue = nextBatch(queue)
+			op, mirrors := batch[0].op, []*Mirror{}
+			for _, j := range batch {
+				if s, ok := jobs[j]; ok {
+					mirrors = append(mirrors, s.mirror)
+				}
+			}
+			go func() {
+				d.runBatch(op, mirrors)
+				done <- batch
+			}()
+			running = true
+		}
+
+		timer := time.NewTimer(time.Until(earliestRun(jobs, busy)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if running {
+				<-done
+			}
+			return nil
+
+		case <-d.reload:
+			reloading = true
+
+		case batch := <-done:
+			running = false
+			for _, j := range batch {
+				delete(busy, j)
+			}
+
+		case now := <-timer.C:
+			for j, s := range jobs {
+				// Schedules that never match have no next run
+				if busy[j] || s.next.IsZero() || s.next.After(now) {
+					continue
+				}
+				queue = append(queue, j)
+				busy[j] = true
+				s.next = d.nextRun(s.sched, now)
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// reloadJobs reads the configuration and the schedules again, keeping the
+// current ones on errors.
+func (d *Daemon) reloadJobs(current map[job]*scheduled) map[job]*scheduled {
+	if d.LoadConfig != nil {
+		if err := d.LoadConfig(); err != nil {
+			d.warn(fmt.Sprintf("Error reloading configuration, keeping the current one: %v", err))
+		}
+	}
+	jobs, err := d.load(current, time.Now())
+	if err != nil {
+		d.warn(fmt.Sprintf("Error reloading mirrors, keeping the current schedule: %v", err))
+		return current
+	}
+	return jobs
+}
+
+// load lists the mirrors and reads their schedules. Jobs whose schedule
+// didn't change keep their next run from current.
+func (d *Daemon) load(current map[job]*scheduled, now time.Time) (map[job]*scheduled, error) {
+	mirrors, err := d.Manager.List()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := map[job]*scheduled{}
+	for _, m := range mirrors {
+		opts, err := m.Options()
+		if err != nil {
+			d.Manager.emit(Event{Type: EventWarning, Mirror: m, Message: fmt.Sprintf("Not scheduled: %v", err)})
+			continue
+		}
+
+		for op, schedule := range map[Operation]string{
+			OpFetch: firstNonEmpty(opts.FetchSchedule, d.FetchSchedule),
+			OpPush:  firstNonEmpty(opts.PushSchedule, d.PushSchedule),
+		} {
+			if schedule == "" || schedule == neverSchedule {
+				continue
+			}
+
+			j := job{op: op, path: m.Path}
+			if s, ok := current[j]; ok && s.schedule == schedule {
+				jobs[j] = s
+				continue
+			}
+
+			sched, err := ParseSchedule(schedule)
+			if err != nil {
+				d.Manager.emit(Event{Type: EventWarning, Op: op, Mirror: m, Message: fmt.Sprintf("Not scheduled: %v", err)})
+				continue
+			}
+			jobs[j] = &scheduled{
+				mirror:   m,
+				schedule: schedule,
+				sched:    sched,
+				next:     d.nextRun(sched, now),
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// runBatch performs op on mirrors while holding the root lock, and reports
+// on the outcome as Fetch and Push do.
+func (d *Daemon) runBatch(op Operation, mirrors []*Mirror) {
+	if len(mirrors) == 0 {
+		// Removed by a reload
+		return
+	}
+	if _, err := d.Manager.runBatch(op, mirrors); err != nil {
+		d.warn(fmt.Sprintf("Skipping scheduled %v of %v mirrors: %v", op, len(mirrors), err))
+	}
+}
+
+func (d *Daemon) warn(msg string) {
+	d.Manager.emit(Event{Type: EventWarning, Message: msg})
+}
+
+// nextRun returns the next time sched runs after now, delayed by up to
+// the daemon's jitter.
+func (d *Daemon) nextRun(sched Schedule, now time.Time) time.Time {
+	next := sched.Next(now)
+	if d.Jitter > 0 && !next.IsZero() {
+		next = next.Add(time.Duration(rand.Int63n(int64(d.Jitter))))
+	}
+	return next
+}
+
+// nextBatch removes the first queued job and every other queued job for
+// the same operation from queue.
+func nextBatch(queue []job) (batch, rest []job) {
+	op := queue[0].op
+	for _, j := range queue {
+		if j.op == op {
+			batch = append(batch, j)
+		} else {
+			rest = append(rest, j)
+		}
+	}
+	return batch, rest
+}
+
+// earliestRun returns the earliest time a job that isn't already queued
+// or running is due. Without such a job, it returns a time far enough
+// away that only a reload or a finished batch wakes the daemon.
+func earliestRun(jobs map[job]*scheduled, busy map[job]bool) time.Time {
+	next := time.Now().Add(24 * time.Hour)
+	for j, s := range jobs {
+		if !busy[j] && !s.next.IsZero() && s.next.Before(next) {
+			next = s.next
+		}
+	}
+	return next
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDaemon_Run(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+	if _, err := mgr.Add("file://"+f.newUpstream("other"), f.path("destination", "other.git"), "other",
+		MirrorOptions{FetchSchedule: "never", PushSchedule: "50ms"}); err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	// February 31st never comes
+	if _, err := mgr.Add("file://"+f.newUpstream("idle"), f.path("destination", "idle.git"), "idle",
+		MirrorOptions{FetchSchedule: "0 0 31 2 *", PushSchedule: "never"}); err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+
+	var mu sync.Mutex
+	finished := map[string]int{}
+	mgr.OnEvent = func(e Event) {
+		if e.Type == EventFinished {
+			if e.Err != nil {
+				t.Errorf("%v %v failed: %+v", e.Op, e.Mirror, e.Err)
+			}
+			mu.Lock()
+			finished[string(e.Op)+" "+e.Mirror.Path]++
+			mu.Unlock()
+		}
+	}
+	count := func(key string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return finished[key]
+	}
+	waitFor := func(key string) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); count(key) < 2; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %v to run twice", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	mgr.RunReportDir = f.path("reports")
+	d := NewDaemon(mgr)
+	loads := 0
+	d.LoadConfig = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		loads++
+		return nil
+	}
+	d.FetchSchedule = "50ms"
+	d.Jitter = 10 * time.Millisecond
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- d.Run(ctx) }()
+
+	waitFor("fetch project.git")
+	waitFor("push other.git")
+	if n := count("fetch other.git") + count("push project.git") + count("fetch idle.git"); n != 0 {
+		t.Errorf("Ran %v operations that aren't scheduled", n)
+	}
+
+	// A mirror added while the daemon runs is picked up on reload
+	f.git(f.dir, "clone", "-q", "--mirror", f.path("upstream", "project"), f.path("mirrors", "added.git"))
+	d.Reload()
+	waitFor("fetch added.git")
+	mu.Lock()
+	if loads != 1 {
+		t.Errorf("Reload() read the configuration %v times, want 1", loads)
+	}
+	mu.Unlock()
+
+	stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Run() error = %+v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run() did not return after its context was cancelled")
+	}
+
+	// Scheduled runs are reported like the others
+	if reports, _ := filepath.Glob(filepath.Join(mgr.RunReportDir, "*.html")); len(reports) == 0 {
+		t.Errorf("No run reports in %v", mgr.RunReportDir)
+	}
+}
+
+func TestDaemon_Run_invalidSchedule(t *testing.T) {
+	f := newFixture(t)
+	d := NewDaemon(f.manager("exec"))
+	d.PushSchedule = "every day"
+	if err := d.Run(context.Background()); err == nil {
+		t.Errorf("Run() accepted an invalid schedule")
+	}
+}
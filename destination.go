@@ -0,0 +1,404 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	gogitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// OriginDestination names the destination set by the pushURL given to
+// Add. It is stored as the push URL of the mirror's origin remote.
+const OriginDestination = "origin"
+
+// namePattern matches the names of destinations and sources, which are
+// used in config subsection names and on the command line.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Destination is a repository that a mirror pushes to. Besides the
+// origin destination, a mirror may push to any number of named
+// destinations stored in the gomir.push.<name> subsections of its git
+// config:
+//
+//	git config --file github.com/pkg/errors.git/config gomir.push.backup.url file:///backup/errors.git
+type Destination struct {
+	// Name identifies the destination within the mirror
+	Name string
+
+	// URL is where the destination is pushed to (url)
+	URL string
+
+	// Refs limits the push to the refs matching these names or patterns
+	// with a single "*", such as "refs/heads/*" or "refs/tags/v*" (refs,
+	// may be repeated).
+	Refs []string
+
+	// Map pushes the refs matching the source side of these rules to
+	// the refs named by their destination side, such as
+	// "refs/heads/*:refs/heads/mirror/*" or
+	// "refs/heads/main:refs/heads/upstream-main" (map, may be repeated).
+	// Like Refs, it limits the push to the matching refs.
+	//
+	// Without Refs and Map, the destination receives every ref and any
+	// other ref on it is deleted. Otherwise, only refs on the
+	// destination matching Refs or the destination side of Map are
+	// deleted once the mirror no longer has their counterpart.
+	Map []string
+
+	// Credentials authenticate to the destination, falling back to
+	// those configured for its host in the root's gomir.config
+	Credentials Credentials
+
+	// Network configures the connection to the destination. The Manager
+	// sets it from the host settings in the root's gomir.config; it
+	// isn't saved with the mirror.
+	Network Network
+
+	// Blocked are refs of the mirror held back from the push, such as
+	// refs violating the mirror's policy. Their counterparts on the
+	// destination are neither updated nor deleted. The Manager sets it
+	// for each push; it isn't saved with the mirror.
+	Blocked []string
+}
+
+// IsMirror reports whether the destination receives every ref as-is.
+func (d Destination) IsMirror() bool {
+	return len(d.Refs) == 0 && len(d.Map) == 0
+}
+
+// pushesAll reports whether a plain mirror push, which also deletes every
+// other ref, updates the destination.
+func (d Destination) pushesAll() bool {
+	return d.IsMirror() && len(d.Blocked) == 0
+}
+
+func (d Destination) validate() error {
+	if !namePattern.MatchString(d.Name) {
+		return errors.Errorf("Invalid destination name %#v, use letters, digits, - and _", d.Name)
+	}
+	if d.URL == "" {
+		return errors.Errorf("Destination %v has no URL", d.Name)
+	}
+	for _, ref := range d.Refs {
+		if !strings.HasPrefix(ref, "refs/") || strings.Count(ref, "*") > 1 {
+			return errors.Errorf("Invalid ref pattern %#v for destination %v, expected a ref such as refs/heads/* with at most one *", ref, d.Name)
+		}
+	}
+	for _, rule := range d.Map {
+		i := strings.Index(rule, ":")
+		if i < 0 || !strings.HasPrefix(rule, "refs/") || !strings.HasPrefix(rule[i+1:], "refs/") || refSpec(rule[:i], rule[i+1:]).Validate() != nil {
+			return errors.Errorf("Invalid ref mapping %#v for destination %v, expected source:destination such as refs/heads/*:refs/heads/mirror/*", rule, d.Name)
+		}
+	}
+	return errors.Wrapf(d.Credentials.validate(), "Invalid credentials for destination %v", d.Name)
+}
+
+// rules returns the forced refspecs mapping the mirror's refs to the
+// destination's, or nil if the destination receives every ref as-is.
+func (d Destination) rules() []gogitconfig.RefSpec {
+	rules := []gogitconfig.RefSpec{}
+	for _, ref := range d.Refs {
+		rules = append(rules, refSpec(ref, ref))
+	}
+	for _, rule := range d.Map {
+		i := strings.Index(rule, ":")
+		rules = append(rules, refSpec(rule[:i], rule[i+1:]))
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules
+}
+
+func refSpec(src, dst string) gogitconfig.RefSpec {
+	return gogitconfig.RefSpec("+" + src + ":" + dst)
+}
+
+// mapRefs returns the mirror's ref that each of the destination's refs
+// is pushed from, given the mirror's refs. A ref matching several rules
+// is pushed to each of their destinations, but a destination ref can
+// only come from one ref. Blocked refs are left out.
+func (d Destination) mapRefs(localRefs []string) (map[string]string, error) {
+	blocked := map[string]bool{}
+	for _, ref := range d.Blocked {
+		blocked[ref] = true
+	}
+
+	mapped := map[string]string{}
+	for _, ref := range localRefs {
+		if !strings.HasPrefix(ref, "refs/") || blocked[ref] {
+			continue
+		}
+		if d.IsMirror() {
+			mapped[ref] = ref
+			continue
+		}
+		for _, rule := range d.rules() {
+			name := plumbing.ReferenceName(ref)
+			if !rule.Match(name) {
+				continue
+			}
+			dst := rule.Dst(name).String()
+			if src, ok := mapped[dst]; ok && src != ref {
+				return nil, errors.Errorf("Refs %v and %v are both pushed to %v on destination %v", src, ref, dst, d.Name)
+			}
+			mapped[dst] = ref
+		}
+	}
+	return mapped, nil
+}
+
+// owns reports whether the destination ref name is managed by the push,
+// so that it is deleted once no ref of the mirror maps to it.
+func (d Destination) owns(name string) bool {
+	if d.IsMirror() {
+		return strings.HasPrefix(name, "refs/")
+	}
+	for _, rule := range d.rules() {
+		i := strings.Index(string(rule), ":")
+		if refSpec(string(rule[i+1:]), rule.Src()).Match(plumbing.ReferenceName(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// refSpecs returns the refspecs pushing the mirror's refs, localRefs, to
+// the destination. Rules with a pattern are kept as-is; rules naming a
+// single ref are left out unless the mirror has it, since git refuses to
+// push a missing ref. Refs the destination owns but that no longer map
+// from the mirror's refs, among remoteRefs, are deleted.
+//
+// Patterns would also push blocked refs, so with blocked refs every
+// ref is pushed by name instead, and the refs they map to are left
+// alone.
+func (d Destination) refSpecs(localRefs, remoteRefs []string) ([]string, error) {
+	mapped, err := d.mapRefs(localRefs)
+	if err != nil {
+		return nil, err
+	}
+	unblocked := d
+	unblocked.Blocked = nil
+	held, err := unblocked.mapRefs(d.Blocked)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []string{}
+	if len(d.Blocked) == 0 {
+		for _, rule := range d.rules() {
+			if rule.IsWildcard() || mapped[rule.Dst("").String()] != "" {
+				specs = append(specs, string(rule))
+			}
+		}
+	} else {
+		dsts := []string{}
+		for dst := range mapped {
+			dsts = append(dsts, dst)
+		}
+		sort.Strings(dsts)
+		for _, dst := range dsts {
+			specs = append(specs, string(refSpec(mapped[dst], dst)))
+		}
+	}
+	for _, ref := range remoteRefs {
+		if d.owns(ref) && mapped[ref] == "" && held[ref] == "" {
+			specs = append(specs, ":"+ref)
+		}
+	}
+	return specs, nil
+}
+
+// RefMapping is a ref of a mirror and the ref of a destination it is
+// pushed to.
+type RefMapping struct {
+	Src string
+	Dst string
+}
+
+// MapRefs returns the refs of the mirror that a push to dest sends, and
+// where they end up on dest, sorted by the destination ref.
+func (m *Mirror) MapRefs(dest Destination) ([]RefMapping, error) {
+	repo, err := gogit.PlainOpen(m.GitDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening mirror")
+	}
+	localRefs, err := listGoGitRefs(repo)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing refs")
+	}
+	mapped, err := dest.mapRefs(localRefs)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := []RefMapping{}
+	for dst, src := range mapped {
+		mappings = append(mappings, RefMapping{Src: src, Dst: dst})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Dst < mappings[j].Dst })
+	return mappings, nil
+}
+
+// destinationSubsection returns the name of the subsection of the gomir
+// section that stores the destination name.
+func destinationSubsection(name string) string {
+	if name == OriginDestination {
+		return "push"
+	}
+	return "push." + name
+}
+
+// Destinations returns the destinations the mirror pushes to, starting
+// with the origin destination.
+func (m *Mirror) Destinations() ([]Destination, error) {
+	cfg, err := readRawConfig(m.GitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	originURL, err := rawOriginURL(m.GitDir, "pushurl")
+	if err != nil {
+		return nil, err
+	}
+	section := cfg.Section("gomir")
+	dests := []Destination{readDestination(section, OriginDestination)}
+	dests[0].URL = originURL
+
+	for _, sub := range section.Subsections {
+		if !strings.HasPrefix(sub.Name, "push.") {
+			continue
+		}
+		d := readDestination(section, strings.TrimPrefix(sub.Name, "push."))
+		d.URL = sub.Option("url")
+		dests = append(dests, d)
+	}
+
+	for _, d := range dests {
+		if err := d.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return dests, nil
+}
+
+func readDestination(section *formatconfig.Section, name string) Destination {
+	sub := section.Subsection(destinationSubsection(name))
+	return Destination{
+		Name:        name,
+		Refs:        sub.OptionAll("refs"),
+		Map:         sub.OptionAll("map"),
+		Credentials: readCredentials(sub),
+	}
+}
+
+// SetDestination adds the destination to the mirror, or replaces the
+// destination with the same name. Setting the origin destination
+// changes the push URL of the origin remote.
+func (m *Mirror) SetDestination(d Destination) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+
+	return editRawConfig(m.GitDir, func(cfg *formatconfig.Config) {
+		section := cfg.Section("gomir")
+		name := destinationSubsection(d.Name)
+		if d.Name == OriginDestination {
+			cfg.Section("remote").Subsection("origin").SetOption("pushurl", d.URL)
+		} else {
+			section.Subsection(name).SetOption("url", d.URL)
+		}
+
+		sub := section.Subsection(name)
+		sub.RemoveOption("refs")
+		for _, ref := range d.Refs {
+			sub.AddOption("refs", ref)
+		}
+		sub.RemoveOption("map")
+		for _, rule := range d.Map {
+			sub.AddOption("map", rule)
+		}
+		writeCredentials(section, name, d.Credentials)
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.RemoveSection("gomir")
+		}
+	})
+}
+
+// RemoveDestination stops the mirror from pushing to the named
+// destination. The origin destination can't be removed.
+func (m *Mirror) RemoveDestination(name string) error {
+	if name == OriginDestination {
+		return errors.New("The origin destination can't be removed")
+	}
+
+	dests, err := m.Destinations()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, d := range dests {
+		found = found || d.Name == name
+	}
+	if !found {
+		return errors.Errorf("Mirror %v has no destination %#v", m, name)
+	}
+
+	return editRawConfig(m.GitDir, func(cfg *formatconfig.Config) {
+		section := cfg.Section("gomir")
+		section.RemoveSubsection(destinationSubsection(name))
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.RemoveSection("gomir")
+		}
+	})
+}
+
+// selectDestinations returns the destinations named in names, or all of
+// dests if names is empty.
+func selectDestinations(dests []Destination, names []string) []Destination {
+	if len(names) == 0 {
+		return dests
+	}
+	selected := []Destination{}
+	for _, d := range dests {
+		for _, name := range names {
+			if d.Name == name {
+				selected = append(selected, d)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// DestinationResult is the outcome of pushing a mirror to one of its
+// destinations.
+type DestinationResult struct {
+	Destination string
+	Err         error
+}
+
+// DestinationError reports a push to several destinations that failed
+// for some of them. Results holds the outcome for every destination.
+type DestinationError struct {
+	Results []DestinationResult
+}
+
+func (e *DestinationError) Error() string {
+	msgs := []string{}
+	for _, r := range e.Results {
+		if r.Err != nil {
+			msgs = append(msgs, r.Destination+": "+r.Err.Error())
+		}
+	}
+	return "Error pushing to some destinations:\n" + strings.Join(msgs, "\n")
+}
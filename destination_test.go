@@ -0,0 +1,324 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMirror_SetDestination(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	m := f.add(mgr, "file://"+f.newUpstream("project"), "file:///primary/project.git")
+	if err := m.SetOptions(MirrorOptions{PushCredentials: Credentials{SSHKey: "/keys/primary"}}); err != nil {
+		t.Fatalf("SetOptions() error = %+v", err)
+	}
+
+	backup := Destination{Name: "backup", URL: "file:///backup/project.git", Refs: []string{"refs/heads/*", "refs/tags/v*"}, Map: []string{"refs/heads/main:refs/heads/upstream-main"}, Credentials: Credentials{TokenEnv: "BACKUP_TOKEN"}}
+	if err := m.SetDestination(backup); err != nil {
+		t.Fatalf("SetDestination() error = %+v", err)
+	}
+	origin := Destination{Name: OriginDestination, URL: "file:///primary/moved.git", Refs: []string{"refs/heads/master"}, Map: []string{"refs/tags/*:refs/tags/upstream/*"}, Credentials: Credentials{SSHKey: "/keys/primary"}}
+	if err := m.SetDestination(origin); err != nil {
+		t.Fatalf("SetDestination() error = %+v", err)
+	}
+
+	want := []Destination{origin, backup}
+	if got, err := m.Destinations(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Destinations() = %+v, %v, want %+v", got, err, want)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.push.backup.url"); got != backup.URL {
+		t.Errorf("gomir.push.backup.url = %#v, want it readable by git", got)
+	}
+
+	// Options and destinations share the gomir.push subsection
+	if err := m.SetOptions(MirrorOptions{}); err != nil {
+		t.Fatalf("SetOptions() error = %+v", err)
+	}
+	if got, err := m.Destinations(); err != nil || !reflect.DeepEqual(got[0].Refs, origin.Refs) {
+		t.Errorf("Destinations() = %+v, %v, want the origin refs kept", got, err)
+	}
+
+	if err := m.RemoveDestination("backup"); err != nil {
+		t.Fatalf("RemoveDestination() error = %+v", err)
+	}
+	if err := m.SetDestination(Destination{Name: OriginDestination, URL: origin.URL}); err != nil {
+		t.Fatalf("SetDestination() error = %+v", err)
+	}
+	if strings.Contains(f.git(m.GitDir, "config", "--list"), "gomir.") {
+		t.Errorf("Removed destinations left gomir settings behind")
+	}
+
+	if err := m.RemoveDestination(OriginDestination); err == nil {
+		t.Errorf("RemoveDestination() removed the origin destination")
+	}
+	if err := m.RemoveDestination("missing"); err == nil {
+		t.Errorf("RemoveDestination() succeeded for a missing destination")
+	}
+	for _, invalid := range []Destination{
+		{Name: "back up", URL: "file:///backup"},
+		{Name: "backup"},
+		{Name: "backup", URL: "file:///backup", Refs: []string{"heads/*"}},
+		{Name: "backup", URL: "file:///backup", Refs: []string{"refs/*/v*"}},
+		{Name: "backup", URL: "file:///backup", Map: []string{"refs/heads/*"}},
+		{Name: "backup", URL: "file:///backup", Map: []string{"refs/heads/*:refs/heads/main"}},
+		{Name: "backup", URL: "file:///backup", Map: []string{"refs/heads/*:mirror/*"}},
+	} {
+		if err := m.SetDestination(invalid); err == nil {
+			t.Errorf("SetDestination() accepted %+v", invalid)
+		}
+	}
+}
+
+func TestManager_PushMirror_destinations(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			var events []Event
+			mgr.OnEvent = func(e Event) {
+				if e.Type == EventDestinationFinished {
+					events = append(events, e)
+				}
+			}
+			upstream := f.newUpstream("project")
+			primary := f.path("primary", "project.git")
+			backup := f.path("backup", "project.git")
+			m := f.add(mgr, "file://"+upstream, "file://"+primary)
+			if err := m.SetDestination(Destination{Name: "backup", URL: "file://" + backup, Refs: []string{"refs/heads/*"}}); err != nil {
+				t.Fatalf("SetDestination() error = %+v", err)
+			}
+
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			f.assertSameRefs(upstream, primary)
+			wantBackup := f.refs(upstream)
+			delete(wantBackup, "refs/tags/v1.0")
+			if got := f.refs(backup); !reflect.DeepEqual(got, wantBackup) {
+				t.Errorf("Backup refs = %v, want %v", got, wantBackup)
+			}
+			if len(events) != 2 || events[0].Destination != OriginDestination || events[1].Destination != "backup" {
+				t.Errorf("Destination events = %+v, want origin and backup", events)
+			}
+
+			// Deletions are limited to the refs the destination receives
+			f.git(backup, "tag", "local", "master")
+			f.git(upstream, "branch", "-D", "feature")
+			if !fetch(mgr, m) {
+				t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+			}
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			got := f.refs(backup)
+			if _, ok := got["refs/heads/feature"]; ok {
+				t.Errorf("Backup kept the deleted branch feature")
+			}
+			if _, ok := got["refs/tags/local"]; !ok {
+				t.Errorf("Backup lost the tag outside its refs")
+			}
+		})
+	}
+}
+
+func TestManager_PushMirror_selectedDestinations(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	primary := f.path("primary", "project.git")
+	m := f.add(mgr, "file://"+upstream, "file://"+primary)
+	backup := f.path("backup", "project.git")
+	if err := m.SetDestination(Destination{Name: "backup", URL: "file://" + backup}); err != nil {
+		t.Fatalf("SetDestination() error = %+v", err)
+	}
+
+	mgr.PushDestinations = []string{"backup"}
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, backup)
+	if _, err := os.Stat(primary); !os.IsNotExist(err) {
+		t.Errorf("PushMirror() pushed to the origin destination, which wasn't selected")
+	}
+
+	// The refs count as pushed once every destination received them
+	if refs, err := m.PushedRefs(); refs != nil || err != nil {
+		t.Errorf("PushedRefs() = %v, %v before origin was pushed, want none", refs, err)
+	}
+	if refs, err := m.destinationPushedRefs("backup"); len(refs) == 0 || err != nil {
+		t.Errorf("Pushed refs of backup = %v, %v, want the refs pushed", refs, err)
+	}
+	mgr.PushDestinations = []string{OriginDestination}
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	if refs, err := m.PushedRefs(); len(refs) == 0 || err != nil {
+		t.Errorf("PushedRefs() = %v, %v after every destination was pushed, want the refs", refs, err)
+	}
+	if ahead, _ := filepath.Glob(filepath.Join(m.GitDir, pushedRefsName+"-*")); len(ahead) != 0 {
+		t.Errorf("Pushed refs of single destinations left behind: %v", ahead)
+	}
+
+	mgr.PushDestinations = []string{"missing"}
+	if !push(mgr, m) {
+		t.Errorf("PushMirror() failed for a mirror without the selected destination")
+	}
+	if log := readLog(t, m); !strings.Contains(log, "No destination named missing") {
+		t.Errorf("Log does not record the skipped mirror:\n%v", log)
+	}
+
+	// A destination no mirror has is a mistake rather than nothing to do
+	if results, err := mgr.Push(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Push() = %v, %v, want an error naming the unknown destination", results, err)
+	}
+	mgr.PushDestinations = []string{"backup"}
+	if _, err := mgr.Push(); err != nil {
+		t.Errorf("Push() error = %+v with a known destination", err)
+	}
+}
+
+func TestManager_PushMirror_failedDestination(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	m := f.add(mgr, "file://"+upstream, f.unreachableURL())
+	backup := f.path("backup", "project.git")
+	if err := m.SetDestination(Destination{Name: "backup", URL: "file://" + backup}); err != nil {
+		t.Fatalf("SetDestination() error = %+v", err)
+	}
+
+	err := mgr.PushMirror(m)
+	destErr, ok := errors.Cause(err).(*DestinationError)
+	if !ok {
+		t.Fatalf("PushMirror() error = %v, want a *DestinationError", err)
+	}
+	if len(destErr.Results) != 2 || destErr.Results[0].Err == nil || destErr.Results[1].Err != nil {
+		t.Errorf("Results = %+v, want origin failed and backup pushed", destErr.Results)
+	}
+	if !strings.Contains(err.Error(), "origin: Error pushing") {
+		t.Errorf("Error() = %v, want the failed destination", err)
+	}
+	f.assertSameRefs(upstream, backup)
+}
+
+func TestDestination_refSpecs(t *testing.T) {
+	localRefs := []string{"refs/heads/main", "refs/heads/feature", "refs/tags/v1"}
+	tests := []struct {
+		dest       Destination
+		remoteRefs []string
+		want       []string
+		wantErr    bool
+	}{
+		{
+			Destination{Name: "mirror"},
+			[]string{"refs/heads/main", "refs/heads/gone"},
+			[]string{":refs/heads/gone"},
+			false,
+		},
+		{
+			Destination{Name: "prefixed", Map: []string{"refs/heads/*:refs/heads/mirror/*"}},
+			[]string{"HEAD", "refs/heads/local", "refs/heads/mirror/main", "refs/heads/mirror/gone", "refs/tags/v1"},
+			[]string{"+refs/heads/*:refs/heads/mirror/*", ":refs/heads/mirror/gone"},
+			false,
+		},
+		{
+			Destination{Name: "renamed", Refs: []string{"refs/tags/*"}, Map: []string{"refs/heads/main:refs/heads/upstream-main", "refs/heads/gone:refs/heads/upstream-gone"}},
+			[]string{"refs/heads/main", "refs/heads/upstream-gone", "refs/tags/v0"},
+			[]string{"+refs/tags/*:refs/tags/*", "+refs/heads/main:refs/heads/upstream-main", ":refs/heads/upstream-gone", ":refs/tags/v0"},
+			false,
+		},
+		{
+			Destination{Name: "collision", Map: []string{"refs/heads/*:refs/mirror/*", "refs/tags/v1:refs/mirror/main"}},
+			nil,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.dest.refSpecs(localRefs, tt.remoteRefs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: refSpecs() error = %v, wantErr %v", tt.dest.Name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: refSpecs() = %v, want %v", tt.dest.Name, got, tt.want)
+		}
+	}
+}
+
+func TestManager_PushMirror_refMapping(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			upstream := f.newUpstream("project")
+			dest := f.path("destination", "project.git")
+			f.git(f.dir, "clone", "-q", "--bare", upstream, dest)
+			f.git(dest, "branch", "local-work", "master")
+			f.git(dest, "branch", "-D", "feature")
+			m := f.add(mgr, "file://"+upstream, "file://"+dest)
+			mapping := []string{"refs/heads/*:refs/heads/mirror/*", "refs/heads/master:refs/heads/upstream-main"}
+			if err := m.SetDestination(Destination{Name: OriginDestination, URL: "file://" + dest, Map: mapping}); err != nil {
+				t.Fatalf("SetDestination() error = %+v", err)
+			}
+
+			dests, err := m.Destinations()
+			if err != nil {
+				t.Fatalf("Destinations() error = %+v", err)
+			}
+			preview, err := m.MapRefs(dests[0])
+			if err != nil {
+				t.Fatalf("MapRefs() error = %+v", err)
+			}
+			wantPreview := []RefMapping{
+				{"refs/heads/feature", "refs/heads/mirror/feature"},
+				{"refs/heads/master", "refs/heads/mirror/master"},
+				{"refs/heads/master", "refs/heads/upstream-main"},
+			}
+			if !reflect.DeepEqual(preview, wantPreview) {
+				t.Errorf("MapRefs() = %v, want %v", preview, wantPreview)
+			}
+
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			upstreamRefs := f.refs(upstream)
+			got := f.refs(dest)
+			for _, ref := range []string{"refs/heads/mirror/master", "refs/heads/mirror/feature", "refs/heads/upstream-main", "refs/heads/local-work"} {
+				if got[ref] == "" {
+					t.Errorf("Destination lacks %v", ref)
+				}
+			}
+			if got["refs/heads/mirror/feature"] != upstreamRefs["refs/heads/feature"] {
+				t.Errorf("mirror/feature = %v, want %v", got["refs/heads/mirror/feature"], upstreamRefs["refs/heads/feature"])
+			}
+
+			// Deletions stay within the mapped refs
+			f.git(upstream, "branch", "-D", "feature")
+			if !fetch(mgr, m) {
+				t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+			}
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			got = f.refs(dest)
+			if _, ok := got["refs/heads/mirror/feature"]; ok {
+				t.Errorf("Destination kept mirror/feature after feature was deleted")
+			}
+			for _, ref := range []string{"refs/heads/local-work", "refs/heads/master", "refs/tags/v1.0"} {
+				if got[ref] == "" {
+					t.Errorf("Destination lost %v, which isn't mapped", ref)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitEnv collects the environment variables and config that make a git
+// command connect to a remote the way the mirror's settings ask for.
+// Config is passed through the environment, like `git -c` but without
+// showing up in the command line.
+type gitEnv struct {
+	vars []string
+	// config holds key and value pairs
+	config []string
+}
+
+// remoteEnv returns the environment for git commands that talk to the
+// remote at rawURL with creds over network. If the remote's bandwidth is limited,
+// git connects through the local proxies limiting it, which run until
+// stop is called.
+func remoteEnv(rawURL string, creds Credentials, network Network) (env []string, stop func(), err error) {
+	proxies, stop, err := network.throttle.localProxies(network)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error limiting bandwidth")
+	}
+
+	var e gitEnv
+	e.addSSHCommand(creds, network, proxies)
+	if err := e.addCredentials(rawURL, creds); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	e.addNetwork(network, proxies)
+	return append(os.Environ(), e.list()...), stop, nil
+}
+
+func (e *gitEnv) set(name, value string) {
+	e.vars = append(e.vars, name+"="+value)
+}
+
+func (e *gitEnv) setConfig(key, value string) {
+	e.config = append(e.config, key, value)
+}
+
+// list returns the variables, followed by those passing the config.
+func (e *gitEnv) list() []string {
+	env := append([]string{}, e.vars...)
+	if len(e.config) == 0 {
+		return env
+	}
+	for i := 0; i+1 < len(e.config); i += 2 {
+		n := strconv.Itoa(i / 2)
+		env = append(env, "GIT_CONFIG_KEY_"+n+"="+e.config[i], "GIT_CONFIG_VALUE_"+n+"="+e.config[i+1])
+	}
+	return append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(len(e.config)/2))
+}
+
+// addSSHCommand sets GIT_SSH_COMMAND if creds, network or proxies change
+// how ssh connects. Through a forwarder, ssh still verifies the host key
+// of the remote, or the jump host, by its name.
+func (e *gitEnv) addSSHCommand(creds Credentials, network Network, proxies localProxies) {
+	ssh := []string{"ssh"}
+	if creds.SSHKey != "" {
+		// Don't try the agent's keys first
+		ssh = append(ssh, "-i", shellQuote(creds.SSHKey), "-o", "IdentitiesOnly=yes")
+	}
+	if creds.KnownHosts != "" {
+		ssh = append(ssh, "-o", shellQuote("UserKnownHostsFile="+creds.KnownHosts), "-o", "StrictHostKeyChecking=yes")
+	}
+	switch {
+	case proxies.sshJump != "":
+		jump := fmt.Sprintf("ssh -o HostName=%v -o Port=%v -o HostKeyAlias=%v -W %%h:%%p %v",
+			proxies.sshHost, proxies.sshPort, shellQuote(proxies.sshAlias), shellQuote(proxies.sshJump))
+		ssh = append(ssh, "-o", shellQuote("ProxyCommand="+jump))
+	case proxies.sshHost != "":
+		ssh = append(ssh, "-o", "HostName="+proxies.sshHost, "-o", "Port="+proxies.sshPort,
+			"-o", shellQuote("HostKeyAlias="+proxies.sshAlias))
+	case network.SSHProxyJump != "":
+		ssh = append(ssh, "-J", shellQuote(network.SSHProxyJump))
+	}
+	if network.ConnectTimeout > 0 {
+		ssh = append(ssh, "-o", "ConnectTimeout="+seconds(network.ConnectTimeout))
+	}
+	if len(ssh) > 1 {
+		e.set("GIT_SSH_COMMAND", strings.Join(ssh, " "))
+	}
+}
+
+// addCredentials makes git authenticate with creds if rawURL is an http
+// remote. The token is handed to git through an environment variable read
+// by an inline credential helper, which replaces the operator's helpers.
+func (e *gitEnv) addCredentials(rawURL string, creds Credentials) error {
+	if !isHTTPURL(rawURL) {
+		return nil
+	}
+	token, err := creds.token()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		e.set("GOMIR_GIT_USERNAME", creds.username())
+		e.set("GOMIR_GIT_PASSWORD", token)
+		// Fail rather than prompt if the token is rejected
+		e.set("GIT_TERMINAL_PROMPT", "0")
+		// An empty helper clears the helpers configured before it
+		e.setConfig("credential.helper", "")
+		e.setConfig("credential.helper", `!f() { test "$1" = get && echo "username=$GOMIR_GIT_USERNAME" && echo "password=$GOMIR_GIT_PASSWORD"; }; f`)
+	}
+
+	if creds.SSLCert != "" {
+		e.set("GIT_SSL_CERT", creds.SSLCert)
+		key := creds.SSLKey
+		if key == "" {
+			key = creds.SSLCert
+		}
+		e.set("GIT_SSL_KEY", key)
+	}
+	return nil
+}
+
+// addNetwork applies the http settings of network. Git reads NO_PROXY
+// itself, so the proxy applies to the hosts it doesn't list. Through the
+// SOCKS proxy of proxies, which picks the proxy for each host itself,
+// git reaches every host, authenticating with the credentials of the
+// proxy.
+func (e *gitEnv) addNetwork(network Network, proxies localProxies) {
+	if proxies.socks != "" {
+		// socks5h leaves resolving the host to the proxy, which needs its
+		// name
+		e.setConfig("http.proxy", "socks5h://"+proxies.socks)
+		e.set("NO_PROXY", "")
+		e.set("no_proxy", "")
+	} else {
+		if network.Proxy != "" {
+			e.setConfig("http.proxy", network.Proxy)
+		}
+		if network.NoProxy != "" {
+			e.set("NO_PROXY", network.NoProxy)
+			e.set("no_proxy", network.NoProxy)
+		}
+	}
+	if network.LowSpeedLimit > 0 {
+		e.setConfig("http.lowSpeedLimit", strconv.Itoa(network.LowSpeedLimit))
+	}
+	if network.LowSpeedTime > 0 {
+		e.setConfig("http.lowSpeedTime", seconds(network.LowSpeedTime))
+	}
+	if network.CABundle != "" {
+		e.set("GIT_SSL_CAINFO", network.CABundle)
+	}
+}
+
+// shellQuote quotes s as a single word for the POSIX shell that runs
+// GIT_SSH_COMMAND.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
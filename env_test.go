@@ -0,0 +1,73 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_remoteEnv(t *testing.T) {
+	t.Setenv("GOMIR_TEST_TOKEN", "s3cret")
+	tests := []struct {
+		name    string
+		url     string
+		creds   Credentials
+		network Network
+		want    []string
+		wantErr bool
+	}{
+		{"none", "https://example.com/project.git", Credentials{}, Network{}, []string{}, false},
+		{"ssh", "ssh://git@example.com/project.git", Credentials{SSHKey: "/keys/it's", KnownHosts: "/keys/known hosts"}, Network{SSHProxyJump: "jump@bastion:2222", ConnectTimeout: 1500 * time.Millisecond}, []string{
+			`GIT_SSH_COMMAND=ssh -i '/keys/it'\''s' -o IdentitiesOnly=yes -o 'UserKnownHostsFile=/keys/known hosts' -o StrictHostKeyChecking=yes -J 'jump@bastion:2222' -o ConnectTimeout=2`,
+		}, false},
+		{"token", "https://example.com/project.git", Credentials{TokenEnv: "GOMIR_TEST_TOKEN"}, Network{}, []string{
+			"GOMIR_GIT_USERNAME=git",
+			"GOMIR_GIT_PASSWORD=s3cret",
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_CONFIG_KEY_0=credential.helper",
+			"GIT_CONFIG_VALUE_0=",
+			"GIT_CONFIG_KEY_1=credential.helper",
+			`GIT_CONFIG_VALUE_1=!f() { test "$1" = get && echo "username=$GOMIR_GIT_USERNAME" && echo "password=$GOMIR_GIT_PASSWORD"; }; f`,
+			"GIT_CONFIG_COUNT=2",
+		}, false},
+		{"client certificate", "https://example.com/project.git", Credentials{SSLCert: "/tls/both.pem"}, Network{}, []string{
+			"GIT_SSL_CERT=/tls/both.pem",
+			"GIT_SSL_KEY=/tls/both.pem",
+		}, false},
+		{"http network", "https://example.com/project.git", Credentials{}, Network{Proxy: "http://proxy:3128", NoProxy: ".internal,localhost", LowSpeedLimit: 1000, LowSpeedTime: time.Minute, CABundle: "/tls/ca.pem"}, []string{
+			"NO_PROXY=.internal,localhost",
+			"no_proxy=.internal,localhost",
+			"GIT_SSL_CAINFO=/tls/ca.pem",
+			"GIT_CONFIG_KEY_0=http.proxy",
+			"GIT_CONFIG_VALUE_0=http://proxy:3128",
+			"GIT_CONFIG_KEY_1=http.lowSpeedLimit",
+			"GIT_CONFIG_VALUE_1=1000",
+			"GIT_CONFIG_KEY_2=http.lowSpeedTime",
+			"GIT_CONFIG_VALUE_2=60",
+			"GIT_CONFIG_COUNT=3",
+		}, false},
+		{"missing token", "https://example.com/project.git", Credentials{TokenEnv: "GOMIR_TEST_MISSING"}, Network{}, nil, true},
+		{"missing token file", "https://example.com/project.git", Credentials{TokenFile: "/missing/token"}, Network{}, nil, true},
+		{"ssh ignores token", "git@example.com:project.git", Credentials{TokenEnv: "GOMIR_TEST_MISSING"}, Network{}, []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stop, err := remoteEnv(tt.url, tt.creds, tt.network)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("remoteEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			stop()
+			if got = got[len(os.Environ()):]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("remoteEnv() added %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
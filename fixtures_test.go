@@ -0,0 +1,172 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixture is a throwaway workspace for integration tests. Upstream
+// repositories, push destinations and the gomir mirror root all live
+// under dir.
+type fixture struct {
+	t   *testing.T
+	dir string
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git executable not found")
+	}
+
+	f := &fixture{t: t, dir: t.TempDir()}
+	root := f.path("mirrors")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("Error creating mirror root: %+v", err)
+	}
+	return f
+}
+
+// path returns the absolute path of elem within the fixture.
+func (f *fixture) path(elem ...string) string {
+	return filepath.Join(append([]string{f.dir}, elem...)...)
+}
+
+// git runs git in dir and returns its trimmed output, failing the test
+// on error.
+func (f *fixture) git(dir string, args ...string) string {
+	f.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %v: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// newUpstream creates a non-bare repository with a commit on master, a
+// second branch and an annotated tag, and returns its path.
+func (f *fixture) newUpstream(name string) string {
+	f.t.Helper()
+	dir := f.path("upstream", name)
+	f.git(f.dir, "init", "-q", "-b", "master", dir)
+	f.commit(dir, "Initial commit")
+	f.git(dir, "branch", "feature")
+	f.git(dir, "tag", "-a", "v1.0", "-m", "Version 1.0")
+	return dir
+}
+
+// commit creates a commit in the repository at dir and returns its hash.
+func (f *fixture) commit(dir, message string) string {
+	f.t.Helper()
+	f.git(dir, "commit", "-q", "--allow-empty", "-m", message)
+	return f.git(dir, "rev-parse", "HEAD")
+}
+
+// refs returns the refs of the repository at dir mapped to the objects
+// they point to.
+func (f *fixture) refs(dir string) map[string]string {
+	f.t.Helper()
+	refs := map[string]string{}
+	output := f.git(dir, "for-each-ref", "--format=%(refname) %(objectname)")
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[0]] = fields[1]
+		}
+	}
+	return refs
+}
+
+// assertSameRefs fails the test if the repositories at want and got do
+// not have identical refs.
+func (f *fixture) assertSameRefs(want, got string) {
+	f.t.Helper()
+	wantRefs, gotRefs := f.refs(want), f.refs(got)
+	for name, hash := range wantRefs {
+		if gotRefs[name] != hash {
+			f.t.Errorf("Ref %v = %#v in %v, want %v", name, gotRefs[name], got, hash)
+		}
+	}
+	for name := range gotRefs {
+		if _, ok := wantRefs[name]; !ok {
+			f.t.Errorf("Unexpected ref %v in %v", name, got)
+		}
+	}
+}
+
+// serveSmartHTTP serves the repositories under root through
+// `git http-backend` and returns the server's base URL.
+func (f *fixture) serveSmartHTTP(root string) string {
+	srv := httptest.NewServer(f.httpBackend(root))
+	f.t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// serveSmartHTTPAuth is serveSmartHTTP for clients that authenticate
+// with username and password.
+func (f *fixture) serveSmartHTTPAuth(root, username, password string) string {
+	backend := f.httpBackend(root)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gomir"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	f.t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func (f *fixture) httpBackend(root string) http.Handler {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		f.t.Fatalf("Error finding git: %+v", err)
+	}
+
+	return &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			// Enables receive-pack
+			"REMOTE_USER=gomir",
+		},
+	}
+}
+
+// serveDumbHTTP serves the files under root as-is and returns the
+// server's base URL. Git clients can only read from it if the
+// repositories' server info is up to date.
+func (f *fixture) serveDumbHTTP(root string) string {
+	srv := httptest.NewServer(http.FileServer(http.Dir(root)))
+	f.t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// unreachableURL returns an http URL that refuses connections.
+func (f *fixture) unreachableURL() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL + "/missing.git"
+}
+
+// manager returns a Manager for the fixture's mirror root using the
+// named git backend.
+func (f *fixture) manager(backendName string) *Manager {
+	mgr := NewManager(f.path("mirrors"))
+	mgr.Backend = gitBackends[backendName]
+	return mgr
+}
@@ -2,63 +2,214 @@
 // Use of this source code is governed by a MIT
 // license that can be found in the LICENSE file.
 
-package main
+package gomir
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"net/url"
-	"os"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
-// git clone --mirror <fetchURL> <localDest>
-func gitCloneMirror(fetchURL, localDest string) error {
+// GitBackend performs the git operations gomir needs to mirror a
+// repository. Output from git is written to logFile. Clone, fetch and
+// push apply the mirror's options; backends return an error for options
+// they don't support. Clone and fetch authenticate with the options'
+// FetchCredentials, push with the destination's Credentials. Since they
+// talk to remotes, they also stop when ctx is cancelled.
+type GitBackend interface {
+	CloneMirror(ctx context.Context, fetchURL, localDest string, opts MirrorOptions, logFile io.Writer) error
+	SetOriginPushURL(gitDir, pushURL string) error
+	GetOriginPushURL(gitDir string) (*url.URL, error)
+	PushMirror(ctx context.Context, gitDir string, dest Destination, opts MirrorOptions, logFile io.Writer) error
+	InitBareRepo(gitDir string, logFile io.Writer) error
+	UpdateServerInfo(gitDir string, logFile io.Writer) error
+	FetchPrune(ctx context.Context, gitDir string, opts MirrorOptions, logFile io.Writer) error
+	FetchSources(ctx context.Context, gitDir string, sources []Source, opts MirrorOptions, logFile io.Writer) error
+}
+
+// gitBackends maps backend names to their implementations.
+var gitBackends = map[string]GitBackend{
+	"exec":   ExecBackend{},
+	"go-git": GoGitBackend{},
+}
+
+// NewGitBackend returns the git backend with the given name, either
+// "exec" or "go-git".
+func NewGitBackend(name string) (GitBackend, error) {
+	backend, ok := gitBackends[name]
+	if !ok {
+		return nil, errors.Errorf("Unknown git backend %#v", name)
+	}
+	return backend, nil
+}
+
+// ExecBackend implements GitBackend by running the git executable.
+type ExecBackend struct{}
+
+// git clone --mirror --progress [<historyArgs>] <fetchURL> <localDest>
+func (ExecBackend) CloneMirror(ctx context.Context, fetchURL, localDest string, opts MirrorOptions, logFile io.Writer) error {
 	if fetchURL == "" {
 		return errors.New("fetchURL is empty")
 	}
 	if localDest == "" {
 		return errors.New("localDest is empty")
 	}
-	cmd := exec.Command("git", "clone", "--mirror", fetchURL, localDest)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return errors.Wrap(cmd.Run(), "Error cloning repository")
+	args := []string{"clone", "--mirror", "--progress"}
+	args = append(args, historyArgs(opts)...)
+	if opts.IsShallow() {
+		// --depth and --shallow-since imply --single-branch
+		args = append(args, "--no-single-branch")
+	}
+	env, stop, err := remoteEnv(fetchURL, opts.FetchCredentials, opts.FetchNetwork)
+	if err != nil {
+		return errors.Wrap(err, "Error cloning repository")
+	}
+	defer stop()
+	cmd := exec.CommandContext(ctx, "git", append(args, fetchURL, localDest)...)
+	cmd.Env = env
+	return errors.Wrap(runGit(cmd, logFile), "Error cloning repository")
 }
 
 // cd <gitDir>
 // git remote set-url --push origin <pushURL>
-func gitSetOriginPushURL(gitDir, pushURL string) error {
+func (ExecBackend) SetOriginPushURL(gitDir, pushURL string) error {
 	cmd := exec.Command("git", "remote", "set-url", "--push", "origin", pushURL)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
 	cmd.Dir = gitDir
-	return errors.Wrap(cmd.Run(), "Error setting push URL")
+	return errors.Wrap(runGit(cmd, nil), "Error setting push URL")
 }
 
 // cd <gitDir>
-// git push --mirror
-func gitPushMirror(gitDir string, logFile io.Writer) error {
-	cmd := exec.Command("git", "push", "--mirror")
-	cmd.Stderr = logFile
-	cmd.Stdout = logFile
+// git push --mirror --progress <dest.URL>
+// git ls-remote <dest.URL>, git push --force --progress <dest.URL> <dest.refSpecs>...  (for a ref filter, mapping or blocked refs)
+func (ExecBackend) PushMirror(ctx context.Context, gitDir string, dest Destination, opts MirrorOptions, logFile io.Writer) error {
+	env, stop, err := remoteEnv(dest.URL, dest.Credentials, dest.Network)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	defer stop()
+	if opts.Filter != "" {
+		// Git would otherwise try to fetch the objects the filter left
+		// out from the source, which is unreachable while pushing
+		env = append(env, "GIT_NO_LAZY_FETCH=1")
+	}
+
+	localRefs, err := listRefs(gitDir)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	mapped, err := dest.mapRefs(localRefs)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+
+	// git rejects a mirror push from a shallow repository when several
+	// refs end at different shallow boundaries. Pushing the refs one at
+	// a time works, after which the final push only has deletions left.
+	if isShallowRepo(gitDir) {
+		if err := pushRefsSeparately(ctx, gitDir, dest.URL, mapped, env, logFile); err != nil {
+			return errors.Wrap(err, "Error pushing mirrored git repo")
+		}
+	}
+
+	args := []string{"push", "--mirror", "--progress", dest.URL}
+	if !dest.pushesAll() {
+		// git's --prune would delete the refs mapped from refs the
+		// mirror doesn't have, or held back, so work out the deletions
+		// ourselves
+		remoteRefs, err := lsRemote(ctx, gitDir, dest.URL, env, logFile)
+		if err != nil {
+			return errors.Wrap(err, "Error pushing mirrored git repo")
+		}
+		specs, err := dest.refSpecs(localRefs, remoteRefs)
+		if err != nil {
+			return errors.Wrap(err, "Error pushing mirrored git repo")
+		}
+		if len(specs) == 0 {
+			fmt.Fprintln(logFile, "No refs to push")
+			return nil
+		}
+		args = append([]string{"push", "--force", "--progress", dest.URL}, specs...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = gitDir
-	return errors.Wrap(cmd.Run(), "Error pushing mirrored git repo")
+	cmd.Env = env
+	return errors.Wrap(runGit(cmd, logFile), "Error pushing mirrored git repo")
+}
+
+// cd <gitDir>
+// git push --force --progress <pushURL> <src>:<dst>  (for each mapped ref)
+func pushRefsSeparately(ctx context.Context, gitDir, pushURL string, mapped map[string]string, env []string, logFile io.Writer) error {
+	dsts := []string{}
+	for dst := range mapped {
+		dsts = append(dsts, dst)
+	}
+	sort.Strings(dsts)
+
+	for _, dst := range dsts {
+		cmd := exec.CommandContext(ctx, "git", "push", "--force", "--progress", pushURL, fmt.Sprintf("%v:%v", mapped[dst], dst))
+		cmd.Dir = gitDir
+		cmd.Env = env
+		if err := runGit(cmd, logFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cd <gitDir>
+// git ls-remote <remoteURL>
+func lsRemote(ctx context.Context, gitDir, remoteURL string, env []string, logFile io.Writer) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", remoteURL)
+	cmd.Dir = gitDir
+	cmd.Env = env
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := runGit(cmd, logFile); err != nil {
+		return nil, err
+	}
+
+	refs := []string{}
+	for _, line := range strings.Split(output.String(), "\n") {
+		// Skip the peeled entries of annotated tags, which aren't refs
+		if fields := strings.Fields(line); len(fields) == 2 && !strings.HasSuffix(fields[1], "^{}") {
+			refs = append(refs, fields[1])
+		}
+	}
+	return refs, nil
+}
+
+// cd <gitDir>
+// git for-each-ref --format=%(refname)
+func listRefs(gitDir string) ([]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(refname)")
+	cmd.Dir = gitDir
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := runGit(cmd, nil); err != nil {
+		return nil, err
+	}
+	return strings.Fields(output.String()), nil
 }
 
 // cd <gitDir>
 // git remote get-url --push origin
-func gitGetOriginPushURL(gitDir string) (*url.URL, error) {
+func (ExecBackend) GetOriginPushURL(gitDir string) (*url.URL, error) {
 	cmd := exec.Command("git", "remote", "get-url", "--push", "origin")
 	cmd.Dir = gitDir
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error running git command `git remote get-url --push origin` for %#v", gitDir)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := runGit(cmd, nil); err != nil {
+		return nil, errors.Wrapf(err, "Error reading push URL for %#v", gitDir)
 	}
 
-	urlOutput, err := url.Parse(strings.TrimSpace(string(output)))
+	urlOutput, err := url.Parse(strings.TrimSpace(output.String()))
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing push URL")
 	}
@@ -67,29 +218,198 @@ func gitGetOriginPushURL(gitDir string) (*url.URL, error) {
 }
 
 // git init --bare <gitDir>
-func gitInitBareRepo(gitDir string, logFile io.Writer) error {
+func (ExecBackend) InitBareRepo(gitDir string, logFile io.Writer) error {
 	cmd := exec.Command("git", "init", "--bare", gitDir)
-	cmd.Stderr = logFile
-	cmd.Stdout = logFile
-	return errors.Wrapf(cmd.Run(), "Error initializing bare git repo at %v", gitDir)
+	return errors.Wrapf(runGit(cmd, logFile), "Error initializing bare git repo at %v", gitDir)
 }
 
 // cd <gitDir>
 // git update-server-info
-func gitUpdateServerInfo(gitDir string, logFile io.Writer) error {
+func (ExecBackend) UpdateServerInfo(gitDir string, logFile io.Writer) error {
 	cmd := exec.Command("git", "update-server-info")
-	cmd.Stderr = logFile
-	cmd.Stdout = logFile
 	cmd.Dir = gitDir
-	return errors.Wrap(cmd.Run(), "Error updating server info")
+	return errors.Wrap(runGit(cmd, logFile), "Error updating server info")
+}
+
+// cd <gitDir>
+// git fetch -p --progress origin [<historyArgs>]
+func (ExecBackend) FetchPrune(ctx context.Context, gitDir string, opts MirrorOptions, logFile io.Writer) error {
+	fetchURL, err := rawOriginURL(gitDir, "url")
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+	env, stop, err := remoteEnv(fetchURL, opts.FetchCredentials, opts.FetchNetwork)
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+	defer stop()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"fetch", "-p", "--progress", "origin"}, historyArgs(opts)...)...)
+	cmd.Dir = gitDir
+	cmd.Env = env
+	return errors.Wrap(runGit(cmd, logFile), "Error fetching")
 }
 
 // cd <gitDir>
-// git fetch -p origin
-func gitFetchPrune(gitDir string, logFile io.Writer) error {
-	cmd := exec.Command("git", "fetch", "-p", "origin")
-	cmd.Stderr = logFile
-	cmd.Stdout = logFile
+// git ls-remote <source.URL>  (for each source)
+// git fetch --no-tags --progress <source.URL> [<historyArgs>] <source.refSpecs>  (for each source)
+// git update-ref --stdin  (deleting the refs no source has)
+func (ExecBackend) FetchSources(ctx context.Context, gitDir string, sources []Source, opts MirrorOptions, logFile io.Writer) error {
+	envs := make([][]string, len(sources))
+	listed := make([][]string, len(sources))
+	for i, s := range sources {
+		env, stop, err := remoteEnv(s.URL, s.Credentials, s.Network)
+		if err != nil {
+			return errors.Wrapf(err, "Error fetching %v", s.Name)
+		}
+		defer stop()
+		envs[i] = env
+
+		if listed[i], err = lsRemote(ctx, gitDir, s.URL, env, logFile); err != nil {
+			return errors.Wrapf(err, "Error listing refs of %v", s.Name)
+		}
+	}
+
+	want, err := mapSourceRefs(sources, listed)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range sources {
+		args := append([]string{"fetch", "--no-tags", "--progress", s.URL}, historyArgs(opts)...)
+		cmd := exec.CommandContext(ctx, "git", append(args, s.refSpecs()...)...)
+		cmd.Dir = gitDir
+		cmd.Env = envs[i]
+		if err := runGit(cmd, logFile); err != nil {
+			return errors.Wrapf(err, "Error fetching %v", s.Name)
+		}
+	}
+
+	localRefs, err := listRefs(gitDir)
+	if err != nil {
+		return errors.Wrap(err, "Error pruning")
+	}
+	var deletes bytes.Buffer
+	for _, ref := range staleRefs(localRefs, want) {
+		fmt.Fprintf(logFile, " - [deleted] %v\n", ref)
+		fmt.Fprintf(&deletes, "delete %v\n", ref)
+	}
+	if deletes.Len() == 0 {
+		return nil
+	}
+	cmd := exec.Command("git", "update-ref", "--stdin")
 	cmd.Dir = gitDir
-	return errors.Wrap(cmd.Run(), "Error fetching")
+	cmd.Stdin = &deletes
+	return errors.Wrap(runGit(cmd, logFile), "Error pruning")
+}
+
+// historyArgs returns the clone and fetch arguments that limit the
+// history and objects transferred.
+func historyArgs(opts MirrorOptions) []string {
+	args := []string{}
+	if opts.Depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%v", opts.Depth))
+	}
+	if opts.ShallowSince != "" {
+		args = append(args, fmt.Sprintf("--shallow-since=%v", opts.ShallowSince))
+	}
+	if opts.Filter != "" {
+		args = append(args, fmt.Sprintf("--filter=%v", opts.Filter))
+	}
+	return args
+}
+
+// GitError describes a git command that failed.
+type GitError struct {
+	// Args is the command line, starting with "git"
+	Args []string
+	// Dir is the directory the command ran in, if not the current one
+	Dir string
+	// Stderr holds the last lines git wrote to stderr
+	Stderr string
+	// Err is the error returned by exec, typically an *exec.ExitError
+	Err error
+}
+
+func (e *GitError) Error() string {
+	where := ""
+	if e.Dir != "" {
+		where = fmt.Sprintf(" in %v", e.Dir)
+	}
+	msg := fmt.Sprintf("`%v`%v failed: %v", strings.Join(e.Args, " "), where, e.Err)
+	if e.Stderr != "" {
+		msg += "\n" + e.Stderr
+	}
+	return msg
+}
+
+// Unwrap returns the underlying exec error. GitError deliberately has
+// no Cause method, so that errors.Cause stops at the GitError.
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// Limits on the stderr kept in a GitError
+const (
+	stderrTailBytes = 8 * 1024
+	stderrTailLines = 10
+)
+
+// runGit runs cmd, copying its output to logFile if set. If git fails,
+// the returned *GitError includes the tail of its stderr.
+func runGit(cmd *exec.Cmd, logFile io.Writer) error {
+	stderr := &tailBuffer{max: stderrTailBytes}
+	cmd.Stderr = stderr
+	if logFile != nil {
+		cmd.Stderr = io.MultiWriter(logFile, stderr)
+		if cmd.Stdout == nil {
+			cmd.Stdout = logFile
+		}
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	return &GitError{
+		Args:   cmd.Args,
+		Dir:    cmd.Dir,
+		Stderr: tailLines(stderr.String(), stderrTailLines),
+		Err:    err,
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// tailLines returns the last n non-empty lines of s. Progress output
+// separated by carriage returns only keeps its final update.
+func tailLines(s string, n int) string {
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
 }
@@ -4,16 +4,25 @@
 
 // license that can be found in the LICENSE file.
 
-package main
+package gomir
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
 func Test_gitCloneMirror(t *testing.T) {
+	f := newFixture(t)
+	upstream := f.newUpstream("hello-world")
+	f.git(f.dir, "clone", "-q", "--bare", upstream, upstream+".git")
+
 	type args struct {
 		fetchURL  string
 		localDest string
@@ -30,55 +39,64 @@ func Test_gitCloneMirror(t *testing.T) {
 		},
 		{
 			"EmptyLocalDest",
-			args{"https://github.com/octocat/Hello-World.git", ""},
+			args{"file://" + upstream + ".git", ""},
 			true,
 		},
 		{
 			"SuccessfulMirror",
-			args{"https://github.com/octocat/Hello-World.git", "successfulmirror"},
+			args{"file://" + upstream + ".git", "successfulmirror"},
 			false,
 		},
 		{
 			"SuccessfulMirrorNoDotGit",
-			args{"https://github.com/octocat/Hello-World", "successfulmirrornodotgit"},
+			args{"file://" + upstream, "successfulmirrornodotgit"},
 			false,
 		},
 	}
 
-	baseTempDir, err := ioutil.TempDir("", "Test_gitCloneMirror")
-	if err != nil {
-		t.Fatalf("Error generating base temp dir: %+v", err)
-	}
-
-	for _, tt := range tests {
+	baseTempDir := f.path("mirrors")
 
-		// If localDest is set, prepend the base temp dir to it
-		localDest := tt.args.localDest
-		if localDest != "" {
-			localDest = path.Join(baseTempDir, tt.args.localDest)
-		}
+	for _, backendName := range backendNames() {
+		backend := gitBackends[backendName]
+		for _, tt := range tests {
 
-		t.Run(tt.name, func(t *testing.T) {
-			err := gitCloneMirror(tt.args.fetchURL, localDest)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("gitCloneMirror() error = %v, wantErr %v", err, tt.wantErr)
+			// If localDest is set, prepend the base temp dir to it
+			localDest := tt.args.localDest
+			if localDest != "" {
+				localDest = path.Join(baseTempDir, backendName, tt.args.localDest)
 			}
 
-			if err == nil {
-				ensureDirExists(t, path.Join(localDest, "hooks"))
-				ensureDirExists(t, path.Join(localDest, "info"))
-				ensureDirExists(t, path.Join(localDest, "objects"))
-				ensureDirExists(t, path.Join(localDest, "refs"))
-				ensureFileExists(t, path.Join(localDest, "config"))
-				ensureFileExists(t, path.Join(localDest, "description"))
-				ensureFileExists(t, path.Join(localDest, "HEAD"))
-				ensureFileExists(t, path.Join(localDest, "packed-refs"))
-			}
-		})
+			t.Run(backendName+"/"+tt.name, func(t *testing.T) {
+				err := backend.CloneMirror(context.Background(), tt.args.fetchURL, localDest, MirrorOptions{}, ioutil.Discard)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("CloneMirror() error = %v, wantErr %v", err, tt.wantErr)
+				}
+
+				if err == nil {
+					ensureDirExists(t, path.Join(localDest, "hooks"))
+					ensureDirExists(t, path.Join(localDest, "info"))
+					ensureDirExists(t, path.Join(localDest, "objects"))
+					ensureDirExists(t, path.Join(localDest, "refs"))
+					ensureFileExists(t, path.Join(localDest, "config"))
+					ensureFileExists(t, path.Join(localDest, "description"))
+					ensureFileExists(t, path.Join(localDest, "HEAD"))
+					ensureFileExists(t, path.Join(localDest, "packed-refs"))
+					f.assertSameRefs(upstream, localDest)
+				}
+			})
+		}
 	}
+}
 
-	// Remove any temp files
-	os.RemoveAll(baseTempDir)
+// backendNames returns the names of all git backends so that each test
+// can be run against every implementation.
+func backendNames() []string {
+	names := []string{}
+	for name := range gitBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func ensureDirExists(t *testing.T, name string) {
@@ -102,3 +120,45 @@ func ensureFileExists(t *testing.T, name string) {
 		t.Errorf("Expected file, but was not: %v", name)
 	}
 }
+
+func TestExecBackend_gitError(t *testing.T) {
+	f := newFixture(t)
+	missing := f.path("upstream", "missing")
+	err := ExecBackend{}.CloneMirror(context.Background(), "file://"+missing, f.path("mirrors", "missing.git"), MirrorOptions{}, ioutil.Discard)
+
+	gitErr, ok := errors.Cause(err).(*GitError)
+	if !ok {
+		t.Fatalf("CloneMirror() error = %#v, want a *GitError", err)
+	}
+	if gitErr.Args[0] != "git" || gitErr.Args[1] != "clone" {
+		t.Errorf("Args = %v, want the git clone command line", gitErr.Args)
+	}
+	if !strings.Contains(gitErr.Stderr, "does not appear to be a git repository") {
+		t.Errorf("Stderr = %#v, want git's error message", gitErr.Stderr)
+	}
+	if !strings.Contains(err.Error(), gitErr.Stderr) {
+		t.Errorf("Error() = %#v, want it to include stderr", err.Error())
+	}
+}
+
+func Test_tailLines(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{"Empty", "", 3, ""},
+		{"Short", "one\ntwo\n", 3, "one\ntwo"},
+		{"Long", "one\ntwo\nthree\nfour\n", 2, "three\nfour"},
+		{"BlankLines", "one\n\n  \ntwo\n", 3, "one\ntwo"},
+		{"Progress", "Counting: 10%\rCounting: 100%\ndone\n", 3, "Counting: 100%\ndone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tailLines(tt.s, tt.n); got != tt.want {
+				t.Errorf("tailLines() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,606 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	gogitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	// go-git's default file transport runs git-upload-pack and
+	// git-receive-pack. Serve file:// remotes in-process instead so that
+	// this backend works on machines without git installed.
+	loader := fileLoader{osfs.New("")}
+	client.InstallProtocol("file", fileTransport{server.NewClient(loader), loader})
+}
+
+// fileTransport serves file:// remotes in-process. Unlike git, go-git's
+// server fails when the client has commits it doesn't know, as when
+// fetching a second source into a mirror, so they are left out of the
+// requests.
+type fileTransport struct {
+	transport.Transport
+	loader fileLoader
+}
+
+func (t fileTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := t.Transport.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	sto, err := t.loader.Load(ep)
+	if err != nil {
+		return nil, err
+	}
+	return knownHavesSession{session, sto}, nil
+}
+
+// knownHavesSession is an upload-pack session that ignores the haves of
+// requests that the repository doesn't have.
+type knownHavesSession struct {
+	transport.UploadPackSession
+	storer storer.EncodedObjectStorer
+}
+
+func (s knownHavesSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	haves := []plumbing.Hash{}
+	for _, hash := range req.Haves {
+		if s.storer.HasEncodedObject(hash) == nil {
+			haves = append(haves, hash)
+		}
+	}
+	req.Haves = haves
+	return s.UploadPackSession.UploadPack(ctx, req)
+}
+
+// fileLoader loads the repository at a file:// endpoint. Unlike go-git's
+// DefaultLoader, it opens the .git directory of non-bare repositories.
+type fileLoader struct {
+	base billy.Filesystem
+}
+
+func (l fileLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	fs, err := l.base.Chroot(ep.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fs.Stat("config"); err != nil {
+		if _, err := fs.Stat(".git"); err != nil {
+			return nil, transport.ErrRepositoryNotFound
+		}
+		if fs, err = fs.Chroot(".git"); err != nil {
+			return nil, err
+		}
+	}
+
+	return filesystem.NewStorage(fs, cache.NewObjectLRUDefault()), nil
+}
+
+// GoGitBackend implements GitBackend in-process using go-git, for
+// machines where git is not installed.
+type GoGitBackend struct{}
+
+func (GoGitBackend) CloneMirror(ctx context.Context, fetchURL, localDest string, opts MirrorOptions, logFile io.Writer) error {
+	if fetchURL == "" {
+		return errors.New("fetchURL is empty")
+	}
+	if localDest == "" {
+		return errors.New("localDest is empty")
+	}
+	if err := checkGoGitOptions(opts); err != nil {
+		return errors.Wrap(err, "Error cloning repository")
+	}
+
+	conn, err := newGoGitConnection(fetchURL, opts.FetchCredentials, opts.FetchNetwork)
+	if err != nil {
+		return errors.Wrap(err, "Error cloning repository")
+	}
+	defer conn.close()
+
+	repo, err := gogit.PlainCloneContext(ctx, localDest, true, &gogit.CloneOptions{
+		URL:          fetchURL,
+		Mirror:       true,
+		Auth:         conn.auth,
+		ClientCert:   conn.clientCert,
+		ClientKey:    conn.clientKey,
+		CABundle:     conn.caBundle,
+		ProxyOptions: conn.proxy,
+		Progress:     logFile,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error cloning repository")
+	}
+
+	// Match the layout produced by `git clone --mirror`
+	if err := packRefs(repo); err != nil {
+		return errors.Wrap(err, "Error cloning repository")
+	}
+	return errors.Wrap(writeRepoTemplate(localDest), "Error cloning repository")
+}
+
+func (GoGitBackend) SetOriginPushURL(gitDir, pushURL string) error {
+	err := editRawConfig(gitDir, func(cfg *formatconfig.Config) {
+		cfg.Section("remote").Subsection("origin").SetOption("pushurl", pushURL)
+	})
+	return errors.Wrap(err, "Error setting push URL")
+}
+
+func (GoGitBackend) PushMirror(ctx context.Context, gitDir string, dest Destination, opts MirrorOptions, logFile io.Writer) error {
+	if err := checkGoGitOptions(opts); err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+
+	conn, err := newGoGitConnection(dest.URL, dest.Credentials, dest.Network)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	defer conn.close()
+
+	remote := gogit.NewRemote(repo.Storer, &gogitconfig.RemoteConfig{
+		Name: dest.Name,
+		URLs: []string{dest.URL},
+	})
+
+	// go-git's Prune option mishandles forced refspecs and would delete
+	// every ref on the destination, so work out the deletions ourselves.
+	remoteRefs, err := listGoGitRemoteRefs(ctx, remote, &gogit.ListOptions{
+		Auth:         conn.auth,
+		ClientCert:   conn.clientCert,
+		ClientKey:    conn.clientKey,
+		CABundle:     conn.caBundle,
+		ProxyOptions: conn.proxy,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	localRefs, err := listGoGitRefs(repo)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	specs, err := dest.refSpecs(localRefs, remoteRefs)
+	if err != nil {
+		return errors.Wrap(err, "Error pushing mirrored git repo")
+	}
+	if dest.pushesAll() {
+		specs = append(specs, "+refs/*:refs/*")
+	}
+	if len(specs) == 0 {
+		fmt.Fprintln(logFile, "No refs to push")
+		return nil
+	}
+	refSpecs := []gogitconfig.RefSpec{}
+	for _, spec := range specs {
+		refSpecs = append(refSpecs, gogitconfig.RefSpec(spec))
+	}
+
+	err = remote.PushContext(ctx, &gogit.PushOptions{
+		RemoteName:   dest.Name,
+		RefSpecs:     refSpecs,
+		Auth:         conn.auth,
+		ClientCert:   conn.clientCert,
+		ClientKey:    conn.clientKey,
+		CABundle:     conn.caBundle,
+		ProxyOptions: conn.proxy,
+		Progress:     logFile,
+	})
+	if err == gogit.NoErrAlreadyUpToDate {
+		fmt.Fprintln(logFile, "Everything up-to-date")
+		err = nil
+	}
+	return errors.Wrap(err, "Error pushing mirrored git repo")
+}
+
+// listGoGitRemoteRefs returns the names of the refs on remote.
+func listGoGitRemoteRefs(ctx context.Context, remote *gogit.Remote, listOpts *gogit.ListOptions) ([]string, error) {
+	refs, err := remote.ListContext(ctx, listOpts)
+	if err == transport.ErrEmptyRemoteRepository {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.HashReference {
+			names = append(names, ref.Name().String())
+		}
+	}
+	return names, nil
+}
+
+// listGoGitRefs returns the names of the refs in repo.
+func listGoGitRefs(repo *gogit.Repository) ([]string, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			names = append(names, ref.Name().String())
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (GoGitBackend) GetOriginPushURL(gitDir string) (*url.URL, error) {
+	pushURL, err := rawOriginURL(gitDir, "pushurl")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading push URL for %#v", gitDir)
+	}
+
+	urlOutput, err := url.Parse(pushURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing push URL")
+	}
+
+	return urlOutput, err
+}
+
+func (GoGitBackend) InitBareRepo(gitDir string, logFile io.Writer) error {
+	if _, err := gogit.PlainInit(gitDir, true); err != nil {
+		return errors.Wrapf(err, "Error initializing bare git repo at %v", gitDir)
+	}
+	fmt.Fprintf(logFile, "Initialized empty Git repository in %v\n", gitDir)
+	return errors.Wrapf(writeRepoTemplate(gitDir), "Error initializing bare git repo at %v", gitDir)
+}
+
+func (GoGitBackend) UpdateServerInfo(gitDir string, logFile io.Writer) error {
+	return errors.Wrap(writeServerInfo(gitDir), "Error updating server info")
+}
+
+func (GoGitBackend) FetchPrune(ctx context.Context, gitDir string, opts MirrorOptions, logFile io.Writer) error {
+	if err := checkGoGitOptions(opts); err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+
+	fetchURL, err := rawOriginURL(gitDir, "url")
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+
+	conn, err := newGoGitConnection(fetchURL, opts.FetchCredentials, opts.FetchNetwork)
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+	defer conn.close()
+
+	// The refspec is not forced since Prune mishandles forced refspecs,
+	// see PushMirror. Force allows the non-fast-forward updates instead.
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{
+		RemoteName:   "origin",
+		RemoteURL:    fetchURL,
+		RefSpecs:     []gogitconfig.RefSpec{"refs/*:refs/*"},
+		Prune:        true,
+		Force:        true,
+		Auth:         conn.auth,
+		ClientCert:   conn.clientCert,
+		ClientKey:    conn.clientKey,
+		CABundle:     conn.caBundle,
+		ProxyOptions: conn.proxy,
+		Progress:     logFile,
+	})
+	if err == gogit.NoErrAlreadyUpToDate {
+		err = nil
+	}
+	return errors.Wrap(err, "Error fetching")
+}
+
+func (GoGitBackend) FetchSources(ctx context.Context, gitDir string, sources []Source, opts MirrorOptions, logFile io.Writer) error {
+	if err := checkGoGitOptions(opts); err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		return errors.Wrap(err, "Error fetching")
+	}
+
+	conns := make([]goGitConnection, len(sources))
+	remotes := make([]*gogit.Remote, len(sources))
+	listed := make([][]string, len(sources))
+	for i, s := range sources {
+		if conns[i], err = newGoGitConnection(s.URL, s.Credentials, s.Network); err != nil {
+			return errors.Wrapf(err, "Error fetching %v", s.Name)
+		}
+		defer conns[i].close()
+		remotes[i] = gogit.NewRemote(repo.Storer, &gogitconfig.RemoteConfig{
+			Name: s.Name,
+			URLs: []string{s.URL},
+		})
+
+		listed[i], err = listGoGitRemoteRefs(ctx, remotes[i], &gogit.ListOptions{
+			Auth:         conns[i].auth,
+			ClientCert:   conns[i].clientCert,
+			ClientKey:    conns[i].clientKey,
+			CABundle:     conns[i].caBundle,
+			ProxyOptions: conns[i].proxy,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Error listing refs of %v", s.Name)
+		}
+	}
+
+	want, err := mapSourceRefs(sources, listed)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range sources {
+		refSpecs := []gogitconfig.RefSpec{}
+		for _, spec := range s.refSpecs() {
+			refSpecs = append(refSpecs, gogitconfig.RefSpec(spec))
+		}
+		err := remotes[i].FetchContext(ctx, &gogit.FetchOptions{
+			RemoteName:   s.Name,
+			RefSpecs:     refSpecs,
+			Tags:         gogit.NoTags,
+			Force:        true,
+			Auth:         conns[i].auth,
+			ClientCert:   conns[i].clientCert,
+			ClientKey:    conns[i].clientKey,
+			CABundle:     conns[i].caBundle,
+			ProxyOptions: conns[i].proxy,
+			Progress:     logFile,
+		})
+		if err != nil && err != gogit.NoErrAlreadyUpToDate && err != transport.ErrEmptyRemoteRepository {
+			return errors.Wrapf(err, "Error fetching %v", s.Name)
+		}
+	}
+
+	localRefs, err := listGoGitRefs(repo)
+	if err != nil {
+		return errors.Wrap(err, "Error pruning")
+	}
+	for _, ref := range staleRefs(localRefs, want) {
+		fmt.Fprintf(logFile, " - [deleted] %v\n", ref)
+		if err := repo.Storer.RemoveReference(plumbing.ReferenceName(ref)); err != nil {
+			return errors.Wrap(err, "Error pruning")
+		}
+	}
+	return nil
+}
+
+// checkGoGitOptions returns an error for mirror options go-git can't
+// apply. go-git can fetch with a depth, but neither its file transport
+// nor its push support shallow repositories, so none of the history
+// options are supported.
+func checkGoGitOptions(opts MirrorOptions) error {
+	if opts.IsShallow() || opts.Filter != "" {
+		return errors.New("The go-git backend does not support depth, shallowSince or filter; use the exec backend")
+	}
+	return nil
+}
+
+// goGitConnection holds the go-git options for connecting to a remote.
+type goGitConnection struct {
+	auth                  transport.AuthMethod
+	clientCert, clientKey []byte
+	caBundle              []byte
+	proxy                 transport.ProxyOptions
+
+	// throttle is the SOCKS proxy limiting the bandwidth, if any
+	throttle *localProxy
+}
+
+// close stops the proxy limiting the bandwidth of the connection.
+func (conn goGitConnection) close() {
+	if conn.throttle != nil {
+		conn.throttle.close()
+	}
+}
+
+// newGoGitConnection applies creds and network to the connection to the
+// remote at rawURL. go-git can't jump through ssh hosts, and its
+// transports don't support the timeouts, so remotes they apply to are
+// refused rather than connected to without them.
+func newGoGitConnection(rawURL string, creds Credentials, network Network) (goGitConnection, error) {
+	var conn goGitConnection
+	var err error
+	if conn.auth, err = goGitAuth(rawURL, creds); err != nil {
+		return conn, err
+	}
+	if conn.clientCert, conn.clientKey, err = goGitClientCert(creds); err != nil {
+		return conn, err
+	}
+
+	if network.SSHProxyJump != "" && isSSHURL(rawURL) {
+		return conn, errors.New("The go-git backend does not support sshProxyJump; use the exec backend")
+	}
+	if network.ConnectTimeout > 0 && isSSHURL(rawURL) {
+		return conn, errors.New("The go-git backend does not support connectTimeout; use the exec backend")
+	}
+	if (network.LowSpeedLimit > 0 || network.LowSpeedTime > 0) && isHTTPURL(rawURL) {
+		return conn, errors.New("The go-git backend does not support lowSpeedLimit or lowSpeedTime; use the exec backend")
+	}
+	if network.CABundle != "" {
+		if conn.caBundle, err = ioutil.ReadFile(network.CABundle); err != nil {
+			return conn, errors.Wrap(err, "Error reading CA bundle")
+		}
+	}
+	conn.proxy.URL = network.proxyFor(repoURLHost(rawURL))
+	if t := network.throttle; t != nil {
+		// The SOCKS proxy serves ssh remotes as well
+		if conn.throttle, err = t.mgr.socksProxy(); err != nil {
+			return conn, errors.Wrap(err, "Error limiting bandwidth")
+		}
+		conn.proxy = transport.ProxyOptions{
+			URL:      "socks5://" + conn.throttle.addr(),
+			Username: conn.throttle.user,
+			Password: conn.throttle.password,
+		}
+	}
+	return conn, nil
+}
+
+func isSSHURL(rawURL string) bool {
+	ep, err := transport.NewEndpoint(rawURL)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+func isHTTPURL(rawURL string) bool {
+	ep, err := transport.NewEndpoint(rawURL)
+	return err == nil && (ep.Protocol == "http" || ep.Protocol == "https")
+}
+
+// rawOriginURL reads remote.origin.<key> straight from the config file.
+// go-git folds pushurl into the remote's URL list, so its parsed config
+// can't tell the two apart. A missing pushurl falls back to url, as git
+// does.
+func rawOriginURL(gitDir, key string) (string, error) {
+	cfg, err := readRawConfig(gitDir)
+	if err != nil {
+		return "", err
+	}
+
+	origin := cfg.Section("remote").Subsection("origin")
+	if v := origin.Option(key); v != "" {
+		return v, nil
+	}
+	if v := origin.Option("url"); v != "" {
+		return v, nil
+	}
+	return "", errors.New("Remote origin has no URL")
+}
+
+func packRefs(repo *gogit.Repository) error {
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return nil
+	}
+	return storage.PackRefs()
+}
+
+// writeRepoTemplate creates the files `git init` copies from its default
+// template that go-git leaves out.
+func writeRepoTemplate(gitDir string) error {
+	for _, dir := range []string{"hooks", "info"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	files := map[string]string{
+		"description":  "Unnamed repository; edit this file 'description' to name the repository.\n",
+		"info/exclude": "# git ls-files --others --exclude-from=.git/info/exclude\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(gitDir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeServerInfo writes info/refs and objects/info/packs, the files
+// `git update-server-info` maintains for dumb transports.
+func writeServerInfo(gitDir string) error {
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		return err
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		lines = append(lines, fmt.Sprintf("%v\t%v\n", ref.Hash(), ref.Name()))
+
+		// Peel annotated tags
+		if tag, err := repo.TagObject(ref.Hash()); err == nil {
+			target, err := peelTag(repo, tag)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%v\t%v^{}\n", target, ref.Name()))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(lines)
+
+	if err := os.MkdirAll(filepath.Join(gitDir, "info"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitDir, "info", "refs"), []byte(strings.Join(lines, "")), 0644); err != nil {
+		return err
+	}
+
+	packs, err := ioutil.ReadDir(filepath.Join(gitDir, "objects", "pack"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var packLines []string
+	for _, pack := range packs {
+		if filepath.Ext(pack.Name()) == ".pack" {
+			packLines = append(packLines, fmt.Sprintf("P %v\n", pack.Name()))
+		}
+	}
+	packLines = append(packLines, "\n")
+
+	if err := os.MkdirAll(filepath.Join(gitDir, "objects", "info"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(gitDir, "objects", "info", "packs"), []byte(strings.Join(packLines, "")), 0644)
+}
+
+func peelTag(repo *gogit.Repository, tag *object.Tag) (plumbing.Hash, error) {
+	for tag.TargetType == plumbing.TagObject {
+		next, err := repo.TagObject(tag.Target)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tag = next
+	}
+	return tag.Target, nil
+}
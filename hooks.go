@@ -0,0 +1,214 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// Hooks are shell commands run before and after the operations on each
+// mirror. A failing pre hook aborts the operation; a failing post hook
+// is reported as a warning, since the operation already happened.
+//
+// Hooks receive the operation and mirror in GOMIR_* environment
+// variables, and the same as JSON on stdin, see HookInput. Their output
+// is written to the mirror's log.
+type Hooks struct {
+	PreAdd    string
+	PostAdd   string
+	PreFetch  string
+	PostFetch string
+	PrePush   string
+	PostPush  string
+}
+
+// hookKeys maps the config keys of Hooks to their fields.
+func (h *Hooks) hookKeys() map[string]*string {
+	return map[string]*string{
+		"preAdd":    &h.PreAdd,
+		"postAdd":   &h.PostAdd,
+		"preFetch":  &h.PreFetch,
+		"postFetch": &h.PostFetch,
+		"prePush":   &h.PrePush,
+		"postPush":  &h.PostPush,
+	}
+}
+
+// command returns the hook run before op if pre is set, otherwise the
+// one run after it, and the hook's config key.
+func (h Hooks) command(pre bool, op Operation) (key, command string) {
+	key = "post"
+	if pre {
+		key = "pre"
+	}
+	key += strings.ToUpper(string(op[:1])) + string(op[1:])
+	return key, *h.hookKeys()[key]
+}
+
+// SetHook sets the hook with the config key, such as preFetch.
+func (h *Hooks) SetHook(key, command string) error {
+	field, ok := h.hookKeys()[key]
+	if !ok {
+		return errors.Errorf("Unknown hook %#v", key)
+	}
+	*field = command
+	return nil
+}
+
+func readHooks(options formatconfig.Options) Hooks {
+	var h Hooks
+	for key, field := range h.hookKeys() {
+		*field = options.Get(key)
+	}
+	return h
+}
+
+func writeHooks(sub *formatconfig.Subsection, h Hooks) {
+	for key, field := range h.hookKeys() {
+		if *field != "" {
+			sub.SetOption(key, *field)
+		} else {
+			sub.RemoveOption(key)
+		}
+	}
+}
+
+// HookInput is the JSON written to the stdin of hooks.
+type HookInput struct {
+	// Hook is the hook's config key, such as "preFetch"
+	Hook      string    `json:"hook"`
+	Operation Operation `json:"operation"`
+
+	// Mirror is the path of the mirror relative to the root, GitDir its
+	// absolute path
+	Mirror string `json:"mirror"`
+	GitDir string `json:"gitDir"`
+
+	FetchURL string `json:"fetchURL"`
+	// PushURLs maps the names of the mirror's destinations to their URLs
+	PushURLs map[string]string `json:"pushURLs"`
+
+	// Refs are the refs the operation changed, for post hooks, or is
+	// about to push since the last successful push, for push hooks
+	Refs []RefChange `json:"refs"`
+
+	// Error describes why the operation failed, for post hooks
+	Error string `json:"error,omitempty"`
+}
+
+// env returns the environment variables describing the input.
+func (in HookInput) env() []string {
+	refs := []string{}
+	for _, change := range in.Refs {
+		refs = append(refs, change.Ref)
+	}
+	env := []string{
+		"GOMIR_HOOK=" + in.Hook,
+		"GOMIR_OPERATION=" + string(in.Operation),
+		"GOMIR_MIRROR=" + in.Mirror,
+		"GOMIR_GIT_DIR=" + in.GitDir,
+		"GOMIR_FETCH_URL=" + in.FetchURL,
+		"GOMIR_PUSH_URL=" + in.PushURLs[OriginDestination],
+		"GOMIR_CHANGED_REFS=" + strings.Join(refs, " "),
+		"GOMIR_ERROR=" + in.Error,
+	}
+
+	names := []string{}
+	for name := range in.PushURLs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("GOMIR_PUSH_URL_%v=%v", strings.ToUpper(strings.Replace(name, "-", "_", -1)), in.PushURLs[name]))
+	}
+	return env
+}
+
+// withHooks runs fn, the operation op on m, between the pre and post
+// hooks of the root and of the mirror. in describes the operation to the
+// hooks.
+func (mgr *Manager) withHooks(op Operation, m *Mirror, mirrorHooks Hooks, in HookInput, logFile io.Writer, fn func() error) error {
+	in.Operation = op
+	in.Mirror = m.Path
+	in.GitDir, _ = filepath.Abs(m.GitDir)
+
+	before, err := readRefs(m.GitDir)
+	if err != nil {
+		return err
+	}
+	if op == OpPush {
+		pushed, err := m.PushedRefs()
+		if err != nil {
+			return err
+		}
+		in.Refs = diffRefs(pushed, before)
+	}
+
+	for _, hooks := range []Hooks{mgr.Hooks, mirrorHooks} {
+		if err := mgr.runHook(true, hooks, in, logFile); err != nil {
+			return err
+		}
+	}
+
+	opErr := fn()
+
+	if op != OpPush {
+		after, err := readRefs(m.GitDir)
+		if err != nil {
+			mgr.warn(op, m, logFile, "Error reading refs for post hooks: %v", err)
+		}
+		in.Refs = diffRefs(before, after)
+	}
+	if opErr != nil {
+		in.Error = Redact(opErr.Error())
+	}
+	for _, hooks := range []Hooks{mgr.Hooks, mirrorHooks} {
+		if err := mgr.runHook(false, hooks, in, logFile); err != nil {
+			mgr.warn(op, m, logFile, "%v", err)
+		}
+	}
+	return opErr
+}
+
+// runHook runs the pre or post hook of hooks for the operation in
+// describes, if set.
+func (mgr *Manager) runHook(pre bool, hooks Hooks, in HookInput, logFile io.Writer) error {
+	key, command := hooks.command(pre, in.Operation)
+	if command == "" {
+		return nil
+	}
+	in.Hook = key
+
+	input, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "Error running %v hook", key)
+	}
+	fmt.Fprintf(logFile, "Running %v hook: %v\n", key, command)
+	cmd := shellCommand(mgr.context(), command)
+	cmd.Dir = mgr.Root
+	cmd.Env = append(os.Environ(), in.env()...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = logFile
+	stderr := &tailBuffer{max: stderrTailBytes}
+	cmd.Stderr = io.MultiWriter(logFile, stderr)
+	if err := cmd.Run(); err != nil {
+		msg := tailLines(stderr.String(), stderrTailLines)
+		if msg != "" {
+			return errors.Errorf("%v hook failed: %v\n%v", key, err, msg)
+		}
+		return errors.Errorf("%v hook failed: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// recordHook returns a hook command saving its input to the file name in
+// the root, and the function reading it back.
+func recordHook(t *testing.T, mgr *Manager, name string) (string, func() HookInput) {
+	command := "cat > " + name + " && env | grep ^GOMIR_ > " + name + ".env"
+	return command, func() HookInput {
+		t.Helper()
+		content, err := ioutil.ReadFile(mgr.Root + "/" + name)
+		if err != nil {
+			t.Fatalf("Hook %v didn't run: %v", name, err)
+		}
+		var in HookInput
+		if err := json.Unmarshal(content, &in); err != nil {
+			t.Fatalf("Hook %v input %s: %v", name, content, err)
+		}
+		env, _ := ioutil.ReadFile(mgr.Root + "/" + name + ".env")
+		if !strings.Contains(string(env), "GOMIR_HOOK="+in.Hook+"\n") {
+			t.Errorf("Hook %v environment = %s, want GOMIR_HOOK=%v", name, env, in.Hook)
+		}
+		os.Remove(mgr.Root + "/" + name)
+		return in
+	}
+}
+
+func TestManager_hooks(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	dest := f.path("destination", "project.git")
+
+	postAdd, readPostAdd := recordHook(t, mgr, "post-add")
+	prePush, readPrePush := recordHook(t, mgr, "pre-push")
+	postFetch, readPostFetch := recordHook(t, mgr, "post-fetch")
+	mgr.Hooks = Hooks{PostAdd: postAdd, PrePush: prePush}
+	m, err := mgr.Add("file://"+upstream, "file://"+dest, "project", MirrorOptions{Hooks: Hooks{PostFetch: postFetch}})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+
+	in := readPostAdd()
+	if in.Hook != "postAdd" || in.Operation != OpAdd || in.Mirror != "project.git" ||
+		in.FetchURL != "file://"+upstream || in.PushURLs[OriginDestination] != "file://"+dest {
+		t.Errorf("postAdd input = %+v", in)
+	}
+	if len(in.Refs) != len(f.refs(upstream)) {
+		t.Errorf("postAdd refs = %v, want every cloned ref", in.Refs)
+	}
+
+	// Push hooks see the refs changed since the last push
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	if in := readPrePush(); len(in.Refs) != len(f.refs(upstream)) {
+		t.Errorf("prePush refs = %v, want every ref on the first push", in.Refs)
+	}
+	hash := f.commit(upstream, "second")
+	if !fetch(mgr, m) {
+		t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+	}
+	want := []RefChange{{Ref: "refs/heads/master", Old: f.refs(dest)["refs/heads/master"], New: hash}}
+	if in := readPostFetch(); in.Hook != "postFetch" || !equalChanges(in.Refs, want) {
+		t.Errorf("postFetch input = %+v, want refs %v", in, want)
+	}
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	if in := readPrePush(); !equalChanges(in.Refs, want) {
+		t.Errorf("prePush refs = %v, want %v", in.Refs, want)
+	}
+}
+
+func TestManager_hooks_failures(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	m := f.add(mgr, "file://"+upstream, "file://"+f.path("destination", "project.git"))
+	before := f.refs(m.GitDir)
+	f.commit(upstream, "second")
+
+	// A failing pre hook aborts the operation
+	mgr.Hooks = Hooks{PreFetch: "echo not today >&2; exit 1"}
+	err := mgr.FetchMirror(m)
+	if err == nil || !strings.Contains(err.Error(), "preFetch hook failed") || !strings.Contains(err.Error(), "not today") {
+		t.Errorf("FetchMirror() error = %v, want the hook's failure", err)
+	}
+	if got := f.refs(m.GitDir); got["refs/heads/master"] != before["refs/heads/master"] {
+		t.Errorf("FetchMirror() fetched despite the failing pre hook")
+	}
+
+	// A failing post hook only warns, and is told about failures
+	warnings := []string{}
+	mgr.OnEvent = func(e Event) {
+		if e.Type == EventWarning {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	mgr.Hooks = Hooks{PostFetch: `test -z "$GOMIR_ERROR"`}
+	if !fetch(mgr, m) {
+		t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Warnings = %v, want none", warnings)
+	}
+	if err := m.SetSource(Source{Name: OriginSource, URL: f.unreachableURL()}); err != nil {
+		t.Fatalf("SetSource() error = %+v", err)
+	}
+	if fetch(mgr, m) {
+		t.Fatalf("FetchMirror() succeeded for an unreachable source")
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "postFetch hook failed") {
+		t.Errorf("Warnings = %v, want the failed post hook", warnings)
+	}
+}
+
+func equalChanges(got, want []RefChange) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rootLockName is the name of the lock file held in a Manager's root while
+// it adds, fetches or pushes mirrors.
+const rootLockName = ".gomir.lock"
+
+// DefaultStaleLockAge is how old a lock held from another host must be
+// before it is considered abandoned.
+const DefaultStaleLockAge = 24 * time.Hour
+
+// lockPollInterval is how often a waiting Manager retries a held lock.
+var lockPollInterval = time.Second
+
+// lockTakeoverAge is how old a takeover file must be before it is
+// considered left behind by a process that died while taking over a
+// stale lock.
+const lockTakeoverAge = time.Minute
+
+// LockInfo identifies the gomir process holding a lock. It is stored as
+// JSON in the lock file.
+type LockInfo struct {
+	PID      int       `json:"pid"`
+	Host     string    `json:"host"`
+	Acquired time.Time `json:"acquired"`
+}
+
+func (info LockInfo) String() string {
+	return fmt.Sprintf("gomir (pid %v on %v) since %v", info.PID, info.Host, info.Acquired.Format(time.RFC3339))
+}
+
+// LockError is returned when another gomir process holds a lock.
+type LockError struct {
+	// Path of the lock file
+	Path string
+	// Holder is the process holding the lock, as recorded in the lock
+	// file
+	Holder LockInfo
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("%v is locked by %v; if that process is gone, delete the lock file", e.Path, e.Holder)
+}
+
+// lock is a lock file created by this process.
+type lock struct {
+	path string
+	// content is what this process wrote to the lock file
+	content []byte
+}
+
+// unlock removes the lock file, unless another process took it over after
+// judging it stale.
+func (l *lock) unlock() {
+	if current, err := ioutil.ReadFile(l.path); err == nil && bytes.Equal(current, l.content) {
+		os.Remove(l.path)
+	}
+}
+
+// acquireLock creates the lock file at path. If another live process
+// holds it, acquireLock retries until wait has passed and then returns a
+// *LockError. A lock left behind by a process that is no longer running
+// on this host, or older than staleAge, is replaced; onStale is called
+// with its holder.
+func acquireLock(path string, wait, staleAge time.Duration, onStale func(LockInfo)) (*lock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		l, err := createLock(path)
+		if err == nil {
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.Wrap(err, "Error creating lock file")
+		}
+
+		content, holder, err := readLock(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			// Released while we looked at it
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if holder.isStale(staleAge) {
+			l, err := replaceLock(path, content)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error replacing stale lock file")
+			}
+			if l != nil {
+				if onStale != nil {
+					onStale(holder)
+				}
+				return l, nil
+			}
+			// Another process is taking it over, or replaced or released
+			// it first
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, &LockError{Path: path, Holder: holder}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockContent returns the contents of a lock file held by this process.
+func lockContent() ([]byte, error) {
+	host, _ := os.Hostname()
+	return json.Marshal(LockInfo{
+		PID:      os.Getpid(),
+		Host:     host,
+		Acquired: time.Now().UTC(),
+	})
+}
+
+// createLock creates the lock file at path, failing if it already exists.
+func createLock(path string) (*lock, error) {
+	content, err := lockContent()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &lock{path: path, content: content}, nil
+}
+
+// replaceLock takes over the lock file at path, whose contents were stale,
+// unless another process replaced or released it meanwhile. It returns nil
+// if it didn't take the lock over.
+//
+// Only the process that creates path.takeover may take the lock over, so
+// two processes can't both replace the same stale lock. The new lock is
+// written to a temporary file first and renamed over the stale one, so the
+// lock file is never missing or partly written.
+func replaceLock(path string, stale []byte) (*lock, error) {
+	takeover := path + ".takeover"
+	f, err := os.OpenFile(takeover, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		// Another process is taking the lock over, unless it died doing so
+		if fi, err := os.Stat(takeover); err == nil && time.Since(fi.ModTime()) > lockTakeoverAge {
+			os.Remove(takeover)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(takeover)
+
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && !bytes.Equal(current, stale)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := lockContent()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return &lock{path: path, content: content}, nil
+}
+
+// readLock returns the contents of the lock file at path and its holder.
+func readLock(path string) ([]byte, LockInfo, error) {
+	var info LockInfo
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, info, errors.Wrap(err, "Error reading lock file")
+	}
+	if len(content) == 0 {
+		// Still being written by its creator, or left empty by a creator
+		// that died: judge it by when it was created
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, info, errors.Wrap(err, "Error reading lock file")
+		}
+		info.Acquired = fi.ModTime().UTC()
+		return content, info, nil
+	}
+	if err := json.Unmarshal(content, &info); err != nil {
+		return nil, info, errors.Wrapf(err, "Error parsing lock file %v", path)
+	}
+	return content, info, nil
+}
+
+// isStale reports whether the process holding the lock has gone away.
+// The process can only be checked on this host; locks from other hosts
+// go stale after staleAge.
+func (info LockInfo) isStale(staleAge time.Duration) bool {
+	host, _ := os.Hostname()
+	if info.Host == host && info.PID != 0 {
+		return !processExists(info.PID)
+	}
+	return staleAge > 0 && time.Since(info.Acquired) > staleAge
+}
+
+// lockRoot locks the Manager's root directory.
+func (mgr *Manager) lockRoot() (*lock, error) {
+	path := filepath.Join(mgr.Root, rootLockName)
+	return acquireLock(path, mgr.LockWait, mgr.StaleLockAge, func(holder LockInfo) {
+		mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Removed stale lock %v held by %v", path, holder)})
+	})
+}
+
+// lockMirror locks a single mirror.
+func (mgr *Manager) lockMirror(op Operation, m *Mirror) (*lock, error) {
+	return acquireLock(m.lockPath(), mgr.LockWait, mgr.StaleLockAge, func(holder LockInfo) {
+		mgr.emit(Event{Type: EventWarning, Op: op, Mirror: m, Message: fmt.Sprintf("Removed stale lock held by %v", holder)})
+	})
+}
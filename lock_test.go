@@ -0,0 +1,187 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writeLock writes a lock file as if held by holder.
+func writeLock(t *testing.T, path string, holder LockInfo) {
+	t.Helper()
+	content, err := json.Marshal(holder)
+	if err != nil {
+		t.Fatalf("Error encoding lock: %+v", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Error writing lock: %+v", err)
+	}
+}
+
+// exitedPID returns the pid of a process that has exited.
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Error running child process: %+v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func Test_acquireLock(t *testing.T) {
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		holder    *LockInfo
+		wantErr   bool
+		wantStale bool
+	}{
+		{"Free", nil, false, false},
+		{"HeldByLiveProcess", &LockInfo{PID: os.Getpid(), Host: host, Acquired: now}, true, false},
+		{"HeldByExitedProcess", &LockInfo{PID: exitedPID(t), Host: host, Acquired: now}, false, true},
+		{"HeldFromOtherHost", &LockInfo{PID: 1, Host: "elsewhere", Acquired: now.Add(-time.Hour)}, true, false},
+		{"AbandonedOnOtherHost", &LockInfo{PID: 1, Host: "elsewhere", Acquired: now.Add(-48 * time.Hour)}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.lock")
+			if tt.holder != nil {
+				writeLock(t, path, *tt.holder)
+			}
+
+			stale := false
+			l, err := acquireLock(path, 0, DefaultStaleLockAge, func(LockInfo) { stale = true })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquireLock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if stale != tt.wantStale {
+				t.Errorf("Stale lock reported = %v, want %v", stale, tt.wantStale)
+			}
+			if err != nil {
+				lockErr, ok := errors.Cause(err).(*LockError)
+				if !ok || lockErr.Holder != *tt.holder {
+					t.Errorf("acquireLock() error = %#v, want a *LockError naming the holder", err)
+				}
+				if !strings.Contains(err.Error(), tt.holder.Host) {
+					t.Errorf("Error %q doesn't name the holder's host", err)
+				}
+				return
+			}
+
+			_, holder, err := readLock(path)
+			if err != nil || holder.PID != os.Getpid() || holder.Host != host {
+				t.Errorf("Lock file holds %+v, %v, want this process", holder, err)
+			}
+			l.unlock()
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Lock file still exists after unlock")
+			}
+		})
+	}
+}
+
+func Test_replaceLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	writeLock(t, path, LockInfo{PID: 1, Host: "elsewhere"})
+	stale, _, err := readLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process took the stale lock over first
+	writeLock(t, path, LockInfo{PID: 2, Host: "elsewhere"})
+	if l, err := replaceLock(path, stale); l != nil || err != nil {
+		t.Errorf("replaceLock() = %v, %v after the lock changed, want nil", l, err)
+	}
+	os.Remove(path)
+	if l, err := replaceLock(path, stale); l != nil || err != nil {
+		t.Errorf("replaceLock() = %v, %v after the lock was released, want nil", l, err)
+	}
+
+	// Another process is taking the stale lock over
+	writeLock(t, path, LockInfo{PID: 1, Host: "elsewhere"})
+	takeover := path + ".takeover"
+	if err := ioutil.WriteFile(takeover, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := replaceLock(path, stale); l != nil || err != nil {
+		t.Errorf("replaceLock() = %v, %v during another takeover, want nil", l, err)
+	}
+	// ... or died doing so
+	old := time.Now().Add(-2 * lockTakeoverAge)
+	os.Chtimes(takeover, old, old)
+	if l, err := replaceLock(path, stale); l != nil || err != nil {
+		t.Errorf("replaceLock() = %v, %v with a left over takeover file, want nil", l, err)
+	}
+
+	l, err := replaceLock(path, stale)
+	if l == nil || err != nil {
+		t.Fatalf("replaceLock() = %v, %v, want a lock", l, err)
+	}
+	if _, holder, err := readLock(path); err != nil || holder.PID != os.Getpid() {
+		t.Errorf("Lock file holds %+v, %v, want this process", holder, err)
+	}
+	if names, _ := filepath.Glob(path + ".*"); len(names) != 0 {
+		t.Errorf("Temporary files left behind: %v", names)
+	}
+	l.unlock()
+}
+
+func Test_lock_unlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	l, err := acquireLock(path, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %+v", err)
+	}
+
+	// A process that lost its lock to another mustn't release the other's
+	writeLock(t, path, LockInfo{PID: 2, Host: "elsewhere"})
+	l.unlock()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("unlock() removed a lock taken over by another process: %v", err)
+	}
+}
+
+func Test_readLock_empty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(path, created, created)
+
+	_, holder, err := readLock(path)
+	if err != nil || !holder.isStale(DefaultStaleLockAge) {
+		t.Errorf("readLock() = %+v, %v, want a stale lock acquired at %v", holder, err, created)
+	}
+}
+
+func Test_acquireLock_wait(t *testing.T) {
+	defer func(interval time.Duration) { lockPollInterval = interval }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "test.lock")
+	held, err := acquireLock(path, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("acquireLock() error = %+v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, held.unlock)
+
+	l, err := acquireLock(path, 5*time.Second, 0, nil)
+	if err != nil {
+		t.Fatalf("acquireLock() didn't wait for the lock: %+v", err)
+	}
+	l.unlock()
+}
@@ -0,0 +1,777 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+Package gomir mirrors git repositories between two disconnected networks.
+
+A Manager owns a root directory holding the local copies of the mirrored
+repositories. Fetch updates them from the source network and Push sends
+them on to the destination network:
+
+	mgr := gomir.NewManager("/srv/mirrors")
+	if _, err := mgr.Add("https://github.com/pkg/errors.git", "file:///share/errors.git", "", gomir.MirrorOptions{}); err != nil {
+		return err
+	}
+	results, err := mgr.Fetch()
+
+The command line interface lives in cmd/gomir.
+*/
+package gomir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operation identifies what gomir is doing to a mirror.
+type Operation string
+
+// Operations reported in Events and Results
+const (
+	OpAdd   Operation = "add"
+	OpFetch Operation = "fetch"
+	OpPush  Operation = "push"
+)
+
+// EventType distinguishes the Events reported during an operation.
+type EventType int
+
+// Event types
+const (
+	// EventStarted is reported when an operation on a mirror begins
+	EventStarted EventType = iota
+	// EventFinished is reported when an operation on a mirror ends, with
+	// Err set if it failed
+	EventFinished
+	// EventWarning reports something the operator should know about an
+	// operation that still succeeds, described by Message
+	EventWarning
+	// EventDestinationFinished is reported when a push to one of several
+	// destinations of a mirror ends, with Err set if it failed
+	EventDestinationFinished
+	// EventQueued is reported for each mirror of a fetch or push run
+	// before the run starts any of them
+	EventQueued
+	// EventProgress reports the Progress of a transfer as git reports
+	// it
+	EventProgress
+)
+
+// Event reports progress of an operation on a single mirror. Warnings
+// about the root as a whole have no Op or Mirror.
+type Event struct {
+	Type    EventType
+	Op      Operation
+	Mirror  *Mirror
+	Err     error
+	Message string
+
+	// Destination names the destination of EventDestinationFinished
+	Destination string
+
+	// Progress is the state of the transfer of EventProgress
+	Progress Progress
+}
+
+// Result is the outcome of an operation on a single mirror.
+type Result struct {
+	Op       Operation
+	Mirror   *Mirror
+	Err      error
+	Started  time.Time
+	Duration time.Duration
+
+	// Refs are the refs the operation changed: those of the mirror for a
+	// fetch, and those recorded as pushed for a push
+	Refs []RefChange
+}
+
+// Results are the outcomes of an operation across several mirrors.
+type Results []*Result
+
+// Failed returns the results whose operation failed.
+func (rs Results) Failed() Results {
+	failed := Results{}
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Manager adds, fetches and pushes the mirrors under a root directory.
+type Manager struct {
+	// Root is the directory holding the mirrors
+	Root string
+
+	// Backend runs the git operations
+	Backend GitBackend
+
+	// OnEvent, if set, is called as operations progress. It may be called
+	// concurrently from several goroutines.
+	OnEvent func(Event)
+
+	// LockWait is how long to wait for another gomir process to release
+	// the root or a mirror before failing with a *LockError
+	LockWait time.Duration
+
+	// StaleLockAge is how old a lock held from another host must be
+	// before it is replaced. Zero never replaces such locks.
+	StaleLockAge time.Duration
+
+	// Context, if set, cancels the clones, fetches and pushes in progress
+	// when it is done
+	Context context.Context
+
+	// Metrics, if set, collects statistics about the operations
+	Metrics *Metrics
+
+	// Notifications send a summary of each fetch and push run
+	Notifications []Notification
+
+	// Hosts holds the settings for remotes by lower case host name
+	Hosts map[string]HostConfig
+
+	// Hooks run before and after the operations on every mirror, before
+	// the mirror's own hooks
+	Hooks Hooks
+
+	// Policy restricts the files pushed from every mirror, in addition to
+	// the mirror's own policy
+	Policy Policy
+
+	// ChangeReport writes a report of the changes since the last push
+	// after each fetch run
+	ChangeReport ChangeReportConfig
+
+	// RunReportDir, if set, receives an HTML report of each fetch and
+	// push run, relative to the root
+	RunReportDir string
+
+	// BandwidthLimit, if set, limits the traffic with http and ssh
+	// remotes, in bytes per second, across all transfers. Hosts may
+	// set their own limit in addition.
+	BandwidthLimit int64
+
+	// PushDestinations, if set, limits pushes to the destinations with
+	// these names. Mirrors without any of them are skipped with a
+	// warning; PushSelected fails if no mirror has one of them.
+	PushDestinations []string
+
+	bandwidth bandwidth
+}
+
+// NewManager returns a Manager for the mirrors under root that runs the
+// git executable.
+func NewManager(root string) *Manager {
+	return &Manager{
+		Root:         root,
+		Backend:      ExecBackend{},
+		StaleLockAge: DefaultStaleLockAge,
+	}
+}
+
+// Add clones the repository at fetchURL into a new mirror that pushes to
+// pushURL. localDest, relative to the root, defaults to the host and path
+// of fetchURL. The options are saved with the mirror and apply to every
+// later fetch and push.
+//
+// Add, Fetch and Push lock the root, and every operation on a mirror
+// locks the mirror, so that several gomir processes sharing a root don't
+// corrupt it. If another process holds a lock for longer than LockWait,
+// the operation fails with a *LockError.
+func (mgr *Manager) Add(fetchURL, pushURL, localDest string, opts MirrorOptions) (*Mirror, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// Try to generate a localDest
+	if localDest == "" {
+		u, err := url.Parse(fetchURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not generate a localDest")
+		}
+		localDest = fmt.Sprintf("%v%v", u.Host, u.Path)
+	}
+
+	m := mgr.mirror(ensureGitExt(localDest))
+	if err := os.MkdirAll(filepath.Dir(m.GitDir), 0755); err != nil {
+		return nil, errors.Wrap(err, "Error creating parent directory")
+	}
+
+	l, err := mgr.lockRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	err = mgr.run(OpAdd, m, "ADD: ", func(logFile io.Writer, stats *opStats) error {
+		in := HookInput{FetchURL: fetchURL, PushURLs: map[string]string{OriginDestination: pushURL}}
+		return mgr.withHooks(OpAdd, m, opts.Hooks, in, logFile, func() error {
+			// Clone. The host's settings are used but not saved with
+			// the mirror.
+			cloneOpts := mgr.fetchOptions(opts, fetchURL)
+			if err := mgr.Backend.CloneMirror(mgr.context(), fetchURL, m.GitDir, cloneOpts, logFile); err != nil {
+				return err
+			}
+			stats.bytes = objectsSize(m.GitDir)
+
+			// Set Push URL
+			if err := mgr.Backend.SetOriginPushURL(m.GitDir, pushURL); err != nil {
+				return err
+			}
+			return errors.Wrap(m.SetOptions(opts), "Error saving mirror options")
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// List returns the mirrors under the root.
+func (mgr *Manager) List() ([]*Mirror, error) {
+	if _, err := os.Stat(mgr.Root); err != nil {
+		return nil, errors.Wrap(err, "Error reading mirror root")
+	}
+
+	mirrors := []*Mirror{}
+	for _, gitDir := range findGitDirs(mgr.Root) {
+		path, err := filepath.Rel(mgr.Root, gitDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error finding mirrors")
+		}
+		mirrors = append(mirrors, mgr.mirror(path))
+	}
+	mgr.Metrics.setMirrors(len(mirrors))
+	return mirrors, nil
+}
+
+// Mirror returns the existing mirror at path, relative to the root.
+func (mgr *Manager) Mirror(path string) (*Mirror, error) {
+	m := mgr.mirror(ensureGitExt(path))
+	if _, err := os.Stat(filepath.Join(m.GitDir, "config")); err != nil {
+		return nil, errors.Wrapf(err, "Error finding mirror %v", path)
+	}
+	return m, nil
+}
+
+// Fetch fetches changes for all mirrors. The returned error is only set
+// if the mirrors could not be listed; failures of individual mirrors are
+// reported in the Results.
+func (mgr *Manager) Fetch() (Results, error) {
+	return mgr.FetchSelected(SelectAll)
+}
+
+// FetchSelected fetches changes for the mirrors chosen by sel from the
+// checkpoint of the last fetch.
+func (mgr *Manager) FetchSelected(sel Selection) (Results, error) {
+	return mgr.forEach(OpFetch, sel, mgr.FetchMirror)
+}
+
+// FetchMirror fetches changes for a single mirror from each of its
+// sources.
+func (mgr *Manager) FetchMirror(m *Mirror) error {
+	return mgr.run(OpFetch, m, "FETCH: ", func(logFile io.Writer, stats *opStats) error {
+		opts, err := m.Options()
+		if err != nil {
+			return err
+		}
+		sources, err := m.Sources()
+		if err != nil {
+			return err
+		}
+
+		in := HookInput{FetchURL: sources[0].URL, PushURLs: pushURLs(m)}
+		return mgr.withHooks(OpFetch, m, opts.Hooks, in, logFile, func() error {
+			before := objectsSize(m.GitDir)
+			var err error
+			if isMirrorSources(sources) {
+				opts = mgr.fetchOptions(opts, sources[0].URL)
+				err = mgr.Backend.FetchPrune(mgr.context(), m.GitDir, opts, logFile)
+			} else {
+				for i := range sources {
+					sources[i] = mgr.source(sources[i])
+				}
+				err = mgr.Backend.FetchSources(mgr.context(), m.GitDir, sources, opts, logFile)
+			}
+			stats.bytes = growth(m.GitDir, before)
+			return err
+		})
+	})
+}
+
+// Push pushes changes for all mirrors. The returned error is only set if
+// the mirrors could not be listed; failures of individual mirrors are
+// reported in the Results.
+func (mgr *Manager) Push() (Results, error) {
+	return mgr.PushSelected(SelectAll)
+}
+
+// PushSelected pushes changes for the mirrors chosen by sel from the
+// checkpoint of the last push. It fails if no mirror has one of the
+// PushDestinations.
+func (mgr *Manager) PushSelected(sel Selection) (Results, error) {
+	if err := mgr.checkPushDestinations(); err != nil {
+		return nil, err
+	}
+	return mgr.forEach(OpPush, sel, mgr.PushMirror)
+}
+
+// checkPushDestinations returns an error naming the PushDestinations that
+// none of the mirrors have, such as misspelled ones.
+func (mgr *Manager) checkPushDestinations() error {
+	if len(mgr.PushDestinations) == 0 {
+		return nil
+	}
+	mirrors, err := mgr.List()
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, m := range mirrors {
+		dests, err := m.Destinations()
+		if err != nil {
+			continue
+		}
+		for _, d := range dests {
+			found[d.Name] = true
+		}
+	}
+	missing := []string{}
+	for _, name := range mgr.PushDestinations {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("No repository has a destination named %v", strings.Join(missing, " or "))
+	}
+	return nil
+}
+
+// PushMirror pushes changes for a single mirror to each of its
+// destinations. If it pushes to a local path that does not exist yet, a
+// bare repository is initialized there first.
+//
+// A mirror with truncated history pushes it as-is, so the destination
+// only receives the history the mirror has. Local destinations are
+// configured to accept this; other servers must allow shallow updates
+// themselves.
+//
+// A failed destination doesn't stop the push to the others. If several
+// destinations were pushed and some failed, the error is a
+// *DestinationError.
+func (mgr *Manager) PushMirror(m *Mirror) error {
+	return mgr.run(OpPush, m, "PUSH: ", func(logFile io.Writer, stats *opStats) error {
+		opts, err := m.Options()
+		if err != nil {
+			return err
+		}
+
+		// Where are we pushing to?
+		all, err := m.Destinations()
+		if err != nil {
+			return errors.Wrap(err, "Error retrieving push URL")
+		}
+		dests := selectDestinations(all, mgr.PushDestinations)
+		if len(dests) == 0 {
+			mgr.warn(OpPush, m, logFile, "No destination named %v", strings.Join(mgr.PushDestinations, " or "))
+			return nil
+		}
+
+		if isShallowRepo(m.GitDir) {
+			mgr.warn(OpPush, m, logFile, "The destination will receive incomplete history, truncated by %v", describeHistory(opts))
+		}
+
+		fetchURL, err := m.FetchURL()
+		if err != nil {
+			return err
+		}
+		in := HookInput{FetchURL: fetchURL, PushURLs: pushURLs(m)}
+		return mgr.withHooks(OpPush, m, opts.Hooks, in, logFile, func() error {
+			refs, err := readRefs(m.GitDir)
+			if err != nil {
+				return err
+			}
+			pushed, err := m.PushedRefs()
+			if err != nil {
+				return err
+			}
+			violations, err := mgr.checkPushPolicy(m, pushed, refs, logFile)
+			if err != nil {
+				return err
+			}
+			blocked, sent := blockedRefs(violations, refs, pushed)
+			for i := range dests {
+				dests[i].Blocked = blocked
+			}
+
+			// Later pushes and their checks start from what every
+			// destination received
+			pushErr := mgr.pushDestinations(m, dests, opts, logFile, stats)
+			if err := m.setPushedRefs(sent, pushedDestinations(dests, pushErr), all); err != nil {
+				return err
+			}
+			if pushErr != nil {
+				return pushErr
+			}
+			if len(violations) > 0 {
+				return &PolicyError{Refs: violations}
+			}
+			return nil
+		})
+	})
+}
+
+// pushedDestinations returns the destinations of dests that
+// pushDestinations pushed to, given the error it returned.
+func pushedDestinations(dests []Destination, err error) []Destination {
+	if err == nil {
+		return dests
+	}
+	destErr, ok := err.(*DestinationError)
+	if !ok {
+		return nil
+	}
+	pushed := []Destination{}
+	for i, r := range destErr.Results {
+		if r.Err == nil {
+			pushed = append(pushed, dests[i])
+		}
+	}
+	return pushed
+}
+
+// pushDestinations pushes m to each of dests.
+func (mgr *Manager) pushDestinations(m *Mirror, dests []Destination, opts MirrorOptions, logFile io.Writer, stats *opStats) error {
+	if len(dests) == 1 {
+		return mgr.pushDestination(m, dests[0], opts, logFile, stats)
+	}
+
+	failed := false
+	results := []DestinationResult{}
+	for _, dest := range dests {
+		fmt.Fprintf(logFile, "Pushing to %v\n", dest.Name)
+		err := redactError(mgr.pushDestination(m, dest, opts, logFile, stats))
+		if err != nil {
+			fmt.Fprintf(logFile, "%+v\n", err)
+			failed = true
+		}
+		results = append(results, DestinationResult{Destination: dest.Name, Err: err})
+		mgr.emit(Event{Type: EventDestinationFinished, Op: OpPush, Mirror: m, Destination: dest.Name, Err: err})
+	}
+	if failed {
+		return &DestinationError{Results: results}
+	}
+	return nil
+}
+
+// pushURLs maps the names of the destinations of m to their URLs, for
+// hooks.
+func pushURLs(m *Mirror) map[string]string {
+	urls := map[string]string{}
+	dests, _ := m.Destinations()
+	for _, d := range dests {
+		urls[d.Name] = d.URL
+	}
+	return urls
+}
+
+// pushDestination pushes m to dest, adding the bytes sent to stats: the
+// growth of a local destination, or the bytes git reports writing to a
+// remote one.
+func (mgr *Manager) pushDestination(m *Mirror, dest Destination, opts MirrorOptions, logFile io.Writer, stats *opStats) error {
+	pushURL, err := url.Parse(dest.URL)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing push URL")
+	}
+
+	// If pushing using file protocol and destination repository does
+	// not alread exist, initialize it
+	isFileProtocol := pushURL.Scheme == "" || strings.ToLower(pushURL.Scheme) == "file"
+	if isFileProtocol {
+		_, err := os.Stat(pushURL.Path)
+		if err != nil && os.IsNotExist(err) {
+			if err := mgr.Backend.InitBareRepo(pushURL.Path, logFile); err != nil {
+				return errors.Wrap(err, "Error initializing bare git repository")
+			}
+		}
+
+		if isShallowRepo(m.GitDir) {
+			if err := allowShallowUpdates(pushURL.Path); err != nil {
+				return errors.Wrap(err, "Error allowing shallow updates on destination")
+			}
+		}
+	}
+
+	// Push
+	dest = mgr.destination(dest)
+	var before, written int64
+	if isFileProtocol {
+		before = objectsSize(pushURL.Path)
+	} else {
+		logFile = &progressWriter{w: logFile, report: func(p Progress) {
+			if p.Phase == "Writing objects" && p.Done {
+				written += p.Bytes
+			}
+		}}
+	}
+	err = mgr.Backend.PushMirror(mgr.context(), m.GitDir, dest, opts, logFile)
+	if isFileProtocol {
+		stats.bytes += growth(pushURL.Path, before)
+	} else {
+		stats.bytes += written
+	}
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "shallow update not allowed"):
+			return errors.Wrap(err, "Error pushing: the destination must set receive.shallowUpdate to accept truncated history")
+		case opts.Filter != "":
+			return errors.Wrapf(err, "Error pushing: objects left out by the %#v filter can't be pushed", opts.Filter)
+		}
+		return errors.Wrap(err, "Error pushing")
+	}
+
+	// Update server info
+	if isFileProtocol {
+		if err := mgr.Backend.UpdateServerInfo(pushURL.Path, logFile); err != nil {
+			return errors.Wrap(err, "Error updating server info")
+		}
+	}
+	return nil
+}
+
+// fetchOptions completes the fetch credentials of opts with the settings
+// of the host of fetchURL, and sets its fetch network settings, limiting
+// its bandwidth if needed.
+func (mgr *Manager) fetchOptions(opts MirrorOptions, fetchURL string) MirrorOptions {
+	host := mgr.hostConfig(fetchURL)
+	opts.FetchCredentials = opts.FetchCredentials.or(host.Credentials)
+	opts.FetchNetwork = mgr.limitBandwidth(fetchURL, host.Network)
+	return opts
+}
+
+// source completes the credentials of s with the settings of its host,
+// and sets its network settings, limiting its bandwidth if needed.
+func (mgr *Manager) source(s Source) Source {
+	host := mgr.hostConfig(s.URL)
+	s.Credentials = s.Credentials.or(host.Credentials)
+	s.Network = mgr.limitBandwidth(s.URL, host.Network)
+	return s
+}
+
+// destination completes the credentials of dest with the settings of
+// its host, and sets its network settings, limiting its bandwidth if
+// needed.
+func (mgr *Manager) destination(dest Destination) Destination {
+	host := mgr.hostConfig(dest.URL)
+	dest.Credentials = dest.Credentials.or(host.Credentials)
+	dest.Network = mgr.limitBandwidth(dest.URL, host.Network)
+	return dest
+}
+
+func (mgr *Manager) mirror(path string) *Mirror {
+	return &Mirror{
+		Path:   path,
+		GitDir: filepath.Join(mgr.Root, path),
+	}
+}
+
+func (mgr *Manager) context() context.Context {
+	if mgr.Context == nil {
+		return context.Background()
+	}
+	return mgr.Context
+}
+
+func (mgr *Manager) emit(e Event) {
+	e.Message = Redact(e.Message)
+	e.Err = redactError(e.Err)
+	if mgr.OnEvent != nil {
+		mgr.OnEvent(e)
+	}
+}
+
+// warn records a warning in the mirror's log and reports it through
+// OnEvent.
+func (mgr *Manager) warn(op Operation, m *Mirror, logFile io.Writer, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(logFile, "WARNING: %v\n", msg)
+	mgr.emit(Event{Type: EventWarning, Op: op, Mirror: m, Message: msg})
+}
+
+// run performs op on m, recording its progress in the mirror's log file
+// and reporting it through OnEvent.
+func (mgr *Manager) run(op Operation, m *Mirror, prefix string, fn func(logFile io.Writer, stats *opStats) error) error {
+	mgr.emit(Event{Type: EventStarted, Op: op, Mirror: m})
+	started := time.Now()
+	var stats opStats
+	err := mgr.runLocked(op, m, prefix, func(logFile io.Writer) error {
+		return fn(mgr.progressWriter(op, m, logFile), &stats)
+	})
+	// Errors end up in the output, reports and notifications
+	err = redactError(err)
+	mgr.Metrics.observe(op, m, time.Now(), time.Since(started), stats, err)
+	mgr.emit(Event{Type: EventFinished, Op: op, Mirror: m, Err: err})
+	return err
+}
+
+func (mgr *Manager) runLocked(op Operation, m *Mirror, prefix string, fn func(logFile io.Writer) error) error {
+	l, err := mgr.lockMirror(op, m)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	return mgr.runLogged(m, prefix, fn)
+}
+
+func (mgr *Manager) runLogged(m *Mirror, prefix string, fn func(logFile io.Writer) error) error {
+	logFile, logger, err := m.openLog(prefix)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	logger.Println("Start")
+	err = fn(logFile)
+	if err != nil {
+		logger.Printf("%+v", err)
+	}
+	logger.Printf("Done, success:%v", err == nil)
+	return err
+}
+
+// forEach performs op concurrently on the mirrors chosen by sel while
+// holding the root lock, recording progress in the op's checkpoint.
+func (mgr *Manager) forEach(op Operation, sel Selection, fn func(m *Mirror) error) (Results, error) {
+	mirrors, err := mgr.List()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := mgr.lockRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	last, err := mgr.Checkpoint(op)
+	if err != nil {
+		return nil, err
+	}
+	prev := last.states()
+
+	started := time.Now()
+	mirrors, cp, err := mgr.selectMirrors(op, sel, mirrors)
+	if err != nil {
+		return nil, err
+	}
+
+	results := mgr.runAll(op, mirrors, fn, cp)
+	if err := cp.finish(); err != nil {
+		mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Error saving checkpoint: %v", err)})
+	}
+	mgr.finishRun(op, started, results, prev)
+	return results, nil
+}
+
+// runBatch performs op on mirrors, run by the daemon or a webhook, while
+// holding the root lock. It records the outcomes in the op's checkpoint,
+// so that --failed and notifications of later runs know about them, and
+// reports on them as Fetch and Push do. It fails if the root is locked.
+func (mgr *Manager) runBatch(op Operation, mirrors []*Mirror) (Results, error) {
+	l, err := mgr.lockRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer l.unlock()
+
+	cp, err := mgr.openCheckpoint(op)
+	if err != nil {
+		mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Not recording %v: %v", op, err)})
+	}
+	prev := cp.states()
+
+	fn := mgr.FetchMirror
+	if op == OpPush {
+		fn = mgr.PushMirror
+	}
+	started := time.Now()
+	results := mgr.runAll(op, mirrors, fn, cp)
+	mgr.finishRun(op, started, results, prev)
+	return results, nil
+}
+
+// finishRun reports on a run that started at started: it sends the
+// notifications, given the outcomes of the op's previous runs in prev,
+// and writes the change report of a fetch and the run report.
+func (mgr *Manager) finishRun(op Operation, started time.Time, results Results, prev map[string]MirrorState) {
+	if len(results) == 0 {
+		return
+	}
+	mgr.notify(summarize(op, started, results, prev))
+	if op == OpFetch {
+		mgr.reportChanges(results)
+	}
+	mgr.reportRun(op, started, results)
+}
+
+// runAll performs op on mirrors concurrently, recording each outcome in
+// cp if set.
+func (mgr *Manager) runAll(op Operation, mirrors []*Mirror, fn func(m *Mirror) error, cp *Checkpoint) Results {
+	results := make(Results, len(mirrors))
+	for _, m := range mirrors {
+		mgr.emit(Event{Type: EventQueued, Op: op, Mirror: m})
+	}
+	var wg sync.WaitGroup
+	for i, m := range mirrors {
+		wg.Add(1)
+		go func(i int, m *Mirror) {
+			defer wg.Done()
+
+			started := time.Now()
+			before := refsOf(op, m)
+			err := fn(m)
+			results[i] = &Result{
+				Op:       op,
+				Mirror:   m,
+				Err:      err,
+				Started:  started,
+				Duration: time.Since(started),
+				Refs:     diffRefs(before, refsOf(op, m)),
+			}
+			if err := cp.record(m, err); err != nil {
+				mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Error saving checkpoint: %v", err)})
+			}
+		}(i, m)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// refsOf returns the refs that op changes on m: the mirror's refs for a
+// fetch, and the refs recorded as pushed for a push. Refs that can't be
+// read are left out.
+func refsOf(op Operation, m *Mirror) map[string]string {
+	var refs map[string]string
+	if op == OpPush {
+		refs, _ = m.PushedRefs()
+	} else {
+		refs, _ = readRefs(m.GitDir)
+	}
+	return refs
+}
@@ -0,0 +1,515 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the operator's git configuration and credentials out of the
+	// tests
+	home, err := ioutil.TempDir("", "gomir-home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("XDG_CONFIG_HOME", home)
+	os.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	os.Setenv("GIT_TERMINAL_PROMPT", "0")
+	os.Setenv("GIT_AUTHOR_NAME", "Gomir Test")
+	os.Setenv("GIT_AUTHOR_EMAIL", "gomir@example.com")
+	os.Setenv("GIT_COMMITTER_NAME", "Gomir Test")
+	os.Setenv("GIT_COMMITTER_EMAIL", "gomir@example.com")
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+func TestManager_List(t *testing.T) {
+	f := newFixture(t)
+	for _, dir := range []string{
+		"a.git",
+		"host/org/b.git",
+		"host/org/not-a-mirror",
+		"UPPER.GIT",
+		"c.git/nested.git",
+		"host/.git",
+	} {
+		if err := os.MkdirAll(f.path("mirrors", dir), 0755); err != nil {
+			t.Fatalf("Error creating %v: %+v", dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(f.path("mirrors", "file.git"), nil, 0644); err != nil {
+		t.Fatalf("Error creating file.git: %+v", err)
+	}
+
+	mirrors, err := f.manager("exec").List()
+	if err != nil {
+		t.Fatalf("List() error = %+v", err)
+	}
+	got := []string{}
+	for _, m := range mirrors {
+		got = append(got, m.Path)
+		if m.GitDir != f.path("mirrors", m.Path) {
+			t.Errorf("GitDir = %v, want it under the root", m.GitDir)
+		}
+	}
+
+	want := []string{"UPPER.GIT", "a.git", "c.git", filepath.Join("host", "org", "b.git")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestManager_mirrorCycle(t *testing.T) {
+	transports := []string{"file", "http"}
+	for _, backendName := range backendNames() {
+		for _, transport := range transports {
+			backendName, transport := backendName, transport
+			t.Run(backendName+"/"+transport, func(t *testing.T) {
+				testMirrorCycle(t, backendName, transport)
+			})
+		}
+	}
+}
+
+// testMirrorCycle adds a mirror, then repeatedly changes the upstream,
+// fetches and pushes, verifying the destination after each push.
+func testMirrorCycle(t *testing.T, backendName, transport string) {
+	f := newFixture(t)
+	mgr := f.manager(backendName)
+	upstream := f.newUpstream("project")
+
+	var fetchURL, pushURL, dest string
+	switch transport {
+	case "file":
+		fetchURL = "file://" + upstream
+		dest = f.path("destination", "project.git")
+		pushURL = dest
+	case "http":
+		// git http-backend serves bare repositories only
+		f.git(f.dir, "clone", "-q", "--bare", upstream, f.path("upstream-bare", "project.git"))
+		upstream = f.path("upstream-bare", "project.git")
+		fetchURL = f.serveSmartHTTP(f.path("upstream-bare")) + "/project.git"
+
+		dest = f.path("destination", "project.git")
+		f.git(f.dir, "init", "-q", "--bare", dest)
+		pushURL = f.serveSmartHTTP(f.path("destination")) + "/project.git"
+	}
+
+	m := f.add(mgr, fetchURL, pushURL)
+
+	if !push(mgr, m) {
+		t.Fatalf("Initial push failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+
+	// Update, create and delete refs upstream
+	work := upstream
+	if transport == "http" {
+		work = f.path("work")
+		f.git(f.dir, "clone", "-q", upstream, work)
+	}
+	f.commit(work, "Second commit")
+	f.git(work, "tag", "v2.0")
+	f.git(work, "checkout", "-q", "-b", "topic")
+	f.commit(work, "Topic commit")
+	if transport == "http" {
+		f.git(work, "push", "-q", "origin", "master", "topic", "v2.0")
+	}
+	f.git(upstream, "branch", "-D", "feature")
+	f.git(upstream, "tag", "-d", "v1.0")
+
+	if !fetch(mgr, m) {
+		t.Fatalf("Fetch failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, m.GitDir)
+
+	if !push(mgr, m) {
+		t.Fatalf("Second push failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+
+	// Pushing again without changes succeeds and leaves the destination
+	// untouched
+	if !push(mgr, m) {
+		t.Fatalf("Third push failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+
+	// Non fast-forward updates upstream are mirrored too
+	f.git(upstream, "update-ref", "refs/heads/topic", "refs/heads/topic~1")
+	if !fetch(mgr, m) || !push(mgr, m) {
+		t.Fatalf("Mirroring a rewritten branch failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+
+	if transport == "file" {
+		// Destinations on file shares are often served over dumb HTTP,
+		// which relies on the server info updated by PushMirror
+		clone := f.path("dumb-clone")
+		f.git(f.dir, "clone", "-q", "--mirror", f.serveDumbHTTP(f.path("destination"))+"/project.git", clone)
+		f.assertSameRefs(upstream, clone)
+	}
+}
+
+func TestManager_FetchMirror_unreachableRemote(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			m := f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+			f.git(m.GitDir, "remote", "set-url", "origin", f.unreachableURL())
+
+			if mgr.FetchMirror(m) == nil {
+				t.Errorf("FetchMirror() succeeded for an unreachable remote")
+			}
+			if log := readLog(t, m); !strings.Contains(log, "Done, success:false") {
+				t.Errorf("Log does not record the failure:\n%v", log)
+			}
+		})
+	}
+}
+
+func TestManager_PushMirror_unreachableRemote(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			m := f.add(mgr, "file://"+f.newUpstream("project"), f.unreachableURL())
+
+			if mgr.PushMirror(m) == nil {
+				t.Errorf("PushMirror() succeeded for an unreachable remote")
+			}
+			if log := readLog(t, m); !strings.Contains(log, "Error pushing") {
+				t.Errorf("Log does not record the failure:\n%v", log)
+			}
+		})
+	}
+}
+
+func TestManager_PushMirror_initializesFileDestination(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			upstream := f.newUpstream("project")
+			dest := f.path("destination", "nested", "project.git")
+			m := f.add(mgr, "file://"+upstream, "file://"+dest)
+
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			if f.git(dest, "rev-parse", "--is-bare-repository") != "true" {
+				t.Errorf("Destination is not a bare repository")
+			}
+			ensureFileExists(t, filepath.Join(dest, "info", "refs"))
+			f.assertSameRefs(upstream, dest)
+		})
+	}
+}
+
+func TestManager_PushMirror_corruptedMirror(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			m := f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+
+			// Remove every object so that the refs dangle
+			if err := os.RemoveAll(filepath.Join(m.GitDir, "objects")); err != nil {
+				t.Fatalf("Error removing objects: %+v", err)
+			}
+			if err := os.MkdirAll(filepath.Join(m.GitDir, "objects", "pack"), 0755); err != nil {
+				t.Fatalf("Error recreating objects: %+v", err)
+			}
+
+			if mgr.PushMirror(m) == nil {
+				t.Errorf("PushMirror() succeeded for a corrupted mirror")
+			}
+		})
+	}
+}
+
+func TestManager_PushMirror_missingPushURL(t *testing.T) {
+	f := newFixture(t)
+	f.git(f.dir, "init", "-q", "--bare", f.path("mirrors", "project.git"))
+	mgr := f.manager("exec")
+	m := mgr.mirror("project.git")
+
+	if err := mgr.PushMirror(m); err == nil || !strings.Contains(err.Error(), "Error retrieving push URL") {
+		t.Errorf("PushMirror() error = %v, want missing push URL", err)
+	}
+	if log := readLog(t, m); !strings.Contains(log, "Error retrieving push URL") {
+		t.Errorf("Log does not record the failure:\n%v", log)
+	}
+}
+
+func TestManager_forEach(t *testing.T) {
+	f := newFixture(t)
+	for _, name := range []string{"a.git", "b.git", "c.git"} {
+		f.git(f.dir, "init", "-q", "--bare", f.path("mirrors", name))
+	}
+
+	mgr := f.manager("exec")
+	var mu sync.Mutex
+	events := []Event{}
+	mgr.OnEvent = func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+
+	results, err := mgr.forEach(OpFetch, SelectAll, func(m *Mirror) error {
+		return mgr.run(OpFetch, m, "TEST: ", func(logFile io.Writer, stats *opStats) error {
+			if m.Path == "b.git" {
+				return errors.New("failure")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("forEach() error = %+v", err)
+	}
+
+	if len(results) != 3 {
+		t.Errorf("forEach() returned %v results, want 3", len(results))
+	}
+	if failed := results.Failed(); len(failed) != 1 || failed[0].Mirror.Path != "b.git" {
+		t.Errorf("Failed() = %v, want only b.git", failed)
+	}
+	if len(events) != 9 {
+		t.Errorf("OnEvent called %v times, want a queued, start and finish per mirror", len(events))
+	}
+	for _, e := range events {
+		if e.Type == EventFinished && (e.Err != nil) != (e.Mirror.Path == "b.git") {
+			t.Errorf("Finished event for %v has Err = %v", e.Mirror, e.Err)
+		}
+	}
+}
+
+func TestManager_List_missingRoot(t *testing.T) {
+	f := newFixture(t)
+	mgr := NewManager(f.path("missing"))
+	if _, err := mgr.Fetch(); err == nil {
+		t.Errorf("Fetch() succeeded for a missing root")
+	}
+}
+
+// add adds a mirror named "project", failing the test on error.
+func (f *fixture) add(mgr *Manager, fetchURL, pushURL string) *Mirror {
+	f.t.Helper()
+	m, err := mgr.Add(fetchURL, pushURL, "project", MirrorOptions{})
+	if err != nil {
+		f.t.Fatalf("Add() error = %+v", err)
+	}
+	return m
+}
+
+func fetch(mgr *Manager, m *Mirror) bool {
+	return mgr.FetchMirror(m) == nil
+}
+
+func push(mgr *Manager, m *Mirror) bool {
+	return mgr.PushMirror(m) == nil
+}
+
+func readLog(t *testing.T, m *Mirror) string {
+	content, err := ioutil.ReadFile(m.LogPath())
+	if err != nil {
+		t.Fatalf("Error reading log for %v: %+v", m, err)
+	}
+	return string(content)
+}
+
+func TestManager_shallowMirror(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	var mu sync.Mutex
+	warnings := []string{}
+	mgr.OnEvent = func(e Event) {
+		if e.Type == EventWarning {
+			mu.Lock()
+			warnings = append(warnings, e.Message)
+			mu.Unlock()
+		}
+	}
+
+	upstream := f.newUpstream("project")
+	f.commit(upstream, "Second commit")
+	f.commit(upstream, "Third commit")
+	dest := f.path("destination", "project.git")
+
+	m, err := mgr.Add("file://"+upstream, dest, "project", MirrorOptions{Depth: 1})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	if opts, err := m.Options(); err != nil || opts.Depth != 1 {
+		t.Errorf("Options() = %+v, %v, want depth 1", opts, err)
+	}
+	if got := f.git(m.GitDir, "rev-list", "--count", "master"); got != "1" {
+		t.Errorf("Mirror has %v commits on master, want 1", got)
+	}
+
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+	ensureFileExists(t, filepath.Join(dest, "shallow"))
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "depth 1") {
+		t.Errorf("Warnings = %v, want one about the truncated history", warnings)
+	}
+
+	f.commit(upstream, "Fourth commit")
+	f.git(upstream, "branch", "-D", "feature")
+	if !fetch(mgr, m) || !push(mgr, m) {
+		t.Fatalf("Mirroring an update failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(upstream, dest)
+}
+
+func TestManager_shallowMirror_goGit(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("go-git")
+	_, err := mgr.Add("file://"+f.newUpstream("project"), f.path("destination", "project.git"), "project", MirrorOptions{Depth: 1})
+	if err == nil || !strings.Contains(err.Error(), "exec backend") {
+		t.Errorf("Add() error = %v, want history options to be rejected", err)
+	}
+}
+
+func TestManager_filteredMirror(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	f.git(upstream, "config", "uploadpack.allowFilter", "true")
+
+	m, err := mgr.Add("file://"+upstream, f.path("destination", "project.git"), "project", MirrorOptions{Filter: "blob:none"})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.filter"); got != "blob:none" {
+		t.Errorf("gomir.filter = %#v, want blob:none", got)
+	}
+	if got := f.git(m.GitDir, "config", "remote.origin.promisor"); got != "true" {
+		t.Errorf("Mirror is not a partial clone")
+	}
+
+	// Files in the upstream's history are missing from the mirror, and
+	// must not be fetched from the source while pushing
+	if err := ioutil.WriteFile(filepath.Join(upstream, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Error writing file: %+v", err)
+	}
+	f.git(upstream, "add", "file.txt")
+	f.commit(upstream, "Add file")
+	if !fetch(mgr, m) {
+		t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+	}
+	if err := os.Rename(upstream, upstream+".offline"); err != nil {
+		t.Fatalf("Error hiding upstream: %+v", err)
+	}
+
+	err = mgr.PushMirror(m)
+	if err == nil || !strings.Contains(err.Error(), "blob:none") {
+		t.Errorf("PushMirror() error = %v, want an error about the filter", err)
+	}
+}
+
+func TestMirror_SetOptions(t *testing.T) {
+	f := newFixture(t)
+	f.git(f.dir, "init", "-q", "--bare", f.path("mirrors", "project.git"))
+	m := f.manager("exec").mirror("project.git")
+
+	want := MirrorOptions{
+		Depth: 10, ShallowSince: "2017-01-01", Filter: "blob:limit=1m", FetchSchedule: "0 2 * * *", PushSchedule: "never",
+		FetchCredentials: Credentials{SSHKey: "/keys/source", KnownHosts: "/keys/known_hosts"},
+		PushCredentials:  Credentials{Username: "bot", TokenEnv: "DEST_TOKEN"},
+		Hooks:            Hooks{PreFetch: "./check.sh", PostPush: "echo pushed"},
+	}
+	if err := m.SetOptions(want); err != nil {
+		t.Fatalf("SetOptions() error = %+v", err)
+	}
+	if got, err := m.Options(); err != nil || got != want {
+		t.Errorf("Options() = %+v, %v, want %+v", got, err, want)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.shallowSince"); got != "2017-01-01" {
+		t.Errorf("gomir.shallowSince = %#v, want it readable by git", got)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.push.tokenEnv"); got != "DEST_TOKEN" {
+		t.Errorf("gomir.push.tokenEnv = %#v, want it readable by git", got)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.hook.preFetch"); got != "./check.sh" {
+		t.Errorf("gomir.hook.preFetch = %#v, want it readable by git", got)
+	}
+
+	if err := m.SetOptions(MirrorOptions{}); err != nil {
+		t.Fatalf("SetOptions() error = %+v", err)
+	}
+	if got, err := m.Options(); err != nil || got != (MirrorOptions{}) {
+		t.Errorf("Options() = %+v, %v, want defaults", got, err)
+	}
+	if strings.Contains(f.git(m.GitDir, "config", "--list"), "gomir.") {
+		t.Errorf("Default options left gomir settings behind")
+	}
+	if err := m.SetOptions(MirrorOptions{Depth: -1}); err == nil {
+		t.Errorf("SetOptions() accepted a negative depth")
+	}
+	if err := m.SetOptions(MirrorOptions{FetchSchedule: "daily"}); err == nil {
+		t.Errorf("SetOptions() accepted an invalid schedule")
+	}
+	if err := m.SetOptions(MirrorOptions{PushCredentials: Credentials{TokenEnv: "A", TokenFile: "b"}}); err == nil {
+		t.Errorf("SetOptions() accepted two token sources")
+	}
+}
+
+func TestManager_locked(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	m := f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+
+	rootLock, err := mgr.lockRoot()
+	if err != nil {
+		t.Fatalf("lockRoot() error = %+v", err)
+	}
+	if _, err := mgr.Fetch(); !isLockError(err) {
+		t.Errorf("Fetch() error = %v, want a *LockError while the root is locked", err)
+	}
+	rootLock.unlock()
+
+	mirrorLock, err := mgr.lockMirror(OpFetch, m)
+	if err != nil {
+		t.Fatalf("lockMirror() error = %+v", err)
+	}
+	results, err := mgr.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() error = %+v", err)
+	}
+	if len(results) != 1 || !isLockError(results[0].Err) {
+		t.Errorf("Fetch() results = %v, want the locked mirror to fail", results)
+	}
+	mirrorLock.unlock()
+
+	if !fetch(mgr, m) {
+		t.Errorf("FetchMirror() failed after the locks were released:\n%v", readLog(t, m))
+	}
+	if _, err := os.Stat(f.path("mirrors", rootLockName)); !os.IsNotExist(err) {
+		t.Errorf("Root lock left behind after Fetch()")
+	}
+}
+
+func isLockError(err error) bool {
+	_, ok := errors.Cause(err).(*LockError)
+	return ok
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the operation
+// duration histogram buckets.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Metrics collects statistics about the operations of a Manager and
+// exposes them in the Prometheus text format. A Manager can save its
+// Metrics and load them again, so that one-shot runs keep counting where
+// the previous run stopped.
+type Metrics struct {
+	mu    sync.Mutex
+	state metricsState
+}
+
+// metricsState is the saved form of Metrics.
+type metricsState struct {
+	// Mirrors is the number of mirrors found by the last List
+	Mirrors int `json:"mirrors"`
+	// Ops holds the statistics of each mirror by operation and path
+	Ops map[Operation]map[string]*opMetrics `json:"ops"`
+	// Durations holds a duration histogram for each operation
+	Durations map[Operation]*histogram `json:"durations"`
+}
+
+type opMetrics struct {
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Runs        uint64     `json:"runs"`
+	Failures    uint64     `json:"failures"`
+	Bytes       int64      `json:"bytes"`
+}
+
+type histogram struct {
+	// Buckets holds the number of observations less than or equal to
+	// the matching durationBuckets bound
+	Buckets []uint64 `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+}
+
+// opStats is filled in by an operation on a mirror for its metrics.
+type opStats struct {
+	// bytes is the amount of data the operation transferred
+	bytes int64
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{state: metricsState{
+		Ops:       map[Operation]map[string]*opMetrics{},
+		Durations: map[Operation]*histogram{},
+	}}
+}
+
+// metricsStateName is the name of the file in a Manager's root where its
+// metrics are saved between runs.
+const metricsStateName = ".gomir-metrics.json"
+
+// LoadMetrics sets the Manager's Metrics to those saved in the root by
+// SaveMetrics, or to empty metrics if there are none.
+func (mgr *Manager) LoadMetrics() error {
+	mx, err := loadMetrics(filepath.Join(mgr.Root, metricsStateName))
+	if err != nil {
+		return err
+	}
+	mgr.Metrics = mx
+	return nil
+}
+
+// SaveMetrics saves the Manager's Metrics in the root.
+func (mgr *Manager) SaveMetrics() error {
+	if mgr.Metrics == nil {
+		return nil
+	}
+	return mgr.Metrics.save(filepath.Join(mgr.Root, metricsStateName))
+}
+
+func loadMetrics(path string) (*Metrics, error) {
+	mx := NewMetrics()
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mx, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading metrics")
+	}
+	if err := json.Unmarshal(content, &mx.state); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing metrics %v", path)
+	}
+	if mx.state.Ops == nil {
+		mx.state.Ops = map[Operation]map[string]*opMetrics{}
+	}
+	if mx.state.Durations == nil {
+		mx.state.Durations = map[Operation]*histogram{}
+	}
+	return mx, nil
+}
+
+func (mx *Metrics) save(path string) error {
+	mx.mu.Lock()
+	content, err := json.MarshalIndent(mx.state, "", "  ")
+	mx.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Error encoding metrics")
+	}
+	return errors.Wrap(writeFileAtomic(path, content), "Error saving metrics")
+}
+
+// WriteTextfile writes the metrics in the Prometheus text format to path,
+// for node exporter's textfile collector.
+func (mx *Metrics) WriteTextfile(path string) error {
+	var buf bytes.Buffer
+	if _, err := mx.WriteTo(&buf); err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(path, buf.Bytes()), "Error writing metrics textfile")
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (mx *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mx.WriteTo(w)
+}
+
+// setMirrors records the number of mirrors found under the root.
+func (mx *Metrics) setMirrors(n int) {
+	if mx == nil {
+		return
+	}
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+	mx.state.Mirrors = n
+}
+
+// observe records an operation on m that finished at end.
+func (mx *Metrics) observe(op Operation, m *Mirror, end time.Time, duration time.Duration, stats opStats, err error) {
+	if mx == nil {
+		return
+	}
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+
+	mirrors, ok := mx.state.Ops[op]
+	if !ok {
+		mirrors = map[string]*opMetrics{}
+		mx.state.Ops[op] = mirrors
+	}
+	om, ok := mirrors[m.Path]
+	if !ok {
+		om = &opMetrics{}
+		mirrors[m.Path] = om
+	}
+	om.Runs++
+	om.Bytes += stats.bytes
+	if err != nil {
+		om.Failures++
+	} else {
+		end = end.UTC()
+		om.LastSuccess = &end
+	}
+
+	h, ok := mx.state.Durations[op]
+	if !ok || len(h.Buckets) != len(durationBuckets) {
+		h = &histogram{Buckets: make([]uint64, len(durationBuckets))}
+		mx.state.Durations[op] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.Buckets[i]++
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (mx *Metrics) WriteTo(w io.Writer) (int64, error) {
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+
+	var buf bytes.Buffer
+	header := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+
+	header("gomir_mirrors", "gauge", "Number of mirrors found under the root.")
+	fmt.Fprintf(&buf, "gomir_mirrors %v\n", mx.state.Mirrors)
+
+	ops := []Operation{}
+	for op := range mx.state.Ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	perMirror := func(name, kind, help string, value func(om *opMetrics) (string, bool)) {
+		header(name, kind, help)
+		for _, op := range ops {
+			paths := []string{}
+			for path := range mx.state.Ops[op] {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				if v, ok := value(mx.state.Ops[op][path]); ok {
+					fmt.Fprintf(&buf, "%v{mirror=%v,op=%v} %v\n", name, quoteLabel(path), quoteLabel(string(op)), v)
+				}
+			}
+		}
+	}
+	perMirror("gomir_last_success_timestamp_seconds", "gauge",
+		"Time the operation last succeeded for the mirror.", func(om *opMetrics) (string, bool) {
+			if om.LastSuccess == nil {
+				return "", false
+			}
+			return strconv.FormatInt(om.LastSuccess.Unix(), 10), true
+		})
+	perMirror("gomir_operations_total", "counter",
+		"Number of times the operation ran for the mirror.", func(om *opMetrics) (string, bool) {
+			return strconv.FormatUint(om.Runs, 10), true
+		})
+	perMirror("gomir_operation_failures_total", "counter",
+		"Number of times the operation failed for the mirror.", func(om *opMetrics) (string, bool) {
+			return strconv.FormatUint(om.Failures, 10), true
+		})
+	perMirror("gomir_transferred_bytes_total", "counter",
+		"Bytes fetched into the mirror, or pushed to its destinations.", func(om *opMetrics) (string, bool) {
+			return strconv.FormatInt(om.Bytes, 10), true
+		})
+
+	header("gomir_operation_duration_seconds", "histogram", "Duration of the operations on single mirrors.")
+	for _, op := range ops {
+		h, ok := mx.state.Durations[op]
+		if !ok {
+			continue
+		}
+		label := quoteLabel(string(op))
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&buf, "gomir_operation_duration_seconds_bucket{op=%v,le=\"%v\"} %v\n", label, bound, h.Buckets[i])
+		}
+		fmt.Fprintf(&buf, "gomir_operation_duration_seconds_bucket{op=%v,le=\"+Inf\"} %v\n", label, h.Count)
+		fmt.Fprintf(&buf, "gomir_operation_duration_seconds_sum{op=%v} %v\n", label, h.Sum)
+		fmt.Fprintf(&buf, "gomir_operation_duration_seconds_count{op=%v} %v\n", label, h.Count)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// quoteLabel quotes a label value as the Prometheus text format expects.
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// objectsSize returns the size of the objects stored in the repository at
+// gitDir.
+func objectsSize(gitDir string) int64 {
+	var size int64
+	filepath.Walk(filepath.Join(gitDir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// growth returns how much the objects of gitDir grew since they were
+// before bytes. Repacking may shrink them, which counts as no growth.
+func growth(gitDir string, before int64) int64 {
+	if after := objectsSize(gitDir); after > before {
+		return after - before
+	}
+	return 0
+}
+
+// writeFileAtomic replaces the file at path, so that readers see either
+// the old or the new content, and a crash never leaves it half written.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	mgr.Metrics = NewMetrics()
+	upstream := f.newUpstream("project")
+	m := f.add(mgr, "file://"+upstream, f.path("destination", "project.git"))
+
+	if err := ioutil.WriteFile(f.path("upstream", "project", "file.txt"), bytes.Repeat([]byte("gomir"), 1000), 0644); err != nil {
+		t.Fatalf("Error writing file: %+v", err)
+	}
+	f.git(upstream, "add", "file.txt")
+	f.commit(upstream, "Add file")
+	if _, err := mgr.Fetch(); err != nil {
+		t.Fatalf("Fetch() error = %+v", err)
+	}
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	f.git(m.GitDir, "remote", "set-url", "--push", "origin", f.unreachableURL())
+	push(mgr, m)
+
+	var buf bytes.Buffer
+	if _, err := mgr.Metrics.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %+v", err)
+	}
+	output := buf.String()
+	for _, want := range []string{
+		`gomir_mirrors 1`,
+		`gomir_last_success_timestamp_seconds{mirror="project.git",op="fetch"} \d+`,
+		`gomir_last_success_timestamp_seconds{mirror="project.git",op="push"} \d+`,
+		`gomir_operations_total{mirror="project.git",op="push"} 2`,
+		`gomir_operation_failures_total{mirror="project.git",op="push"} 1`,
+		`gomir_operation_failures_total{mirror="project.git",op="fetch"} 0`,
+		`gomir_transferred_bytes_total{mirror="project.git",op="fetch"} [1-9]\d*`,
+		`gomir_transferred_bytes_total{mirror="project.git",op="push"} [1-9]\d*`,
+		`gomir_operation_duration_seconds_bucket{op="add",le="\+Inf"} 1`,
+		`gomir_operation_duration_seconds_count{op="push"} 2`,
+		`# TYPE gomir_operation_duration_seconds histogram`,
+	} {
+		if !regexp.MustCompile("(?m)^" + want + "$").MatchString(output) {
+			t.Errorf("Metrics don't match %v:\n%v", want, output)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mgr.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != output || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("ServeHTTP() served %v %q, want the text format", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	// Metrics saved in the root are loaded again by the next run
+	if err := mgr.SaveMetrics(); err != nil {
+		t.Fatalf("SaveMetrics() error = %+v", err)
+	}
+	next := f.manager("exec")
+	if err := next.LoadMetrics(); err != nil {
+		t.Fatalf("LoadMetrics() error = %+v", err)
+	}
+	textfile := f.path("gomir.prom")
+	if err := next.Metrics.WriteTextfile(textfile); err != nil {
+		t.Fatalf("WriteTextfile() error = %+v", err)
+	}
+	if content, err := ioutil.ReadFile(textfile); err != nil || string(content) != output {
+		t.Errorf("Textfile after reload = %q, %v, want %q", content, err, output)
+	}
+}
+
+// TestMetrics_remotePush checks that pushes to remote destinations count
+// the bytes git reports writing.
+func TestMetrics_remotePush(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	mgr.Metrics = NewMetrics()
+	dest := f.path("destination", "project.git")
+	f.git(f.dir, "init", "-q", "--bare", dest)
+	m := f.add(mgr, "file://"+f.newUpstream("project"), f.serveSmartHTTP(f.path("destination"))+"/project.git")
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+
+	var buf bytes.Buffer
+	if _, err := mgr.Metrics.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %+v", err)
+	}
+	want := `gomir_transferred_bytes_total{mirror="project.git",op="push"} [1-9]\d*`
+	if !regexp.MustCompile("(?m)^" + want + "$").MatchString(buf.String()) {
+		t.Errorf("Metrics don't match %v:\n%v", want, buf.String())
+	}
+}
+
+func Test_quoteLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"github.com/pkg/errors.git", `"github.com/pkg/errors.git"`},
+		{`C:\mirrors\a.git`, `"C:\\mirrors\\a.git"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"two\nlines", `"two\nlines"`},
+	}
+	for _, tt := range tests {
+		if got := quoteLabel(tt.value); got != tt.want {
+			t.Errorf("quoteLabel(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mirror is the local copy of a mirrored repository: a bare git
+// repository under a Manager's root whose name ends in ".git".
+type Mirror struct {
+	// Path of the mirror relative to the root, such as
+	// "github.com/pkg/errors.git"
+	Path string
+
+	// GitDir is the path of the mirror's git repository
+	GitDir string
+}
+
+// LogPath returns the path of the file that records the output of every
+// operation on the mirror.
+func (m *Mirror) LogPath() string {
+	return fmt.Sprintf("%v.log", m.GitDir)
+}
+
+// FetchURL returns the URL the mirror fetches from.
+func (m *Mirror) FetchURL() (string, error) {
+	fetchURL, err := rawOriginURL(m.GitDir, "url")
+	return fetchURL, errors.Wrap(err, "Error reading fetch URL")
+}
+
+// lockPath returns the path of the file that locks the mirror while an
+// operation runs on it.
+func (m *Mirror) lockPath() string {
+	return fmt.Sprintf("%v.lock", m.GitDir)
+}
+
+func (m *Mirror) String() string {
+	return m.Path
+}
+
+// openLog opens the mirror's log file for appending. Secrets written to
+// it are redacted.
+func (m *Mirror) openLog(prefix string) (io.WriteCloser, *log.Logger, error) {
+	f, err := os.OpenFile(m.LogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error opening log file")
+	}
+	logFile := newRedactWriter(f)
+
+	logger := log.New(logFile, prefix, log.Ldate|log.Ltime|log.Lshortfile|log.LUTC)
+	return logFile, logger, nil
+}
+
+func findGitDirs(root string) []string {
+	gitDirs := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil &&
+			info.IsDir() &&
+			strings.ToLower(filepath.Base(path)) != ".git" &&
+			strings.ToLower(filepath.Ext(path)) == ".git" {
+			gitDirs = append(gitDirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return gitDirs
+}
+
+func ensureGitExt(str string) string {
+	if strings.ToLower(filepath.Ext(str)) != ".git" {
+		return fmt.Sprintf("%v.git", str)
+	}
+	return str
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// Network holds the settings for connecting to the remotes on a host.
+type Network struct {
+	// Proxy is the URL of the proxy for http remotes (proxy)
+	Proxy string
+
+	// NoProxy lists the hosts reached without the proxy, separated by
+	// commas (noProxy). An entry starting with a dot matches the
+	// domain's subdomains; "*" matches every host.
+	NoProxy string
+
+	// SSHProxyJump is the jump host for ssh remotes, in the format of
+	// ssh's -J option (sshProxyJump)
+	SSHProxyJump string
+
+	// ConnectTimeout limits how long connecting to ssh remotes may take
+	// (connectTimeout)
+	ConnectTimeout time.Duration
+
+	// LowSpeedLimit and LowSpeedTime abort transfers from http remotes
+	// that stay below LowSpeedLimit bytes per second for LowSpeedTime
+	// (lowSpeedLimit, lowSpeedTime)
+	LowSpeedLimit int
+	LowSpeedTime  time.Duration
+
+	// CABundle is the path of the certificates that verify https remotes
+	// (caBundle), instead of the system's
+	CABundle string
+
+	// BandwidthLimit limits the traffic with the host, in bytes per
+	// second, across all transfers (bandwidthLimit)
+	BandwidthLimit int64
+
+	// throttle is set by the Manager for remotes whose bandwidth is
+	// limited
+	throttle *throttle
+}
+
+// or returns n completed by the settings of fallback that n leaves
+// empty.
+func (n Network) or(fallback Network) Network {
+	if n.Proxy == "" {
+		n.Proxy = fallback.Proxy
+	}
+	if n.NoProxy == "" {
+		n.NoProxy = fallback.NoProxy
+	}
+	if n.SSHProxyJump == "" {
+		n.SSHProxyJump = fallback.SSHProxyJump
+	}
+	if n.ConnectTimeout == 0 {
+		n.ConnectTimeout = fallback.ConnectTimeout
+	}
+	if n.LowSpeedLimit == 0 {
+		n.LowSpeedLimit = fallback.LowSpeedLimit
+	}
+	if n.LowSpeedTime == 0 {
+		n.LowSpeedTime = fallback.LowSpeedTime
+	}
+	if n.CABundle == "" {
+		n.CABundle = fallback.CABundle
+	}
+	if n.BandwidthLimit == 0 {
+		n.BandwidthLimit = fallback.BandwidthLimit
+	}
+	return n
+}
+
+// proxyFor returns the proxy to reach host through, or "" to connect
+// directly.
+func (n Network) proxyFor(host string) string {
+	if n.Proxy == "" {
+		return ""
+	}
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(n.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "*", entry == host:
+			return ""
+		case strings.HasPrefix(entry, ".") && (strings.HasSuffix(host, entry) || host == entry[1:]):
+			return ""
+		}
+	}
+	return n.Proxy
+}
+
+// readNetwork reads the network settings of a host section of the gomir
+// config.
+func readNetwork(sub *formatconfig.Subsection) (Network, error) {
+	n := Network{
+		Proxy:        sub.Option("proxy"),
+		NoProxy:      sub.Option("noProxy"),
+		SSHProxyJump: sub.Option("sshProxyJump"),
+		CABundle:     sub.Option("caBundle"),
+	}
+	if n.Proxy != "" {
+		if _, err := url.Parse(n.Proxy); err != nil {
+			return n, errors.Wrap(err, "Invalid proxy")
+		}
+	}
+
+	var err error
+	if n.ConnectTimeout, err = parseDurationOption(sub, "connectTimeout"); err != nil {
+		return n, err
+	}
+	if n.LowSpeedTime, err = parseDurationOption(sub, "lowSpeedTime"); err != nil {
+		return n, err
+	}
+	if limit := sub.Option("lowSpeedLimit"); limit != "" {
+		if n.LowSpeedLimit, err = strconv.Atoi(limit); err != nil || n.LowSpeedLimit < 0 {
+			return n, errors.Errorf("Invalid lowSpeedLimit %#v", limit)
+		}
+	}
+	if limit := sub.Option("bandwidthLimit"); limit != "" {
+		if n.BandwidthLimit, err = ParseBandwidthLimit(limit); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func parseDurationOption(sub *formatconfig.Subsection, key string) (time.Duration, error) {
+	value := sub.Option(key)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("Invalid %v %#v, expected a duration such as 30s", key, value)
+	}
+	return d, nil
+}
+
+// seconds rounds d up to whole seconds, as git and ssh expect them.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// hostConfig returns the settings for the remote at rawURL. Sections
+// for the host name itself take precedence over those for domains, such
+// as "*.example.com", which take precedence over the "*" section.
+func (mgr *Manager) hostConfig(rawURL string) HostConfig {
+	return mgr.hostConfigFor(repoURLHost(rawURL))
+}
+
+// hostConfigFor returns the settings for the remotes on the lower case
+// host name host.
+func (mgr *Manager) hostConfigFor(host string) HostConfig {
+	patterns := []string{}
+	for pattern := range mgr.Hosts {
+		if matchesHost(pattern, host) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	// Longer patterns are more specific, and the host name beats a
+	// pattern of the same length
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return !strings.HasPrefix(patterns[i], "*")
+	})
+
+	var hc HostConfig
+	for _, pattern := range patterns {
+		hc.Credentials = hc.Credentials.or(mgr.Hosts[pattern].Credentials)
+		hc.Network = hc.Network.or(mgr.Hosts[pattern].Network)
+	}
+	return hc
+}
+
+// matchesHost reports whether the host section pattern applies to host.
+func matchesHost(pattern, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNetwork_proxyFor(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		host    string
+		want    string
+	}{
+		{"", "github.com", "http://proxy"},
+		{"git.example.com", "git.example.com", ""},
+		{"git.example.com", "github.com", "http://proxy"},
+		{" .Example.com , other", "git.example.com", ""},
+		{".example.com", "example.com", ""},
+		{".example.com", "badexample.com", "http://proxy"},
+		{"*", "github.com", ""},
+	}
+	for _, tt := range tests {
+		n := Network{Proxy: "http://proxy", NoProxy: tt.noProxy}
+		if got := n.proxyFor(tt.host); got != tt.want {
+			t.Errorf("proxyFor(%v) with noProxy %#v = %#v, want %#v", tt.host, tt.noProxy, got, tt.want)
+		}
+	}
+}
+
+func TestManager_hostConfig(t *testing.T) {
+	mgr := &Manager{Hosts: map[string]HostConfig{
+		"*":               {Network: Network{ConnectTimeout: time.Minute, Proxy: "http://proxy"}},
+		"*.example.com":   {Network: Network{Proxy: "http://example-proxy"}, Credentials: Credentials{KnownHosts: "/example/known_hosts"}},
+		"git.example.com": {Credentials: Credentials{SSHKey: "/keys/git"}},
+	}}
+
+	tests := []struct {
+		url  string
+		want HostConfig
+	}{
+		{"ssh://git@git.example.com/project.git", HostConfig{
+			Credentials: Credentials{SSHKey: "/keys/git", KnownHosts: "/example/known_hosts"},
+			Network:     Network{ConnectTimeout: time.Minute, Proxy: "http://example-proxy"},
+		}},
+		{"https://other.example.com/project.git", HostConfig{
+			Credentials: Credentials{KnownHosts: "/example/known_hosts"},
+			Network:     Network{ConnectTimeout: time.Minute, Proxy: "http://example-proxy"},
+		}},
+		{"git@github.com:pkg/errors.git", HostConfig{
+			Network: Network{ConnectTimeout: time.Minute, Proxy: "http://proxy"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := mgr.hostConfig(tt.url); got != tt.want {
+			t.Errorf("hostConfig(%v) = %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func Test_newGoGitConnection_network(t *testing.T) {
+	tests := []struct {
+		url     string
+		network Network
+		wantErr bool
+	}{
+		{"https://example.com/project.git", Network{Proxy: "http://proxy:3128", NoProxy: ".internal"}, false},
+		{"https://example.com/project.git", Network{ConnectTimeout: time.Minute}, false},
+		{"https://example.com/project.git", Network{LowSpeedLimit: 1000}, true},
+		{"https://example.com/project.git", Network{LowSpeedTime: time.Minute}, true},
+		{"ssh://git@example.com/project.git", Network{LowSpeedLimit: 1000, LowSpeedTime: time.Minute}, false},
+		{"ssh://git@example.com/project.git", Network{ConnectTimeout: time.Minute}, true},
+		{"git@example.com:project.git", Network{SSHProxyJump: "bastion"}, true},
+	}
+	for _, tt := range tests {
+		if _, err := newGoGitConnection(tt.url, Credentials{}, tt.network); (err != nil) != tt.wantErr {
+			t.Errorf("newGoGitConnection(%v, %+v) error = %v, wantErr %v", tt.url, tt.network, err, tt.wantErr)
+		}
+	}
+}
+
+func TestManager_LoadConfig_network(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	write := func(config string) {
+		if err := ioutil.WriteFile(f.path("mirrors", ConfigName), []byte(config), 0644); err != nil {
+			t.Fatalf("Error writing config: %+v", err)
+		}
+	}
+
+	write("[host \"*\"]\n\tproxy = http://proxy:3128\n\tnoProxy = .internal\n\tconnectTimeout = 30s\n\tlowSpeedLimit = 1000\n\tlowSpeedTime = 1m\n\tcaBundle = /tls/ca.pem\n\tsshProxyJump = bastion\n\tbandwidthLimit = 2m\n[bandwidth]\n\tlimit = 10m\n")
+	if err := mgr.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %+v", err)
+	}
+	want := Network{Proxy: "http://proxy:3128", NoProxy: ".internal", SSHProxyJump: "bastion", ConnectTimeout: 30 * time.Second, LowSpeedLimit: 1000, LowSpeedTime: time.Minute, CABundle: "/tls/ca.pem", BandwidthLimit: 2 << 20}
+	if got := mgr.Hosts["*"].Network; got != want {
+		t.Errorf("Network = %+v, want %+v", got, want)
+	}
+	if mgr.BandwidthLimit != 10<<20 {
+		t.Errorf("BandwidthLimit = %v, want 10m", mgr.BandwidthLimit)
+	}
+
+	for _, invalid := range []string{"connectTimeout = 30", "lowSpeedTime = -1s", "lowSpeedLimit = fast", "bandwidthLimit = fast"} {
+		write("[host \"*\"]\n\t" + invalid + "\n")
+		if err := mgr.LoadConfig(); err == nil {
+			t.Errorf("LoadConfig() accepted %v", invalid)
+		}
+	}
+}
+
+func TestManager_proxy(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			testProxy(t, backendName)
+		})
+	}
+}
+
+// testProxy fetches through a forwarding proxy, then directly once the
+// host is excluded from it.
+func testProxy(t *testing.T, backendName string) {
+	f := newFixture(t)
+	mgr := f.manager(backendName)
+
+	var proxied int32
+	forward := &httputil.ReverseProxy{Director: func(r *http.Request) {}}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		forward.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	upstream := f.newUpstream("project")
+	f.git(f.dir, "clone", "-q", "--bare", upstream, f.path("upstream-bare", "project.git"))
+	fetchURL := f.serveSmartHTTP(f.path("upstream-bare")) + "/project.git"
+
+	mgr.Hosts = map[string]HostConfig{"*": {Network: Network{Proxy: proxy.URL}}}
+	m, err := mgr.Add(fetchURL, f.path("destination", "project.git"), "project", MirrorOptions{})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	if atomic.LoadInt32(&proxied) == 0 {
+		t.Errorf("Add() didn't connect through the proxy")
+	}
+
+	atomic.StoreInt32(&proxied, 0)
+	host := strings.Split(strings.TrimPrefix(fetchURL, "http://"), ":")[0]
+	mgr.Hosts = map[string]HostConfig{"*": {Network: Network{Proxy: proxy.URL, NoProxy: host}}}
+	if !fetch(mgr, m) {
+		t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+	}
+	if n := atomic.LoadInt32(&proxied); n != 0 {
+		t.Errorf("FetchMirror() sent %v requests through the proxy, want none for a host in noProxy", n)
+	}
+}
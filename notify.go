@@ -0,0 +1,384 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// notifyLogLines is how many lines of a failed mirror's log a summary
+// includes.
+const notifyLogLines = 10
+
+// notifyTimeout limits how long sending a notification may take. Runs
+// send them while holding the root lock, so a hung server mustn't stall
+// them.
+var notifyTimeout = 30 * time.Second
+
+// RunSummary describes a fetch or push run for notifications.
+type RunSummary struct {
+	Op       Operation     `json:"op"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Total    int           `json:"total"`
+	Failed   int           `json:"failed"`
+
+	// Changed is set if any mirror succeeded where it failed in the
+	// previous run, or the other way around
+	Changed bool `json:"changed"`
+
+	Failures []FailureSummary `json:"failures"`
+}
+
+// FailureSummary describes a mirror that failed in a run.
+type FailureSummary struct {
+	Mirror string `json:"mirror"`
+	Error  string `json:"error"`
+	// LogTail holds the last lines of the mirror's log
+	LogTail string `json:"logTail"`
+}
+
+// Title summarizes the run in a line.
+func (s RunSummary) Title() string {
+	if s.Failed == 0 {
+		return fmt.Sprintf("gomir %v succeeded for all %v repos", s.Op, s.Total)
+	}
+	return fmt.Sprintf("gomir %v failed for %v of %v repos", s.Op, s.Failed, s.Total)
+}
+
+// Text describes the run and its failures in plain text.
+func (s RunSummary) Text() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v\n\nStarted %v, took %v.\n", s.Title(), s.Started.Format(time.RFC1123), s.Duration.Round(time.Second))
+	for _, f := range s.Failures {
+		fmt.Fprintf(&buf, "\n%v: %v\n", f.Mirror, f.Error)
+		if f.LogTail != "" {
+			fmt.Fprintf(&buf, "    %v\n", strings.Replace(f.LogTail, "\n", "\n    ", -1))
+		}
+	}
+	return buf.String()
+}
+
+// summarize describes a run. prev holds the state of the mirrors after
+// the previous run.
+func summarize(op Operation, started time.Time, results Results, prev map[string]MirrorState) RunSummary {
+	s := RunSummary{
+		Op:       op,
+		Started:  started,
+		Duration: time.Since(started),
+		Total:    len(results),
+		Failures: []FailureSummary{},
+	}
+	for _, r := range results {
+		state := StateSucceeded
+		if r.Err != nil {
+			state = StateFailed
+			s.Failed++
+			s.Failures = append(s.Failures, FailureSummary{
+				Mirror:  r.Mirror.Path,
+				Error:   r.Err.Error(),
+				LogTail: readLogTail(r.Mirror, notifyLogLines),
+			})
+		}
+
+		last, ok := prev[r.Mirror.Path]
+		if (ok && last != StatePending && last != state) || (!ok && state == StateFailed) {
+			s.Changed = true
+		}
+	}
+	return s
+}
+
+// readLogTail returns the last n lines of the mirror's log.
+func readLogTail(m *Mirror, n int) string {
+	f, err := os.Open(m.LogPath())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > stderrTailBytes {
+		f.Seek(-stderrTailBytes, io.SeekEnd)
+	}
+	tail := &tailBuffer{max: stderrTailBytes}
+	io.Copy(tail, f)
+	// Logs written before redaction was added may hold secrets
+	return Redact(tailLines(tail.String(), n))
+}
+
+// NotifyRule decides which runs a Notification reports.
+type NotifyRule string
+
+// Notification rules
+const (
+	// NotifyAlways reports every run
+	NotifyAlways NotifyRule = "always"
+	// NotifyOnFailure reports runs in which a mirror failed
+	NotifyOnFailure NotifyRule = "failure"
+	// NotifyOnChange reports runs in which a mirror started or stopped
+	// failing
+	NotifyOnChange NotifyRule = "change"
+)
+
+func (rule NotifyRule) matches(s RunSummary) bool {
+	switch rule {
+	case NotifyAlways:
+		return true
+	case NotifyOnChange:
+		return s.Changed
+	}
+	return s.Failed > 0
+}
+
+// Notifier sends run summaries somewhere.
+type Notifier interface {
+	Notify(s RunSummary) error
+}
+
+// Notification sends the summaries of the runs matching Rule through
+// Notifier.
+type Notification struct {
+	Name     string
+	Rule     NotifyRule
+	Notifier Notifier
+}
+
+// notify sends the summary of a run to the matching notifications. Errors
+// are reported as warnings, since the run itself is over.
+func (mgr *Manager) notify(s RunSummary) {
+	for _, n := range mgr.Notifications {
+		if !n.Rule.matches(s) {
+			continue
+		}
+		if err := n.Notifier.Notify(s); err != nil {
+			mgr.emit(Event{Type: EventWarning, Op: s.Op, Message: fmt.Sprintf("Error sending notification %v: %v", n.Name, err)})
+		}
+	}
+}
+
+// SMTPNotifier emails run summaries.
+type SMTPNotifier struct {
+	// Server is the host:port of the SMTP server
+	Server string
+	From   string
+	To     []string
+
+	// Username and Password authenticate with the server, if set. Go's
+	// SMTP client only sends them over TLS or to localhost.
+	Username string
+	Password string
+}
+
+// Notify emails the summary.
+func (n *SMTPNotifier) Notify(s RunSummary) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.Server
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %v\r\n", s.Title())
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(s.Text(), "\n", "\r\n", -1))
+
+	err := n.send(auth, msg.Bytes())
+	return errors.Wrapf(err, "Error sending mail through %v", n.Server)
+}
+
+// send is smtp.SendMail within notifyTimeout.
+func (n *SMTPNotifier) send(auth smtp.Auth, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", n.Server, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	host, _, _ := net.SplitHostPort(n.Server)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Webhook payload formats
+const (
+	// WebhookGeneric posts the RunSummary as JSON
+	WebhookGeneric = "webhook"
+	// WebhookSlack posts a Slack incoming webhook message, which
+	// Mattermost accepts too
+	WebhookSlack      = "slack"
+	WebhookMattermost = "mattermost"
+	// WebhookTeams posts a Microsoft Teams message card
+	WebhookTeams = "teams"
+)
+
+// WebhookNotifier posts run summaries to a chat service or any other
+// HTTP endpoint.
+type WebhookNotifier struct {
+	URL string
+	// Format is one of the Webhook payload formats
+	Format string
+	// Client sends the requests, a client giving up after notifyTimeout
+	// if nil
+	Client *http.Client
+}
+
+// Notify posts the summary.
+func (n *WebhookNotifier) Notify(s RunSummary) error {
+	var payload interface{}
+	switch n.Format {
+	case WebhookSlack, WebhookMattermost:
+		payload = map[string]string{"text": fmt.Sprintf("*%v*\n```\n%v```", s.Title(), s.Text())}
+	case WebhookTeams:
+		color := "2DC72D"
+		if s.Failed > 0 {
+			color = "D00000"
+		}
+		payload = map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    s.Title(),
+			"title":      s.Title(),
+			"themeColor": color,
+			"text":       "<pre>" + html.EscapeString(s.Text()) + "</pre>",
+		}
+	default:
+		payload = s
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "Error encoding notification")
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: notifyTimeout}
+	}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Error posting notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("Posting notification failed: %v", resp.Status)
+	}
+	return nil
+}
+
+// parseNotifications reads the notify.<name>.* settings of the gomir
+// config:
+//
+//	[notify "ops"]
+//		type = smtp             # or webhook, slack, teams, mattermost
+//		on = failure            # or always, change
+//		server = mail.example.com:587
+//		from = gomir@example.com
+//		to = ops@example.com    # may be repeated
+//		username = gomir
+//		passwordEnv = GOMIR_SMTP_PASSWORD
+//	[notify "chat"]
+//		type = slack
+//		url = https://hooks.slack.com/services/...
+func parseNotifications(section *formatconfig.Section) ([]Notification, error) {
+	notifications := []Notification{}
+	for _, sub := range section.Subsections {
+		n := Notification{
+			Name: sub.Name,
+			Rule: NotifyRule(sub.Option("on")),
+		}
+		switch n.Rule {
+		case "":
+			n.Rule = NotifyOnFailure
+		case NotifyAlways, NotifyOnFailure, NotifyOnChange:
+		default:
+			return nil, errors.Errorf("notify.%v.on must be always, failure or change, not %#v", sub.Name, n.Rule)
+		}
+
+		switch kind := sub.Option("type"); kind {
+		case "smtp":
+			smtpNotifier := &SMTPNotifier{
+				Server:   sub.Option("server"),
+				From:     sub.Option("from"),
+				To:       sub.Options.GetAll("to"),
+				Username: sub.Option("username"),
+			}
+			if env := sub.Option("passwordEnv"); env != "" {
+				smtpNotifier.Password = os.Getenv(env)
+				AddSecret(smtpNotifier.Password)
+			}
+			if smtpNotifier.Server == "" || smtpNotifier.From == "" || len(smtpNotifier.To) == 0 {
+				return nil, errors.Errorf("notify.%v needs a server, from and to", sub.Name)
+			}
+			n.Notifier = smtpNotifier
+		case WebhookGeneric, WebhookSlack, WebhookMattermost, WebhookTeams:
+			url := sub.Option("url")
+			if url == "" {
+				return nil, errors.Errorf("notify.%v needs a url", sub.Name)
+			}
+			// Chat webhook URLs grant access to the channel
+			AddSecret(url)
+			n.Notifier = &WebhookNotifier{URL: url, Format: kind}
+		default:
+			return nil, errors.Errorf("notify.%v.type must be smtp, webhook, slack, teams or mattermost, not %#v", sub.Name, kind)
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func Test_summarize(t *testing.T) {
+	a, b := &Mirror{Path: "a.git"}, &Mirror{Path: "b.git"}
+	ok := func(m *Mirror) *Result { return &Result{Mirror: m} }
+	failed := func(m *Mirror) *Result { return &Result{Mirror: m, Err: errors.New("failure")} }
+	tests := []struct {
+		name        string
+		results     Results
+		prev        map[string]MirrorState
+		wantFailed  int
+		wantChanged bool
+	}{
+		{"FirstSuccess", Results{ok(a), ok(b)}, nil, 0, false},
+		{"FirstFailure", Results{ok(a), failed(b)}, nil, 1, true},
+		{"StillFailing", Results{ok(a), failed(b)}, map[string]MirrorState{"a.git": StateSucceeded, "b.git": StateFailed}, 1, false},
+		{"Recovered", Results{ok(a), ok(b)}, map[string]MirrorState{"a.git": StateSucceeded, "b.git": StateFailed}, 0, true},
+		{"StartedFailing", Results{failed(a)}, map[string]MirrorState{"a.git": StateSucceeded}, 1, true},
+		{"Interrupted", Results{ok(a)}, map[string]MirrorState{"a.git": StatePending}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarize(OpFetch, time.Now(), tt.results, tt.prev)
+			if s.Total != len(tt.results) || s.Failed != tt.wantFailed || len(s.Failures) != tt.wantFailed {
+				t.Errorf("summarize() = %+v, want %v of %v failed", s, tt.wantFailed, len(tt.results))
+			}
+			if s.Changed != tt.wantChanged {
+				t.Errorf("Changed = %v, want %v", s.Changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	summary := RunSummary{
+		Op:       OpPush,
+		Total:    2,
+		Failed:   1,
+		Failures: []FailureSummary{{Mirror: "b.git", Error: "Error pushing", LogTail: "fatal: unable to access"}},
+	}
+	tests := []struct {
+		format string
+		field  string
+	}{
+		{WebhookGeneric, "failures"},
+		{WebhookSlack, "text"},
+		{WebhookMattermost, "text"},
+		{WebhookTeams, "title"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var got map[string]interface{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("Error decoding notification: %+v", err)
+				}
+			}))
+			defer srv.Close()
+
+			n := &WebhookNotifier{URL: srv.URL, Format: tt.format}
+			if err := n.Notify(summary); err != nil {
+				t.Fatalf("Notify() error = %+v", err)
+			}
+			if _, ok := got[tt.field]; !ok {
+				t.Errorf("Notification %v has no %v", got, tt.field)
+			}
+			if encoded, _ := json.Marshal(got); !strings.Contains(string(encoded), "b.git") {
+				t.Errorf("Notification %s doesn't name the failed repo", encoded)
+			}
+		})
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if err := (&WebhookNotifier{URL: srv.URL}).Notify(summary); err == nil {
+		t.Errorf("Notify() succeeded although the server responded 404")
+	}
+}
+
+func TestWebhookNotifier_teamsEscapesText(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	summary := RunSummary{Op: OpPush, Total: 1, Failed: 1, Failures: []FailureSummary{{Mirror: "b.git", Error: "<script>alert(1)</script>"}}}
+	if err := (&WebhookNotifier{URL: srv.URL, Format: WebhookTeams}).Notify(summary); err != nil {
+		t.Fatalf("Notify() error = %+v", err)
+	}
+	if strings.Contains(got["text"], "<script>") || !strings.Contains(got["text"], "&lt;script&gt;") {
+		t.Errorf("Teams text = %q, want the summary escaped", got["text"])
+	}
+}
+
+func TestNotifier_timeout(t *testing.T) {
+	defer func(timeout time.Duration) { notifyTimeout = timeout }(notifyTimeout)
+	notifyTimeout = 100 * time.Millisecond
+
+	// Accepts connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hung []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			hung = append(hung, conn)
+		}
+	}()
+	defer func() {
+		listener.Close()
+		<-done
+		for _, conn := range hung {
+			conn.Close()
+		}
+	}()
+
+	notifiers := map[string]Notifier{
+		"smtp":    &SMTPNotifier{Server: listener.Addr().String(), From: "gomir@example.com", To: []string{"ops@example.com"}},
+		"webhook": &WebhookNotifier{URL: "http://" + listener.Addr().String()},
+	}
+	for name, n := range notifiers {
+		t.Run(name, func(t *testing.T) {
+			started := time.Now()
+			if err := n.Notify(RunSummary{Op: OpFetch}); err == nil {
+				t.Errorf("Notify() succeeded with a server that never answers")
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("Notify() took %v, want it to give up after %v", elapsed, notifyTimeout)
+			}
+		})
+	}
+}
+
+// smtpStandIn is a minimal SMTP server that records the messages it
+// receives.
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %+v", err)
+	}
+	s := &smtpStandIn{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP stand-in")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, _ := ioutil.ReadAll(bufio.NewReader(tp.DotReader()))
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	srv := newSMTPStandIn(t)
+	n := &SMTPNotifier{
+		Server: srv.listener.Addr().String(),
+		From:   "gomir@example.com",
+		To:     []string{"ops@example.com", "dev@example.com"},
+	}
+	summary := RunSummary{Op: OpFetch, Total: 3, Failed: 1, Failures: []FailureSummary{{Mirror: "b.git", Error: "Error fetching"}}}
+	if err := n.Notify(summary); err != nil {
+		t.Fatalf("Notify() error = %+v", err)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.messages) != 1 {
+		t.Fatalf("Server received %v messages, want 1", len(srv.messages))
+	}
+	for _, want := range []string{"Subject: gomir fetch failed for 1 of 3 repos", "To: ops@example.com, dev@example.com", "b.git: Error fetching"} {
+		if !strings.Contains(srv.messages[0], want) {
+			t.Errorf("Message doesn't contain %q:\n%v", want, srv.messages[0])
+		}
+	}
+}
+
+func TestManager_notifications(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	m := f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+
+	var mu sync.Mutex
+	received := map[string][]RunSummary{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s RunSummary
+		json.NewDecoder(r.Body).Decode(&s)
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], s)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	config := "[notify \"failures\"]\n\ttype = webhook\n\turl = " + srv.URL + "/failures\n" +
+		"[notify \"changes\"]\n\ttype = webhook\n\ton = change\n\turl = " + srv.URL + "/changes\n" +
+		"[notify \"always\"]\n\ttype = webhook\n\ton = always\n\turl = " + srv.URL + "/always\n"
+	if err := ioutil.WriteFile(f.path("mirrors", ConfigName), []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing config: %+v", err)
+	}
+	if err := mgr.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %+v", err)
+	}
+	if len(mgr.Notifications) != 3 {
+		t.Fatalf("LoadConfig() loaded %v notifications, want 3", len(mgr.Notifications))
+	}
+
+	mgr.Push()
+	f.git(m.GitDir, "remote", "set-url", "--push", "origin", f.unreachableURL())
+	mgr.Push()
+	mgr.Push()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := len(received["/always"]); n != 3 {
+		t.Errorf("Received %v notifications for every run, want 3", n)
+	}
+	if n := len(received["/failures"]); n != 2 {
+		t.Errorf("Received %v notifications for failures, want 2", n)
+	}
+	if n := len(received["/changes"]); n != 1 {
+		t.Errorf("Received %v notifications for changes, want 1", n)
+	} else if s := received["/changes"][0]; s.Failed != 1 || len(s.Failures) != 1 || !strings.Contains(s.Failures[0].LogTail, "Done, success:false") {
+		t.Errorf("Change notification = %+v, want the failure with its log", s)
+	}
+}
+
+func TestManager_LoadConfig_invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"UnknownType", "[notify \"x\"]\n\ttype = pager\n"},
+		{"UnknownRule", "[notify \"x\"]\n\ttype = slack\n\turl = http://localhost\n\ton = sometimes\n"},
+		{"MissingURL", "[notify \"x\"]\n\ttype = teams\n"},
+		{"MissingRecipient", "[notify \"x\"]\n\ttype = smtp\n\tserver = localhost:25\n\tfrom = gomir@example.com\n"},
+		{"InvalidLimit", "[host \"example.com\"]\n\tproxy = http://proxy:3128\n[report]\n\tdir = reports\n[bandwidth]\n\tlimit = fast\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t)
+			if err := ioutil.WriteFile(f.path("mirrors", ConfigName), []byte(tt.config), 0644); err != nil {
+				t.Fatalf("Error writing config: %+v", err)
+			}
+			mgr := f.manager("exec")
+			mgr.RunReportDir = "current"
+			if err := mgr.LoadConfig(); err == nil {
+				t.Errorf("LoadConfig() accepted %q", tt.config)
+			}
+			if mgr.Hosts != nil || mgr.RunReportDir != "current" {
+				t.Errorf("LoadConfig() applied part of %q", tt.config)
+			}
+		})
+	}
+}
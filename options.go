@@ -0,0 +1,201 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// MirrorOptions are the settings of a single mirror. They are stored in
+// the gomir section of the mirror's git config, so they may also be
+// changed with git:
+//
+//	git config --file github.com/pkg/errors.git/config gomir.depth 50
+type MirrorOptions struct {
+	// Depth limits fetches to this many commits from the tip of each
+	// ref (gomir.depth). Zero fetches the full history.
+	Depth int
+
+	// ShallowSince limits fetches to commits newer than this date
+	// (gomir.shallowSince), in any format git accepts.
+	ShallowSince string
+
+	// Filter is a partial clone filter, such as "blob:limit=1m", that
+	// leaves matching objects out of the mirror (gomir.filter).
+	Filter string
+
+	// FetchSchedule and PushSchedule tell the daemon when to fetch and
+	// push the mirror (gomir.fetchSchedule, gomir.pushSchedule), in the
+	// format accepted by ParseSchedule. Empty uses the daemon's default;
+	// "never" disables the operation.
+	FetchSchedule string
+	PushSchedule  string
+
+	// FetchCredentials and PushCredentials authenticate to the source
+	// and the origin destination (gomir.fetch.*, gomir.push.*, such as
+	// gomir.push.sshKey). Settings left empty fall back to those
+	// configured for the remote's host in the root's gomir.config.
+	// Other destinations have their own credentials.
+	FetchCredentials Credentials
+	PushCredentials  Credentials
+
+	// Hooks run before and after each operation on the mirror
+	// (gomir.hook.*, such as gomir.hook.preFetch), after those
+	// configured in the root's gomir.config.
+	Hooks Hooks
+
+	// FetchNetwork configures the connection to the source. The Manager
+	// sets it from the host settings in the root's gomir.config; it isn't
+	// saved with the mirror.
+	FetchNetwork Network
+}
+
+// IsShallow reports whether the options truncate the fetched history.
+func (o MirrorOptions) IsShallow() bool {
+	return o.Depth > 0 || o.ShallowSince != ""
+}
+
+func (o MirrorOptions) validate() error {
+	if o.Depth < 0 {
+		return errors.Errorf("Invalid depth %v", o.Depth)
+	}
+	for _, schedule := range []string{o.FetchSchedule, o.PushSchedule} {
+		if schedule != "" && schedule != neverSchedule {
+			if _, err := ParseSchedule(schedule); err != nil {
+				return err
+			}
+		}
+	}
+	if err := o.FetchCredentials.validate(); err != nil {
+		return errors.Wrap(err, "Invalid fetch credentials")
+	}
+	return errors.Wrap(o.PushCredentials.validate(), "Invalid push credentials")
+}
+
+// Options reads the mirror's options from its git config.
+func (m *Mirror) Options() (MirrorOptions, error) {
+	cfg, err := readRawConfig(m.GitDir)
+	if err != nil {
+		return MirrorOptions{}, err
+	}
+
+	section := cfg.Section("gomir")
+	opts := MirrorOptions{
+		ShallowSince:  section.Option("shallowSince"),
+		Filter:        section.Option("filter"),
+		FetchSchedule: section.Option("fetchSchedule"),
+		PushSchedule:  section.Option("pushSchedule"),
+
+		FetchCredentials: readCredentials(section.Subsection("fetch")),
+		PushCredentials:  readCredentials(section.Subsection("push")),
+		Hooks:            readHooks(section.Subsection("hook").Options),
+	}
+	if depth := section.Option("depth"); depth != "" {
+		if opts.Depth, err = strconv.Atoi(depth); err != nil {
+			return opts, errors.Wrapf(err, "Invalid gomir.depth %#v", depth)
+		}
+	}
+	return opts, opts.validate()
+}
+
+// SetOptions writes the mirror's options to its git config.
+func (m *Mirror) SetOptions(opts MirrorOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	return editRawConfig(m.GitDir, func(cfg *formatconfig.Config) {
+		section := cfg.Section("gomir")
+		setOrRemove(section, "depth", opts.Depth != 0, strconv.Itoa(opts.Depth))
+		setOrRemove(section, "shallowSince", opts.ShallowSince != "", opts.ShallowSince)
+		setOrRemove(section, "filter", opts.Filter != "", opts.Filter)
+		setOrRemove(section, "fetchSchedule", opts.FetchSchedule != "", opts.FetchSchedule)
+		setOrRemove(section, "pushSchedule", opts.PushSchedule != "", opts.PushSchedule)
+		writeCredentials(section, "fetch", opts.FetchCredentials)
+		writeCredentials(section, "push", opts.PushCredentials)
+		writeHooks(section.Subsection("hook"), opts.Hooks)
+		if len(section.Subsection("hook").Options) == 0 {
+			section.RemoveSubsection("hook")
+		}
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.RemoveSection("gomir")
+		}
+	})
+}
+
+func setOrRemove(section *formatconfig.Section, key string, set bool, value string) {
+	if set {
+		section.SetOption(key, value)
+	} else {
+		section.RemoveOption(key)
+	}
+}
+
+// describeHistory describes how the options truncate history.
+func describeHistory(opts MirrorOptions) string {
+	switch {
+	case opts.Depth > 0 && opts.ShallowSince != "":
+		return fmt.Sprintf("depth %v and shallowSince %v", opts.Depth, opts.ShallowSince)
+	case opts.Depth > 0:
+		return fmt.Sprintf("depth %v", opts.Depth)
+	case opts.ShallowSince != "":
+		return fmt.Sprintf("shallowSince %v", opts.ShallowSince)
+	}
+	return "an earlier shallow fetch"
+}
+
+// allowShallowUpdates configures the repository at gitDir to accept
+// pushes from shallow repositories.
+func allowShallowUpdates(gitDir string) error {
+	return editRawConfig(gitDir, func(cfg *formatconfig.Config) {
+		cfg.Section("receive").SetOption("shallowUpdate", "true")
+	})
+}
+
+// isShallowRepo reports whether the repository at gitDir has truncated
+// history.
+func isShallowRepo(gitDir string) bool {
+	_, err := os.Stat(filepath.Join(gitDir, "shallow"))
+	return err == nil
+}
+
+func readRawConfig(gitDir string) (*formatconfig.Config, error) {
+	f, err := os.Open(filepath.Join(gitDir, "config"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening git config")
+	}
+	defer f.Close()
+
+	cfg := formatconfig.New()
+	if err := formatconfig.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, errors.Wrap(err, "Error parsing git config")
+	}
+	return cfg, nil
+}
+
+// editRawConfig rewrites the config file of gitDir after applying edit.
+// go-git's higher level config writer is avoided since it would turn
+// pushurl entries into additional url entries.
+func editRawConfig(gitDir string, edit func(cfg *formatconfig.Config)) error {
+	cfg, err := readRawConfig(gitDir)
+	if err != nil {
+		return err
+	}
+
+	edit(cfg)
+
+	var buf bytes.Buffer
+	if err := formatconfig.NewEncoder(&buf).Encode(cfg); err != nil {
+		return errors.Wrap(err, "Error encoding git config")
+	}
+	return errors.Wrap(writeFileAtomic(filepath.Join(gitDir, "config"), buf.Bytes()), "Error writing git config")
+}
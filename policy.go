@@ -0,0 +1,771 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// policyReportName is the file in a mirror's git directory holding the
+// policy violations found by the last push, as JSON.
+const policyReportName = "gomir-policy-report.json"
+
+// binarySniffLen is how much of a file is searched for a NUL byte to
+// tell binary files from text, as git does.
+const binarySniffLen = 8000
+
+// maxScanLine is the longest line searched at once for forbidden content
+// and secrets. Longer lines are searched in pieces of this length.
+const maxScanLine = 1 << 20
+
+// PolicyAction decides what happens to refs violating a Policy.
+type PolicyAction string
+
+const (
+	// PolicyBlock holds back the refs bringing violations from the push
+	PolicyBlock PolicyAction = "block"
+	// PolicyWarn pushes every ref and reports the violations as warnings
+	PolicyWarn PolicyAction = "warn"
+	// PolicyAbort pushes no refs at all
+	PolicyAbort PolicyAction = "abort"
+)
+
+// validatePolicyAction returns an error if action, of the named section,
+// isn't empty or a PolicyAction.
+func validatePolicyAction(section string, action PolicyAction) error {
+	switch action {
+	case "", PolicyBlock, PolicyWarn, PolicyAbort:
+		return nil
+	}
+	return errors.Errorf("Invalid %v action %#v, expected block, warn or abort", section, action)
+}
+
+// Policy restricts the files that pushes may send. Pushes check the
+// commits new since the last successful push, and hold back the refs
+// bringing files that violate the policy; the other refs are pushed.
+//
+// The root's gomir.config sets the policy of every mirror, and each
+// mirror may add to it in its git config:
+//
+//	[policy]
+//		maxBlobSize = 10m
+//		forbidPath = *.exe
+//	git config --file github.com/pkg/errors.git/config --add gomir.policy.forbidPath "testdata/**"
+type Policy struct {
+	// MaxBlobSize, if positive, forbids files larger than this many
+	// bytes (maxBlobSize, such as 500k, 10m or 1g)
+	MaxBlobSize int64
+
+	// ForbidPaths forbids files matching these patterns (forbidPath, may
+	// be repeated). Patterns without a / match the file name in any
+	// directory, such as *.exe; ** matches any number of directories,
+	// such as build/** or **/secrets/*.
+	ForbidPaths []string
+
+	// ForbidContent forbids text files with lines matching these regular
+	// expressions (forbidContent, may be repeated). Files over
+	// MaxBlobSize aren't searched.
+	ForbidContent []string
+
+	// Action is what happens to refs with violations (action), block by
+	// default
+	Action PolicyAction
+
+	// Secrets scans the files for secrets, configured in the secrets
+	// section of the root's gomir.config and the gomir.secrets
+	// subsection of each mirror's git config
+	Secrets SecretScan
+
+	// Signatures requires tags and commits to be signed, configured in
+	// the signatures section of the root's gomir.config and the
+	// gomir.signatures subsection of each mirror's git config
+	Signatures SignaturePolicy
+}
+
+// IsZero reports whether the policy allows everything.
+func (p Policy) IsZero() bool {
+	return p.MaxBlobSize == 0 && len(p.ForbidPaths) == 0 && len(p.ForbidContent) == 0 && !p.Secrets.Enabled && p.Signatures.IsZero()
+}
+
+// action returns what happens to refs with the violation v.
+func (p Policy) action(v Violation) PolicyAction {
+	switch {
+	case v.isSecret() && p.Secrets.Action != "":
+		return p.Secrets.Action
+	case v.isSecret():
+		return PolicyWarn
+	case v.isSignature() && p.Signatures.Action != "":
+		return p.Signatures.Action
+	case v.isSignature():
+		return PolicyBlock
+	case p.Action != "":
+		return p.Action
+	}
+	return PolicyBlock
+}
+
+// merge returns the policy with the rules of other added. Settings of
+// other with a single value replace those of p.
+func (p Policy) merge(other Policy) Policy {
+	if other.MaxBlobSize != 0 {
+		p.MaxBlobSize = other.MaxBlobSize
+	}
+	if other.Action != "" {
+		p.Action = other.Action
+	}
+	p.ForbidPaths = append(append([]string{}, p.ForbidPaths...), other.ForbidPaths...)
+	p.ForbidContent = append(append([]string{}, p.ForbidContent...), other.ForbidContent...)
+	p.Secrets = p.Secrets.merge(other.Secrets)
+	p.Signatures = p.Signatures.merge(other.Signatures)
+	return p
+}
+
+func readPolicy(options formatconfig.Options) (Policy, error) {
+	p := Policy{
+		ForbidPaths:   options.GetAll("forbidPath"),
+		ForbidContent: options.GetAll("forbidContent"),
+		Action:        PolicyAction(options.Get("action")),
+	}
+	if size := options.Get("maxBlobSize"); size != "" {
+		var err error
+		if p.MaxBlobSize, err = parseSize(size); err != nil {
+			return p, errors.Errorf("Invalid maxBlobSize %#v, expected a size such as 10m", size)
+		}
+	}
+	if err := validatePolicyAction("policy", p.Action); err != nil {
+		return p, err
+	}
+	for _, pattern := range p.ForbidPaths {
+		if _, err := path.Match(strings.Replace(pattern, "**", "*", -1), ""); err != nil {
+			return p, errors.Errorf("Invalid forbidPath %#v", pattern)
+		}
+	}
+	for _, pattern := range p.ForbidContent {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return p, errors.Wrapf(err, "Invalid forbidContent %#v", pattern)
+		}
+	}
+	return p, nil
+}
+
+// parseSize parses a number of bytes with an optional k, m or g suffix
+// for KiB, MiB or GiB, like git's size options.
+func parseSize(s string) (int64, error) {
+	units := map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30}
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		if u, ok := units[strings.ToLower(s)[n-1]]; ok {
+			unit, s = u, s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("Invalid size %#v", s)
+	}
+	return n * unit, nil
+}
+
+// Policy returns the mirror's own policy, stored in the gomir.policy,
+// gomir.secrets and gomir.signatures subsections of its git config.
+func (m *Mirror) Policy() (Policy, error) {
+	cfg, err := readRawConfig(m.GitDir)
+	if err != nil {
+		return Policy{}, err
+	}
+	section := cfg.Section("gomir")
+	p, err := readPolicy(section.Subsection("policy").Options)
+	if err != nil {
+		return p, errors.Wrapf(err, "Invalid policy for mirror %v", m)
+	}
+	if p.Secrets, err = readSecretScan(nil, section.Subsection("secrets").Options); err != nil {
+		return p, errors.Wrapf(err, "Invalid policy for mirror %v", m)
+	}
+	p.Signatures, err = readSignaturePolicy(section.Subsection("signatures").Options)
+	return p, errors.Wrapf(err, "Invalid policy for mirror %v", m)
+}
+
+// Violation is a file in a commit, or an unsigned commit or tag, that
+// breaks a policy.
+type Violation struct {
+	Commit string `json:"commit"`
+	Path   string `json:"path,omitempty"`
+
+	// Line is the line of the file that breaks the policy, if any
+	Line int `json:"line,omitempty"`
+
+	// Rule is the setting that forbids the file, such as "forbidPath",
+	// "secrets." and the ID of the SecretRule that found a secret, or
+	// signatures.tag or signatures.commit
+	Rule string `json:"rule"`
+
+	// Detail describes the violation, such as the pattern the path
+	// matches. It never includes the file's content.
+	Detail string `json:"detail"`
+
+	// Action is what happens to the refs bringing the violation
+	Action PolicyAction `json:"action"`
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return fmt.Sprintf("%.7v: %v", v.Commit, v.Detail)
+	}
+	if v.Line > 0 {
+		return fmt.Sprintf("%v:%v in %.7v: %v", v.Path, v.Line, v.Commit, v.Detail)
+	}
+	return fmt.Sprintf("%v in %.7v: %v", v.Path, v.Commit, v.Detail)
+}
+
+// RefViolations are the violations in the new commits of a ref.
+type RefViolations struct {
+	Ref        string      `json:"ref"`
+	Violations []Violation `json:"violations"`
+}
+
+// PolicyError reports the refs a push held back because of policy
+// violations. The other refs were pushed, unless Aborted is set.
+type PolicyError struct {
+	Refs []RefViolations
+
+	// Aborted is set if violations with the abort action stopped the
+	// whole push
+	Aborted bool
+}
+
+func (e *PolicyError) Error() string {
+	lines := []string{"Policy violations held back refs from the push:"}
+	if e.Aborted {
+		lines[0] = "Policy violations stopped the push:"
+	}
+	for _, r := range e.Refs {
+		for _, v := range r.Violations {
+			lines = append(lines, fmt.Sprintf("%v: %v", r.Ref, v))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// policyChecker finds the violations of a policy in the commits of a
+// repository.
+type policyChecker struct {
+	*history
+	policy  Policy
+	content []*regexp.Regexp
+	secrets *secretScanner
+
+	// verifier checks signatures, and log receives the signatures that
+	// are good
+	verifier *signatureVerifier
+	log      io.Writer
+
+	// violations are the violations each checked commit introduces, and
+	// offending the commits with violations each checked commit brings
+	// along, itself included
+	violations map[plumbing.Hash][]Violation
+	offending  map[plumbing.Hash][]plumbing.Hash
+
+	// blobs are the violations of the contents of each checked file
+	blobs map[plumbing.Hash][]Violation
+
+	// partial is set if the mirror is a partial clone, which may lack
+	// files
+	partial bool
+}
+
+// checkPolicy returns the violations of p in the commits and tags new in
+// current, the refs of the repository at gitDir, since pushed, the refs as
+// of the last push. Good signatures are logged to log.
+func checkPolicy(gitDir string, p Policy, pushed, current map[string]string, log io.Writer) ([]RefViolations, error) {
+	if p.IsZero() {
+		return nil, nil
+	}
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening mirror")
+	}
+	c := &policyChecker{
+		history:    newHistory(repo),
+		policy:     p,
+		violations: map[plumbing.Hash][]Violation{},
+		offending:  map[plumbing.Hash][]plumbing.Hash{},
+		blobs:      map[plumbing.Hash][]Violation{},
+		log:        log,
+	}
+	if c.partial, err = isPartialClone(repo); err != nil {
+		return nil, errors.Wrap(err, "Error reading mirror config")
+	}
+	for _, pattern := range p.ForbidContent {
+		c.content = append(c.content, regexp.MustCompile(pattern))
+	}
+	if c.secrets, err = newSecretScanner(p.Secrets); err != nil {
+		return nil, err
+	}
+	if !p.Signatures.IsZero() {
+		if c.verifier, err = newSignatureVerifier(p.Signatures); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hash := range pushed {
+		if err := c.markKnown(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	results := []RefViolations{}
+	for _, change := range diffRefs(pushed, current) {
+		if change.New == "" {
+			continue
+		}
+		r := RefViolations{Ref: change.Ref}
+		if c.verifier != nil {
+			if r.Violations, err = c.checkSignatures(change); err != nil {
+				return nil, errors.Wrapf(err, "Error checking %v", change.Ref)
+			}
+		}
+		if err := c.checkFiles(change, &r); err != nil {
+			return nil, errors.Wrapf(err, "Error checking %v", change.Ref)
+		}
+		if len(r.Violations) > 0 {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// checkFiles adds the violations of the files in the commits that change
+// brings to r.
+func (c *policyChecker) checkFiles(change RefChange, r *RefViolations) error {
+	commit, err := c.peel(plumbing.NewHash(change.New))
+	if err != nil {
+		return err
+	}
+	if commit.IsZero() || c.known[commit] {
+		return nil
+	}
+	if err := c.check(commit); err != nil {
+		return err
+	}
+	for _, hash := range c.offending[commit] {
+		r.Violations = append(r.Violations, c.violations[hash]...)
+	}
+	return nil
+}
+
+// parents returns the parents of commit that the repository has. A
+// shallow repository lacks the parents of its oldest commits.
+func (c *policyChecker) parents(commit *object.Commit) []*object.Commit {
+	parents := []*object.Commit{}
+	for _, hash := range commit.ParentHashes {
+		if parent, err := c.repo.CommitObject(hash); err == nil {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// check finds the violations of the commits reachable from tip that
+// aren't known, filling c.offending for each of them.
+func (c *policyChecker) check(tip plumbing.Hash) error {
+	stack := []plumbing.Hash{tip}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		if _, ok := c.offending[hash]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		commit, err := c.repo.CommitObject(hash)
+		if err != nil {
+			return err
+		}
+
+		// Check the parents first
+		parents := c.parents(commit)
+		pending := false
+		for _, parent := range parents {
+			if _, ok := c.offending[parent.Hash]; !ok && !c.known[parent.Hash] {
+				stack = append(stack, parent.Hash)
+				pending = true
+			}
+		}
+		if pending {
+			continue
+		}
+		stack = stack[:len(stack)-1]
+
+		violations, err := c.checkCommit(commit, parents)
+		if err != nil {
+			return errors.Wrapf(err, "Error checking commit %v", hash)
+		}
+		seen := map[plumbing.Hash]bool{}
+		offending := []plumbing.Hash{}
+		if len(violations) > 0 {
+			c.violations[hash] = violations
+			offending = append(offending, hash)
+			seen[hash] = true
+		}
+		for _, parent := range parents {
+			for _, h := range c.offending[parent.Hash] {
+				if !seen[h] {
+					offending = append(offending, h)
+					seen[h] = true
+				}
+			}
+		}
+		c.offending[hash] = offending
+	}
+	return nil
+}
+
+// checkCommit returns the violations of the files that commit adds or
+// changes. Files of a merge that one of its parents already has were
+// checked with that parent.
+func (c *policyChecker) checkCommit(commit *object.Commit, parents []*object.Commit) ([]Violation, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var first *object.Tree
+	others := []*object.Tree{}
+	for i, parent := range parents {
+		t, err := parent.Tree()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			first = t
+		} else {
+			others = append(others, t)
+		}
+	}
+	changes, err := object.DiffTree(first, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	violations := []Violation{}
+	for _, change := range changes {
+		entry := change.To.TreeEntry
+		if change.To.Name == "" || entry.Mode == filemode.Submodule {
+			continue
+		}
+		if inAnyTree(others, change.To.Name, entry.Hash) {
+			continue
+		}
+		fileViolations, err := c.checkFile(change.To.Name, entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range fileViolations {
+			v.Commit = commit.Hash.String()
+			v.Action = c.policy.action(v)
+			if v.isSecret() && c.secrets.allow.finding(v) {
+				continue
+			}
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// inAnyTree reports whether one of trees has the file hash at name.
+func inAnyTree(trees []*object.Tree, name string, hash plumbing.Hash) bool {
+	for _, t := range trees {
+		if entry, err := t.FindEntry(name); err == nil && entry.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFile returns the violations of the file at name with the contents
+// hash.
+func (c *policyChecker) checkFile(name string, hash plumbing.Hash) ([]Violation, error) {
+	violations := []Violation{}
+	for _, pattern := range c.policy.ForbidPaths {
+		if matchPath(pattern, name) {
+			violations = append(violations, Violation{Path: name, Rule: "forbidPath", Detail: fmt.Sprintf("path matches %v", pattern)})
+		}
+	}
+
+	blobViolations, ok := c.blobs[hash]
+	if !ok {
+		var err error
+		if blobViolations, err = c.checkBlob(hash); err != nil {
+			return nil, errors.Wrapf(err, "Error checking %v", name)
+		}
+		c.blobs[hash] = blobViolations
+	}
+	for _, v := range blobViolations {
+		if v.isSecret() && c.secrets.allow.path(name) {
+			continue
+		}
+		v.Path = name
+		violations = append(violations, v)
+	}
+	return violations, nil
+}
+
+// checkBlob returns the violations of the contents of a file. Files that
+// a partial mirror left out can't be pushed and aren't checked; files that
+// can't be read are errors, so that they aren't pushed unchecked. Files
+// over MaxBlobSize and binary files aren't searched for forbidden content
+// or secrets, and the others are read a line at a time.
+func (c *policyChecker) checkBlob(hash plumbing.Hash) ([]Violation, error) {
+	blob, err := c.repo.BlobObject(hash)
+	if err == plumbing.ErrObjectNotFound && c.partial {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Error reading file %v", hash)
+	}
+	violations := []Violation{}
+	if c.policy.MaxBlobSize > 0 && blob.Size > c.policy.MaxBlobSize {
+		violations = append(violations, Violation{Rule: "maxBlobSize", Detail: fmt.Sprintf("%v bytes, over maxBlobSize %v", blob.Size, c.policy.MaxBlobSize)})
+		return violations, nil
+	}
+	if len(c.content) == 0 && c.secrets == nil {
+		return violations, nil
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading file %v", hash)
+	}
+	defer r.Close()
+	content := bufio.NewReaderSize(r, maxScanLine)
+	head, err := content.Peek(binarySniffLen)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "Error reading file %v", hash)
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return violations, nil
+	}
+
+	// The first line matching each of c.content
+	matched := make([]int, len(c.content))
+	secrets := []Violation{}
+	err = scanLines(content, func(n int, line []byte) {
+		for i, re := range c.content {
+			if matched[i] == 0 && re.Match(line) {
+				matched[i] = n
+			}
+		}
+		if c.secrets != nil {
+			secrets = append(secrets, c.secrets.scanLine(n, line)...)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading file %v", hash)
+	}
+	for i, re := range c.content {
+		if matched[i] > 0 {
+			violations = append(violations, Violation{Line: matched[i], Rule: "forbidContent", Detail: fmt.Sprintf("line matches %v", re)})
+		}
+	}
+	return append(violations, secrets...), nil
+}
+
+// isPartialClone reports whether repo is a partial clone, whose promisor
+// remotes may have left files out.
+func isPartialClone(repo *gogit.Repository) (bool, error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return false, err
+	}
+	if cfg.Raw.Section("extensions").Option("partialClone") != "" {
+		return true, nil
+	}
+	for _, remote := range cfg.Raw.Section("remote").Subsections {
+		if promisor, _ := strconv.ParseBool(remote.Option("promisor")); promisor {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// scanLines calls fn with each line of r and its number, until r ends. It
+// returns the error reading r, if any. Lines longer than maxScanLine are
+// passed in pieces, numbered alike.
+func scanLines(r io.Reader, fn func(n int, line []byte)) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok || br.Size() < maxScanLine {
+		br = bufio.NewReaderSize(r, maxScanLine)
+	}
+	for n := 1; ; {
+		line, more, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(n, line)
+		if !more {
+			n++
+		}
+	}
+}
+
+// matchPath reports whether the file name matches pattern, see
+// Policy.ForbidPaths.
+func matchPath(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// policy returns the policy of m, the root's with the mirror's added.
+// The secrets allowlist and the trusted keys are relative to the root.
+func (mgr *Manager) policy(m *Mirror) (Policy, error) {
+	p, err := m.Policy()
+	if err != nil {
+		return p, err
+	}
+	p = mgr.Policy.merge(p)
+	for _, name := range []*string{&p.Secrets.Allowlist, &p.Signatures.GPGKeyring, &p.Signatures.AllowedSigners} {
+		if *name != "" && !filepath.IsAbs(*name) {
+			*name = filepath.Join(mgr.Root, *name)
+		}
+	}
+	return p, nil
+}
+
+// checkPushPolicy checks the commits of m new in current, its refs, since
+// pushed, its refs as of the last push, against its policy. It logs the
+// violations, saves them as the mirror's policy report and returns those
+// of the refs to hold back from the push. Refs with only violations to
+// warn about are reported as warnings. Violations to abort on return a
+// *PolicyError, and nothing is to be pushed.
+func (mgr *Manager) checkPushPolicy(m *Mirror, pushed, current map[string]string, logFile io.Writer) ([]RefViolations, error) {
+	p, err := mgr.policy(m)
+	if err != nil {
+		return nil, err
+	}
+	results, err := checkPolicy(m.GitDir, p, pushed, current, logFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error checking policy")
+	}
+	if err := m.savePolicyReport(results); err != nil {
+		return nil, err
+	}
+
+	blocked := []RefViolations{}
+	aborted := false
+	for _, r := range results {
+		block := false
+		for _, v := range r.Violations {
+			if v.isSecret() {
+				fmt.Fprintf(logFile, "Policy violation: %v: %v (%v)\n", r.Ref, v, v.Fingerprint())
+			} else {
+				fmt.Fprintf(logFile, "Policy violation: %v: %v\n", r.Ref, v)
+			}
+			block = block || v.Action == PolicyBlock || v.Action == PolicyAbort
+			aborted = aborted || v.Action == PolicyAbort
+		}
+		if block {
+			blocked = append(blocked, r)
+		} else {
+			mgr.warn(OpPush, m, logFile, "%v has %v policy violations", r.Ref, len(r.Violations))
+		}
+	}
+	if aborted {
+		return nil, &PolicyError{Refs: blocked, Aborted: true}
+	}
+	return blocked, nil
+}
+
+// savePolicyReport saves the violations found by a push as the mirror's
+// policy report, or removes the report if there are none.
+func (m *Mirror) savePolicyReport(results []RefViolations) error {
+	reportPath := filepath.Join(m.GitDir, policyReportName)
+	if len(results) == 0 {
+		if err := os.Remove(reportPath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Error removing policy report")
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Error saving policy report")
+	}
+	return errors.Wrap(ioutil.WriteFile(reportPath, content, 0644), "Error saving policy report")
+}
+
+// PolicyReport returns the policy violations found by the mirror's last
+// push, if any.
+func (m *Mirror) PolicyReport() ([]RefViolations, error) {
+	content, err := ioutil.ReadFile(filepath.Join(m.GitDir, policyReportName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error reading policy report")
+	}
+	results := []RefViolations{}
+	return results, errors.Wrap(json.Unmarshal(content, &results), "Error reading policy report")
+}
+
+// blockedRefs returns the refs of results, and refs with them reset to
+// their pushed values, which is what the push sends.
+func blockedRefs(results []RefViolations, refs, pushed map[string]string) ([]string, map[string]string) {
+	if len(results) == 0 {
+		return nil, refs
+	}
+	sent := map[string]string{}
+	for ref, hash := range refs {
+		sent[ref] = hash
+	}
+	blocked := []string{}
+	for _, r := range results {
+		blocked = append(blocked, r.Ref)
+		if hash, ok := pushed[r.Ref]; ok {
+			sent[r.Ref] = hash
+		} else {
+			delete(sent, r.Ref)
+		}
+	}
+	sort.Strings(blocked)
+	return blocked, sent
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package gomir
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// processExists reports whether a process with the given pid is running.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// shellCommand returns the command running command with the shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
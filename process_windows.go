@@ -0,0 +1,28 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// processExists reports whether a process with the given pid is running.
+func processExists(pid int) bool {
+	// FindProcess opens a handle to the process, which fails once it has
+	// exited
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// shellCommand returns the command running command with the shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
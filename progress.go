@@ -0,0 +1,120 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxProgressLine is how much of a line without an end the progress
+// parser keeps; longer lines aren't progress.
+const maxProgressLine = 4096
+
+// Progress is the state of a transfer of a mirror, as git reports it.
+type Progress struct {
+	// Phase is what git is doing, such as "Receiving objects" or
+	// "Writing objects"
+	Phase string
+
+	Percent      int
+	Objects      int64
+	TotalObjects int64
+
+	// Bytes is how much the phase transferred, and Rate its throughput
+	// in bytes per second, for the phases that transfer data
+	Bytes int64
+	Rate  float64
+
+	// Done is set on the last update of the phase
+	Done bool
+}
+
+// Remaining estimates how long the phase takes to finish, from its
+// throughput and progress, or returns 0 if it can't tell.
+func (p Progress) Remaining() time.Duration {
+	if p.Done || p.Rate <= 0 || p.Percent <= 0 || p.Percent >= 100 {
+		return 0
+	}
+	total := float64(p.Bytes) * 100 / float64(p.Percent)
+	return time.Duration((total - float64(p.Bytes)) / p.Rate * float64(time.Second))
+}
+
+// progressPattern matches the progress lines git writes to stderr, such
+// as:
+//
+//	Receiving objects:  45% (450/1000), 1.20 MiB | 600.00 KiB/s
+//	remote: Compressing objects: 100% (3/3), done.
+var progressPattern = regexp.MustCompile(`^(?:remote: )?([A-Z][a-z]+(?: [a-z]+)*):\s+(\d+)% \((\d+)/(\d+)\)` +
+	`(?:, ([\d.]+) (bytes|KiB|MiB|GiB|TiB)(?: \| ([\d.]+) (bytes|KiB|MiB|GiB|TiB)/s)?)?(, done\.)?`)
+
+var sizeUnits = map[string]float64{"bytes": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+
+// parseProgress parses a progress line of git.
+func parseProgress(line string) (Progress, bool) {
+	match := progressPattern.FindStringSubmatch(line)
+	if match == nil {
+		return Progress{}, false
+	}
+	p := Progress{Phase: match[1], Done: match[9] != ""}
+	p.Percent, _ = strconv.Atoi(match[2])
+	p.Objects, _ = strconv.ParseInt(match[3], 10, 64)
+	p.TotalObjects, _ = strconv.ParseInt(match[4], 10, 64)
+	if match[5] != "" {
+		size, _ := strconv.ParseFloat(match[5], 64)
+		p.Bytes = int64(size * sizeUnits[match[6]])
+	}
+	if match[7] != "" {
+		rate, _ := strconv.ParseFloat(match[7], 64)
+		p.Rate = rate * sizeUnits[match[8]]
+	}
+	return p, true
+}
+
+// progressWriter passes everything written to it on to w, and reports
+// the progress lines of git among it. git ends the updates of a progress
+// line with carriage returns.
+type progressWriter struct {
+	w      io.Writer
+	report func(Progress)
+
+	mu   sync.Mutex
+	line []byte
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+
+	// git writes stdout and stderr from separate goroutines
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.line = append(p.line, b...)
+	for {
+		i := bytes.IndexAny(p.line, "\r\n")
+		if i < 0 {
+			break
+		}
+		if progress, ok := parseProgress(string(p.line[:i])); ok {
+			p.report(progress)
+		}
+		p.line = p.line[i+1:]
+	}
+	if len(p.line) > maxProgressLine {
+		p.line = nil
+	}
+	return n, err
+}
+
+// progressWriter returns a writer passing output on to logFile that
+// reports the progress of op on m through OnEvent.
+func (mgr *Manager) progressWriter(op Operation, m *Mirror, logFile io.Writer) io.Writer {
+	return &progressWriter{w: logFile, report: func(p Progress) {
+		mgr.emit(Event{Type: EventProgress, Op: op, Mirror: m, Progress: p})
+	}}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_parseProgress(t *testing.T) {
+	tests := []struct {
+		line string
+		want Progress
+		ok   bool
+	}{
+		{"Receiving objects:  45% (450/1000), 1.50 MiB | 512.00 KiB/s", Progress{
+			Phase: "Receiving objects", Percent: 45, Objects: 450, TotalObjects: 1000, Bytes: 1572864, Rate: 524288,
+		}, true},
+		{"Writing objects: 100% (9/9), 527 bytes | 527.00 KiB/s, done.", Progress{
+			Phase: "Writing objects", Percent: 100, Objects: 9, TotalObjects: 9, Bytes: 527, Rate: 539648, Done: true,
+		}, true},
+		{"remote: Compressing objects:  33% (1/3)", Progress{
+			Phase: "Compressing objects", Percent: 33, Objects: 1, TotalObjects: 3,
+		}, true},
+		{"Resolving deltas: 100% (2/2), done.", Progress{
+			Phase: "Resolving deltas", Percent: 100, Objects: 2, TotalObjects: 2, Done: true,
+		}, true},
+		{"Enumerating objects: 9, done.", Progress{}, false},
+		{" * [new branch]      master -> master", Progress{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, ok := parseProgress(tt.line)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProgress() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProgress_Remaining(t *testing.T) {
+	p := Progress{Percent: 25, Bytes: 1 << 20, Rate: 1 << 20}
+	if got := p.Remaining(); got != 3*time.Second {
+		t.Errorf("Remaining() = %v, want 3s", got)
+	}
+	p.Done = true
+	if got := p.Remaining(); got != 0 {
+		t.Errorf("Remaining() = %v when done, want 0", got)
+	}
+}
+
+func Test_progressWriter(t *testing.T) {
+	var log bytes.Buffer
+	got := []Progress{}
+	w := &progressWriter{w: &log, report: func(p Progress) { got = append(got, p) }}
+	output := "Counting objects:  50% (1/2)\rCounting objects: 100% (2/2)\rCounting obj" + "ects: 100% (2/2), done.\nTotal 2\n"
+	for _, chunk := range []string{output[:20], output[20:70], output[70:]} {
+		w.Write([]byte(chunk))
+	}
+	if log.String() != output {
+		t.Errorf("Log = %q, want %q", log.String(), output)
+	}
+	if len(got) != 3 || got[0].Percent != 50 || !got[2].Done {
+		t.Errorf("Progress = %+v, want 3 updates ending with done", got)
+	}
+}
+
+func TestManager_PushMirror_progress(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	m := f.add(mgr, "file://"+f.newUpstream("project"), "file://"+f.path("destination", "project.git"))
+	var mu sync.Mutex
+	phases := map[string]bool{}
+	mgr.OnEvent = func(e Event) {
+		if e.Type == EventProgress && e.Mirror == m && e.Op == OpPush {
+			mu.Lock()
+			phases[e.Progress.Phase] = true
+			mu.Unlock()
+		}
+	}
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	if !phases["Writing objects"] {
+		t.Errorf("Progress phases = %v, want Writing objects", phases)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactedMask replaces the secrets removed by Redact.
+const redactedMask = "***"
+
+// minSecretLength is the length below which AddSecret ignores values, so
+// that short, common strings aren't masked everywhere.
+const minSecretLength = 4
+
+var (
+	// urlUserinfo matches the scheme and userinfo of URLs
+	urlUserinfo = regexp.MustCompile(`\b([a-zA-Z][a-zA-Z0-9+.-]*://)([^/\s@'"]+)@`)
+
+	// tokenPatterns match well-known access token formats. The first
+	// group, if any, is kept.
+	tokenPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+		regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),
+		regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`),
+		regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),
+		regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+		regexp.MustCompile(`(?i)\b(authorization:\s*(?:basic|bearer|token)\s+)\S+`),
+	}
+)
+
+// redactions holds the secrets registered with AddSecret and the
+// patterns registered with AddRedactPattern.
+var redactions struct {
+	sync.RWMutex
+	secrets  []string
+	patterns []*regexp.Regexp
+}
+
+// AddSecret makes Redact mask value, such as a token or a password read
+// from the environment. gomir registers the secrets it reads itself.
+func AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, s := range redactions.secrets {
+		if s == value {
+			return
+		}
+	}
+	redactions.secrets = append(redactions.secrets, value)
+	// Mask longer secrets first, in case one contains another
+	sort.Slice(redactions.secrets, func(i, j int) bool {
+		return len(redactions.secrets[i]) > len(redactions.secrets[j])
+	})
+}
+
+// AddRedactPattern makes Redact mask the matches of the regular
+// expression pattern.
+func AddRedactPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, p := range redactions.patterns {
+		if p.String() == re.String() {
+			// Added by an earlier load of the config
+			return nil
+		}
+	}
+	redactions.patterns = append(redactions.patterns, re)
+	return nil
+}
+
+// Redact masks the secrets in s: the userinfo of URLs, well-known access
+// token formats, and the secrets and patterns registered with AddSecret
+// and AddRedactPattern. Usernames of URLs without a password are kept,
+// except for http, where the username may be a token.
+func Redact(s string) string {
+	s = urlUserinfo.ReplaceAllStringFunc(s, func(match string) string {
+		parts := urlUserinfo.FindStringSubmatch(match)
+		scheme, userinfo := parts[1], parts[2]
+		if i := strings.Index(userinfo, ":"); i >= 0 {
+			return scheme + userinfo[:i+1] + redactedMask + "@"
+		}
+		if strings.HasPrefix(strings.ToLower(scheme), "http") {
+			return scheme + redactedMask + "@"
+		}
+		return match
+	})
+
+	for _, re := range tokenPatterns {
+		s = redactPattern(re, s)
+	}
+
+	redactions.RLock()
+	defer redactions.RUnlock()
+	for _, re := range redactions.patterns {
+		s = redactPattern(re, s)
+	}
+	for _, secret := range redactions.secrets {
+		s = strings.Replace(s, secret, redactedMask, -1)
+	}
+	return s
+}
+
+// redactPattern masks the matches of re in s, keeping the first group if
+// re has one.
+func redactPattern(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() > 0 {
+		return re.ReplaceAllString(s, "${1}"+redactedMask)
+	}
+	return re.ReplaceAllLiteralString(s, redactedMask)
+}
+
+// redactedError masks the secrets in the message of an error. Cause and
+// Unwrap still return the original error, for inspecting its type.
+type redactedError struct {
+	err error
+}
+
+// redactError returns err with its message redacted, or nil if err is
+// nil.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*redactedError); ok {
+		return err
+	}
+	return &redactedError{err: err}
+}
+
+func (e *redactedError) Error() string {
+	return Redact(e.err.Error())
+}
+
+func (e *redactedError) Cause() error {
+	return e.err
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Format redacts the stack traces printed by %+v too.
+func (e *redactedError) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') {
+		io.WriteString(s, Redact(fmt.Sprintf("%+v", e.err)))
+		return
+	}
+	io.WriteString(s, e.Error())
+}
+
+// maxRedactLine is how much output redactWriter buffers while waiting
+// for the end of a line.
+const maxRedactLine = 64 * 1024
+
+// redactWriter redacts what is written to it line by line, so that
+// secrets split across writes are still masked. Lines end with a newline
+// or, for git's progress output, a carriage return. It is safe for
+// concurrent use, since git's stdout and stderr may share a log.
+type redactWriter struct {
+	w io.Writer
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newRedactWriter(w io.Writer) *redactWriter {
+	return &redactWriter{w: w}
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	rw.buf = append(rw.buf, p...)
+	end := bytes.LastIndexAny(rw.buf, "\r\n") + 1
+	if end == 0 && len(rw.buf) > maxRedactLine {
+		end = len(rw.buf)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+
+	_, err := io.WriteString(rw.w, Redact(string(rw.buf[:end])))
+	rw.buf = append(rw.buf[:0], rw.buf[end:]...)
+	return len(p), err
+}
+
+// Close writes the rest of an unfinished line, and closes the underlying
+// writer if it is a Closer.
+func (rw *redactWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	var err error
+	if len(rw.buf) > 0 {
+		_, err = io.WriteString(rw.w, Redact(string(rw.buf)))
+		rw.buf = nil
+	}
+	if c, ok := rw.w.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// pushedRefsName is the file in a mirror's git directory recording the
+// refs as of the last successful push to all destinations. A destination
+// pushed to on its own, and so ahead of the others, has its refs recorded
+// in pushedRefsName-<destination> until they catch up.
+const pushedRefsName = "gomir-pushed-refs"
+
+// RefChange describes a ref that moved. Old is empty for a new ref and
+// New is empty for a deleted one.
+type RefChange struct {
+	Ref string `json:"ref"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// readRefs returns the refs of the repository at gitDir mapped to the
+// objects they point to. A missing repository has no refs.
+func readRefs(gitDir string) (map[string]string, error) {
+	refs := map[string]string{}
+	repo, err := gogit.PlainOpen(gitDir)
+	if err == gogit.ErrRepositoryNotExists {
+		return refs, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error opening mirror")
+	}
+
+	iter, err := repo.References()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing refs")
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), "refs/") {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return refs, errors.Wrap(err, "Error listing refs")
+}
+
+// diffRefs returns the refs that differ between before and after, sorted
+// by name.
+func diffRefs(before, after map[string]string) []RefChange {
+	changes := []RefChange{}
+	for ref, old := range before {
+		if after[ref] != old {
+			changes = append(changes, RefChange{Ref: ref, Old: old, New: after[ref]})
+		}
+	}
+	for ref, hash := range after {
+		if _, ok := before[ref]; !ok {
+			changes = append(changes, RefChange{Ref: ref, New: hash})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Ref < changes[j].Ref })
+	return changes
+}
+
+// PushedRefs returns the mirror's refs as of its last successful push to
+// all destinations, or nil if it was never pushed.
+func (m *Mirror) PushedRefs() (map[string]string, error) {
+	return m.readPushedRefs(pushedRefsName)
+}
+
+// destinationPushedRefs returns the mirror's refs as of its last
+// successful push to the destination name.
+func (m *Mirror) destinationPushedRefs(name string) (map[string]string, error) {
+	refs, err := m.readPushedRefs(pushedRefsName + "-" + name)
+	if refs == nil && err == nil {
+		return m.PushedRefs()
+	}
+	return refs, err
+}
+
+func (m *Mirror) readPushedRefs(file string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(m.GitDir, file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Error reading pushed refs")
+	}
+
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// setPushedRefs records refs as the mirror's refs as of its last
+// successful push to the destinations pushed, out of all of its
+// destinations. Once all of them received refs, they are recorded for the
+// mirror as a whole.
+func (m *Mirror) setPushedRefs(refs map[string]string, pushed, all []Destination) error {
+	caughtUp := true
+	for _, d := range all {
+		if containsDestination(pushed, d.Name) {
+			continue
+		}
+		current, err := m.destinationPushedRefs(d.Name)
+		if err != nil {
+			return err
+		}
+		if current == nil || !sameRefs(current, refs) {
+			caughtUp = false
+		}
+	}
+
+	if !caughtUp {
+		for _, d := range pushed {
+			if err := m.writePushedRefs(pushedRefsName+"-"+d.Name, refs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := m.writePushedRefs(pushedRefsName, refs); err != nil {
+		return err
+	}
+	ahead, _ := filepath.Glob(filepath.Join(m.GitDir, pushedRefsName+"-*"))
+	for _, name := range ahead {
+		os.Remove(name)
+	}
+	return nil
+}
+
+func containsDestination(dests []Destination, name string) bool {
+	for _, d := range dests {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sameRefs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ref, hash := range a {
+		if other, ok := b[ref]; !ok || other != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// writePushedRefs writes refs to file in the format of packed-refs.
+func (m *Mirror) writePushedRefs(file string, refs map[string]string) error {
+	names := []string{}
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%v %v\n", refs[name], name)
+	}
+	return errors.Wrap(writeFileAtomic(filepath.Join(m.GitDir, file), buf.Bytes()), "Error recording pushed refs")
+}
+
+// history tells the commits of a repository already known, such as those
+// pushed before, from new ones.
+type history struct {
+	repo *gogit.Repository
+
+	// known are the commits reachable from the refs marked known
+	known map[plumbing.Hash]bool
+}
+
+func newHistory(repo *gogit.Repository) *history {
+	return &history{repo: repo, known: map[plumbing.Hash]bool{}}
+}
+
+// peel returns the commit that hash, a commit or tag, points to, or the
+// zero hash for anything else.
+func (h *history) peel(hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := h.repo.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return hash, nil
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(h.repo.Storer, obj)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			hash = tag.Target
+		default:
+			return plumbing.ZeroHash, nil
+		}
+	}
+}
+
+// markKnown marks the commits reachable from hash as known.
+func (h *history) markKnown(hash string) error {
+	tip, err := h.peel(plumbing.NewHash(hash))
+	if err == plumbing.ErrObjectNotFound {
+		// The ref was pushed and has since been rewritten and pruned
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Error reading pushed commits")
+	}
+
+	stack := []plumbing.Hash{tip}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash.IsZero() || h.known[hash] {
+			continue
+		}
+		h.known[hash] = true
+		commit, err := h.repo.CommitObject(hash)
+		if err != nil {
+			continue
+		}
+		stack = append(stack, commit.ParentHashes...)
+	}
+	return nil
+}
+
+// newCommits returns the commits reachable from tip that aren't known,
+// children before their parents. A shallow repository lacks the parents
+// of its oldest commits.
+func (h *history) newCommits(tip plumbing.Hash) ([]*object.Commit, error) {
+	commits := []*object.Commit{}
+	seen := map[plumbing.Hash]bool{}
+	stack := []plumbing.Hash{tip}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash.IsZero() || seen[hash] || h.known[hash] {
+			continue
+		}
+		seen[hash] = true
+		commit, err := h.repo.CommitObject(hash)
+		if err == plumbing.ErrObjectNotFound && hash != tip {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+		stack = append(stack, commit.ParentHashes...)
+	}
+	return commits, nil
+}
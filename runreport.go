@@ -0,0 +1,195 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runReportLogLines is how many lines of a failed mirror's log a run
+// report includes.
+const runReportLogLines = 40
+
+// RunReport describes a fetch or push run and the outcome for each
+// mirror, for archiving as a self-contained HTML file.
+type RunReport struct {
+	Op       Operation
+	Started  time.Time
+	Duration time.Duration
+	Total    int
+	Failed   int
+	Mirrors  []MirrorResult
+}
+
+// MirrorResult is the outcome of a run for a single mirror.
+type MirrorResult struct {
+	Mirror   string
+	Started  time.Time
+	Duration time.Duration
+
+	// Error is set if the mirror failed, and LogTail then holds the last
+	// lines of its log
+	Error   string
+	LogTail string
+
+	// Refs are the refs the run changed, see Result
+	Refs []RefChange
+}
+
+// NewRunReport describes the run of op started at started, with results.
+func NewRunReport(op Operation, started time.Time, results Results) *RunReport {
+	r := &RunReport{
+		Op:       op,
+		Started:  started,
+		Duration: time.Since(started),
+		Total:    len(results),
+		Mirrors:  []MirrorResult{},
+	}
+	for _, result := range results {
+		m := MirrorResult{
+			Mirror:   result.Mirror.Path,
+			Started:  result.Started,
+			Duration: result.Duration,
+			Refs:     result.Refs,
+		}
+		if result.Err != nil {
+			r.Failed++
+			m.Error = Redact(result.Err.Error())
+			m.LogTail = readLogTail(result.Mirror, runReportLogLines)
+		}
+		r.Mirrors = append(r.Mirrors, m)
+	}
+	sort.Slice(r.Mirrors, func(i, j int) bool { return r.Mirrors[i].Mirror < r.Mirrors[j].Mirror })
+	return r
+}
+
+// WriteHTML writes the report as an HTML page without external
+// resources, whose table sorts by the column clicked.
+func (r *RunReport) WriteHTML(w io.Writer) error {
+	return runReportTemplate.Execute(w, r)
+}
+
+// reportRun writes the HTML report of a run to RunReportDir, if set,
+// warning about errors.
+func (mgr *Manager) reportRun(op Operation, started time.Time, results Results) {
+	if mgr.RunReportDir == "" {
+		return
+	}
+	dir := mgr.RunReportDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(mgr.Root, dir)
+	}
+	name := fmt.Sprintf("%v-%v", op, started.Format("20060102-150405"))
+	if err := writeRunReport(dir, name, NewRunReport(op, started, results)); err != nil {
+		mgr.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Error writing run report: %v", err)})
+	}
+}
+
+// writeRunReport writes report to dir as name.html, or name-2.html and
+// so on if runs started in the same second.
+func writeRunReport(dir, name string, report *RunReport) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Error creating run report directory")
+	}
+	path := filepath.Join(dir, name+".html")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	for n := 2; os.IsExist(err); n++ {
+		path = filepath.Join(dir, fmt.Sprintf("%v-%v.html", name, n))
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Error writing run report")
+	}
+	if err := report.WriteHTML(f); err != nil {
+		f.Close()
+		return errors.Wrap(err, "Error writing run report")
+	}
+	return errors.Wrap(f.Close(), "Error writing run report")
+}
+
+var runReportTemplate = template.Must(template.New("run").Funcs(template.FuncMap{
+	"time":     func(t time.Time) string { return t.Format(time.RFC1123) },
+	"clock":    func(t time.Time) string { return t.Format("15:04:05") },
+	"duration": func(d time.Duration) string { return d.Round(time.Millisecond).String() },
+	"millis":   func(d time.Duration) int64 { return int64(d / time.Millisecond) },
+	"unix":     func(t time.Time) int64 { return t.Unix() },
+	"describe": describeRefChange,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gomir {{.Op}} {{time .Started}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #eee; cursor: pointer; user-select: none; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+.failed { color: #b00; font-weight: bold; }
+.succeeded { color: #070; }
+pre { background: #f6f6f6; padding: 0.5em; max-width: 60em; overflow-x: auto; }
+ul { margin: 0; padding-left: 1.2em; }
+</style>
+</head>
+<body>
+<h1>gomir {{.Op}}</h1>
+<p>Started {{time .Started}}, took {{duration .Duration}}. {{.Total}} repositories, {{.Failed}} failed.</p>
+<table id="results">
+<thead>
+<tr><th>Repository</th><th>Status</th><th>Started</th><th data-type="number">Duration</th><th data-type="number">Refs changed</th><th>Details</th></tr>
+</thead>
+<tbody>
+{{range .Mirrors}}<tr>
+<td>{{.Mirror}}</td>
+{{if .Error}}<td class="failed">failed</td>{{else}}<td class="succeeded">succeeded</td>{{end}}
+<td data-sort="{{unix .Started}}">{{clock .Started}}</td>
+<td data-sort="{{millis .Duration}}">{{duration .Duration}}</td>
+<td data-sort="{{len .Refs}}">{{if .Refs}}<details><summary>{{len .Refs}}</summary><ul>{{range .Refs}}<li>{{.Ref}} ({{describe .}})</li>{{end}}</ul></details>{{else}}0{{end}}</td>
+<td>{{if .Error}}{{.Error}}{{if .LogTail}}<details><summary>Log</summary><pre>{{.LogTail}}</pre></details>{{end}}{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+(function() {
+	var table = document.getElementById("results");
+	var headers = table.tHead.rows[0].cells;
+	for (var i = 0; i < headers.length; i++) {
+		headers[i].addEventListener("click", sortBy.bind(null, i));
+	}
+	function key(row, col) {
+		var cell = row.cells[col];
+		return cell.hasAttribute("data-sort") ? cell.getAttribute("data-sort") : cell.textContent.trim();
+	}
+	function sortBy(col) {
+		var th = headers[col];
+		var asc = !th.classList.contains("asc");
+		var numeric = th.getAttribute("data-type") === "number";
+		for (var i = 0; i < headers.length; i++) {
+			headers[i].classList.remove("asc", "desc");
+		}
+		th.classList.add(asc ? "asc" : "desc");
+		var body = table.tBodies[0];
+		var rows = Array.prototype.slice.call(body.rows);
+		rows.sort(function(a, b) {
+			var x = key(a, col), y = key(b, col);
+			var c = numeric ? x - y : x.localeCompare(y);
+			return asc ? c : -c;
+		});
+		rows.forEach(function(row) { body.appendChild(row); });
+	}
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,95 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManager_runReport(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	good, err := mgr.Add("file://"+f.newUpstream("good"), "file://"+f.path("destination", "good.git"), "good", MirrorOptions{})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	bad, err := mgr.Add("file://"+f.newUpstream("bad"), f.unreachableURL(), "bad", MirrorOptions{})
+	if err != nil {
+		t.Fatalf("Add() error = %+v", err)
+	}
+	mgr.RunReportDir = "reports"
+
+	f.commit(f.path("upstream", "good"), "Update")
+	results, err := mgr.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() error = %+v", err)
+	}
+	for _, r := range results {
+		want := 0
+		if r.Mirror.Path == good.Path {
+			want = 1
+		}
+		if len(r.Refs) != want {
+			t.Errorf("Fetch() refs of %v = %+v, want %v changes", r.Mirror, r.Refs, want)
+		}
+	}
+	if _, err := mgr.Push(); err != nil {
+		t.Fatalf("Push() error = %+v", err)
+	}
+
+	reports := map[Operation]string{}
+	names, _ := filepath.Glob(f.path("mirrors", "reports", "*.html"))
+	for _, name := range names {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := Operation(strings.SplitN(filepath.Base(name), "-", 2)[0])
+		reports[op] = string(content)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Run reports = %v, want a fetch and a push report", names)
+	}
+
+	for _, want := range []string{"<h1>gomir fetch</h1>", "2 repositories, 0 failed", "<li>refs/heads/master (moved "} {
+		if !strings.Contains(reports[OpFetch], want) {
+			t.Errorf("Fetch report lacks %q:\n%v", want, reports[OpFetch])
+		}
+	}
+	for _, want := range []string{
+		"2 repositories, 1 failed",
+		"<td>" + bad.Path + "</td>\n<td class=\"failed\">failed</td>",
+		"<td>" + good.Path + "</td>\n<td class=\"succeeded\">succeeded</td>",
+		"<details><summary>Log</summary><pre>",
+		"<li>refs/tags/v1.0 (new)</li>",
+	} {
+		if !strings.Contains(reports[OpPush], want) {
+			t.Errorf("Push report lacks %q:\n%v", want, reports[OpPush])
+		}
+	}
+	if strings.Contains(reports[OpPush], "src=") || strings.Contains(reports[OpPush], "href=") {
+		t.Errorf("Push report refers to external resources")
+	}
+}
+
+func Test_writeRunReport_sameSecond(t *testing.T) {
+	f := newFixture(t)
+	for i := 0; i < 3; i++ {
+		if err := writeRunReport(f.path("reports"), "push-20170601-150405", &RunReport{Op: OpPush}); err != nil {
+			t.Fatalf("writeRunReport() error = %+v", err)
+		}
+	}
+	names, _ := filepath.Glob(f.path("reports", "*.html"))
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	want := "push-20170601-150405-2.html push-20170601-150405-3.html push-20170601-150405.html"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("Reports = %v, want %v", got, want)
+	}
+}
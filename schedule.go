@@ -0,0 +1,152 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule decides when the daemon runs an operation.
+type Schedule interface {
+	// Next returns the first time after t the operation should run.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses a schedule, either an interval such as "6h30m" or
+// a cron expression with five fields (minute, hour, day of month, month,
+// day of week) such as "0 */6 * * 1-5". Cron fields accept "*", numbers,
+// ranges, lists and steps; times are in the local time zone.
+func ParseSchedule(s string) (Schedule, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return nil, errors.Errorf("Invalid schedule %#v: the interval must be positive", s)
+		}
+		return intervalSchedule(d), nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("Invalid schedule %#v: want an interval or a cron expression with 5 fields", s)
+	}
+
+	var cs cronSchedule
+	var err error
+	for i, spec := range []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&cs.minute, 0, 59},
+		{&cs.hour, 0, 23},
+		{&cs.dom, 1, 31},
+		{&cs.month, 1, 12},
+		{&cs.dow, 0, 7},
+	} {
+		if *spec.field, err = parseCronField(fields[i], spec.min, spec.max); err != nil {
+			return nil, errors.Wrapf(err, "Invalid schedule %#v", s)
+		}
+	}
+
+	// Both 0 and 7 are Sunday
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.anyDom = fields[2] == "*"
+	cs.anyDow = fields[4] == "*"
+	return cs, nil
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule holds the values allowed for each field as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// maxCronSearch bounds the search for the next match of expressions
+// that never match, such as "0 0 31 2 *".
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxCronSearch)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches follows cron: if both the day of month and the day of week
+// are restricted, matching either is enough.
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseCronField parses a comma separated list of "*", "n", "n-m", each
+// optionally followed by "/step", into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step in %#v", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("invalid value in %#v", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("invalid range in %#v", part)
+				}
+			} else if step > 1 {
+				// "n/step" runs from n to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Errorf("%#v is outside %v-%v", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2017, time.June, 7, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		schedule string
+		want     time.Time
+		wantErr  bool
+	}{
+		{"6h", from.Add(6 * time.Hour), false},
+		{"1h30m", from.Add(90 * time.Minute), false},
+		{"* * * * *", time.Date(2017, time.June, 7, 10, 31, 0, 0, time.UTC), false},
+		{"0 * * * *", time.Date(2017, time.June, 7, 11, 0, 0, 0, time.UTC), false},
+		{"*/20 * * * *", time.Date(2017, time.June, 7, 10, 40, 0, 0, time.UTC), false},
+		{"15 2 * * *", time.Date(2017, time.June, 8, 2, 15, 0, 0, time.UTC), false},
+		{"0 0,12 * * *", time.Date(2017, time.June, 7, 12, 0, 0, 0, time.UTC), false},
+		{"0 9-17/4 * * *", time.Date(2017, time.June, 7, 13, 0, 0, 0, time.UTC), false},
+		{"0 0 * * 0", time.Date(2017, time.June, 11, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 * * 7", time.Date(2017, time.June, 11, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 1 * *", time.Date(2017, time.July, 1, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 1 * 5", time.Date(2017, time.June, 9, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 31 2 *", time.Time{}, false},
+		{"", time.Time{}, true},
+		{"-1h", time.Time{}, true},
+		{"0 0 * *", time.Time{}, true},
+		{"60 * * * *", time.Time{}, true},
+		{"* 5-1 * * *", time.Time{}, true},
+		{"*/0 * * * *", time.Time{}, true},
+		{"a * * * *", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			sched, err := ParseSchedule(tt.schedule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := sched.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// secretRulePrefix starts the Violation.Rule of secrets, followed by the
+// ID of the rule that found them.
+const secretRulePrefix = "secrets."
+
+// SecretRule finds a kind of secret in files.
+type SecretRule struct {
+	// ID names the rule in findings and allowlists, such as
+	// "aws-access-key-id"
+	ID string
+
+	// Description describes the secrets found, such as "AWS access key
+	// ID"
+	Description string
+
+	// Pattern is the regular expression matching the secret. If it has
+	// a group, the first group is the secret.
+	Pattern string
+
+	// Entropy, if positive, is the minimum Shannon entropy of the
+	// secret, in bits per character, which tells random tokens from
+	// placeholders such as "changeme"
+	Entropy float64
+}
+
+// DefaultSecretRules are the rules of SecretScan, in addition to those
+// configured.
+var DefaultSecretRules = []SecretRule{
+	{ID: "private-key", Description: "private key", Pattern: `-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`},
+	{ID: "aws-access-key-id", Description: "AWS access key ID", Pattern: `\b((?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA)[0-9A-Z]{16})\b`},
+	{ID: "aws-secret-access-key", Description: "AWS secret access key", Pattern: `(?i)aws.{0,20}?(?:secret|key).{0,20}?[=:]\s*["']?([A-Za-z0-9/+]{40})\b`, Entropy: 4},
+	{ID: "github-token", Description: "GitHub token", Pattern: `\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`},
+	{ID: "gitlab-token", Description: "GitLab token", Pattern: `\b(glpat-[A-Za-z0-9_-]{20,})`},
+	{ID: "slack-token", Description: "Slack token", Pattern: `\b(xox[abposr]-[A-Za-z0-9-]{10,})`},
+	{ID: "generic-secret", Description: "password or token", Pattern: `(?i)(?:password|passwd|secret|token|api[_-]?key)["']?\s*[:=]\s*["']?([^\s"']{12,})`, Entropy: 3.5},
+}
+
+// SecretScan scans the files that pushes send for secrets such as
+// credentials and private keys, see Policy.
+type SecretScan struct {
+	// Enabled turns the scan on (scan)
+	Enabled bool
+
+	// Rules find secrets besides DefaultSecretRules, from the root's
+	// [secrets "<id>"] sections
+	Rules []SecretRule
+
+	// Allowlist is a file of findings, files and values to ignore
+	// (allowlist), see readAllowlist
+	Allowlist string
+
+	// Action is what happens to refs with secrets (action), warn by
+	// default
+	Action PolicyAction
+
+	// enabledSet is set if Enabled was configured, so that a mirror may
+	// turn off the root's scan
+	enabledSet bool
+}
+
+// merge returns the scan with the settings of other, a mirror's, applied.
+func (s SecretScan) merge(other SecretScan) SecretScan {
+	if other.enabledSet {
+		s.Enabled = other.Enabled
+	}
+	if other.Allowlist != "" {
+		s.Allowlist = other.Allowlist
+	}
+	if other.Action != "" {
+		s.Action = other.Action
+	}
+	return s
+}
+
+// readSecretScan reads the secrets settings in options. Rules are only
+// read from the subsections of section, the secrets section of the root's
+// gomir.config.
+func readSecretScan(section *formatconfig.Section, options formatconfig.Options) (s SecretScan, err error) {
+	s = SecretScan{
+		Allowlist: options.Get("allowlist"),
+		Action:    PolicyAction(options.Get("action")),
+	}
+	if scan := options.Get("scan"); scan != "" {
+		if s.Enabled, err = strconv.ParseBool(scan); err != nil {
+			return s, errors.Errorf("Invalid secrets.scan %#v, expected true or false", scan)
+		}
+		s.enabledSet = true
+	}
+	if err := validatePolicyAction("secrets", s.Action); err != nil {
+		return s, err
+	}
+
+	if section == nil {
+		return s, nil
+	}
+	for _, sub := range section.Subsections {
+		rule := SecretRule{
+			ID:          sub.Name,
+			Description: sub.Option("description"),
+			Pattern:     sub.Option("pattern"),
+		}
+		if rule.Description == "" {
+			rule.Description = rule.ID
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil || rule.Pattern == "" {
+			return s, errors.Errorf("Invalid pattern %#v for secrets rule %v", rule.Pattern, rule.ID)
+		}
+		if entropy := sub.Option("entropy"); entropy != "" {
+			if rule.Entropy, err = strconv.ParseFloat(entropy, 64); err != nil || rule.Entropy < 0 {
+				return s, errors.Errorf("Invalid entropy %#v for secrets rule %v", entropy, rule.ID)
+			}
+		}
+		s.Rules = append(s.Rules, rule)
+	}
+	return s, nil
+}
+
+// secretScanner finds secrets in the contents of files.
+type secretScanner struct {
+	rules []compiledSecretRule
+	allow *allowlist
+}
+
+type compiledSecretRule struct {
+	SecretRule
+	re *regexp.Regexp
+}
+
+// newSecretScanner returns a scanner for s, or nil if s is disabled.
+func newSecretScanner(s SecretScan) (*secretScanner, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+	allow, err := readAllowlist(s.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	scanner := &secretScanner{allow: allow}
+	for _, rule := range append(append([]SecretRule{}, DefaultSecretRules...), s.Rules...) {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid pattern for secrets rule %v", rule.ID)
+		}
+		scanner.rules = append(scanner.rules, compiledSecretRule{SecretRule: rule, re: re})
+	}
+	return scanner, nil
+}
+
+// scanLine returns the secrets in line n, at most one per rule. The
+// secrets themselves are left out of the violations.
+func (s *secretScanner) scanLine(n int, line []byte) []Violation {
+	violations := []Violation{}
+	for _, rule := range s.rules {
+		for _, match := range rule.re.FindAllSubmatch(line, -1) {
+			secret := match[0]
+			if len(match) > 1 && match[1] != nil {
+				secret = match[1]
+			}
+			if rule.Entropy > 0 && entropy(secret) < rule.Entropy {
+				continue
+			}
+			if s.allow.value(secret) {
+				continue
+			}
+			violations = append(violations, Violation{
+				Line:   n,
+				Rule:   secretRulePrefix + rule.ID,
+				Detail: "possible " + rule.Description,
+			})
+			break
+		}
+	}
+	return violations
+}
+
+// entropy returns the Shannon entropy of s, in bits per character.
+func entropy(s []byte) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	counts := map[byte]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	e := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// allowlist holds the secrets to ignore, read from a file with one entry
+// per line:
+//
+//	# Findings, as printed in reports: <commit>:<path>:<rule>
+//	3f2a9c1e...:config/test.env:secrets.generic-secret
+//	# Files that are never scanned, as in Policy.ForbidPaths
+//	path testdata/**
+//	# Secret values to ignore, as regular expressions
+//	value ^AKIA[0-9A-Z]*EXAMPLE$
+type allowlist struct {
+	findings map[string]bool
+	paths    []string
+	values   []*regexp.Regexp
+}
+
+func readAllowlist(name string) (*allowlist, error) {
+	allow := &allowlist{findings: map[string]bool{}}
+	if name == "" {
+		return allow, nil
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading secrets allowlist")
+	}
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "path "):
+			allow.paths = append(allow.paths, strings.TrimSpace(strings.TrimPrefix(line, "path ")))
+		case strings.HasPrefix(line, "value "):
+			re, err := regexp.Compile(strings.TrimSpace(strings.TrimPrefix(line, "value ")))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid value on line %v of %v", n+1, name)
+			}
+			allow.values = append(allow.values, re)
+		case strings.Count(line, ":") >= 2:
+			allow.findings[line] = true
+		default:
+			return nil, errors.Errorf("Invalid line %v of %v, expected <commit>:<path>:<rule>, path <pattern> or value <regexp>", n+1, name)
+		}
+	}
+	return allow, nil
+}
+
+// path reports whether the file name is never scanned.
+func (a *allowlist) path(name string) bool {
+	for _, pattern := range a.paths {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// value reports whether secret is to be ignored.
+func (a *allowlist) value(secret []byte) bool {
+	for _, re := range a.values {
+		if re.Match(secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// finding reports whether the finding v is to be ignored.
+func (a *allowlist) finding(v Violation) bool {
+	return a.findings[v.Fingerprint()]
+}
+
+// Fingerprint identifies the violation in secrets allowlists.
+func (v Violation) Fingerprint() string {
+	return fmt.Sprintf("%v:%v:%v", v.Commit, v.Path, v.Rule)
+}
+
+// isSecret reports whether the violation is a secret found by a
+// SecretScan.
+func (v Violation) isSecret() bool {
+	return strings.HasPrefix(v.Rule, secretRulePrefix)
+}
@@ -0,0 +1,494 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5/plumbing"
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// signatureRulePrefix starts the Violation.Rule of unsigned and untrusted
+// tags and commits.
+const signatureRulePrefix = "signatures."
+
+// sshSignatureNamespace is the namespace of the SSH signatures git makes.
+const sshSignatureNamespace = "git"
+
+// SignaturePolicy requires new tags and the new commits of protected
+// branches to be signed by trusted keys, see Policy. Commits and tags may
+// be signed with GPG, verified against GPGKeyring, or with SSH keys,
+// verified against AllowedSigners.
+type SignaturePolicy struct {
+	// Tags requires new and moved tags to be signed annotated tags
+	// (tags)
+	Tags bool
+
+	// Branches are the protected branches, whose new commits must be
+	// signed, by name or pattern such as main or release/* (branch, may
+	// be repeated)
+	Branches []string
+
+	// GPGKeyring is a file of the trusted GPG public keys, as exported
+	// by `gpg --export --armor` (gpgKeyring)
+	GPGKeyring string
+
+	// AllowedSigners is a file of the trusted SSH public keys, in the
+	// format of git's gpg.ssh.allowedSignersFile (allowedSigners)
+	AllowedSigners string
+
+	// Action is what happens to refs with unsigned or untrusted tags
+	// and commits (action), block by default
+	Action PolicyAction
+
+	// tagsSet is set if Tags was configured, so that a mirror may turn
+	// off the root's requirement
+	tagsSet bool
+}
+
+// IsZero reports whether the policy requires no signatures.
+func (s SignaturePolicy) IsZero() bool {
+	return !s.Tags && len(s.Branches) == 0
+}
+
+// merge returns the policy with the settings of other, a mirror's,
+// applied. A mirror's protected branches replace the root's.
+func (s SignaturePolicy) merge(other SignaturePolicy) SignaturePolicy {
+	if other.tagsSet {
+		s.Tags = other.Tags
+	}
+	if len(other.Branches) > 0 {
+		s.Branches = other.Branches
+	}
+	if other.GPGKeyring != "" {
+		s.GPGKeyring = other.GPGKeyring
+	}
+	if other.AllowedSigners != "" {
+		s.AllowedSigners = other.AllowedSigners
+	}
+	if other.Action != "" {
+		s.Action = other.Action
+	}
+	return s
+}
+
+// protects reports whether the ref name is a protected branch.
+func (s SignaturePolicy) protects(name string) bool {
+	if !strings.HasPrefix(name, "refs/heads/") {
+		return false
+	}
+	for _, pattern := range s.Branches {
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "refs/heads/"), strings.TrimPrefix(name, "refs/heads/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func readSignaturePolicy(options formatconfig.Options) (SignaturePolicy, error) {
+	s := SignaturePolicy{
+		Branches:       options.GetAll("branch"),
+		GPGKeyring:     options.Get("gpgKeyring"),
+		AllowedSigners: options.Get("allowedSigners"),
+		Action:         PolicyAction(options.Get("action")),
+	}
+	if tags := options.Get("tags"); tags != "" {
+		var err error
+		if s.Tags, err = strconv.ParseBool(tags); err != nil {
+			return s, errors.Errorf("Invalid signatures.tags %#v, expected true or false", tags)
+		}
+		s.tagsSet = true
+	}
+	if err := validatePolicyAction("signatures", s.Action); err != nil {
+		return s, err
+	}
+	for _, pattern := range s.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return s, errors.Errorf("Invalid signatures.branch %#v", pattern)
+		}
+	}
+	return s, nil
+}
+
+// signatureVerifier verifies the signatures of tags and commits against
+// the trusted keys of a SignaturePolicy.
+type signatureVerifier struct {
+	keyring openpgp.EntityList
+	signers []allowedSigner
+}
+
+// allowedSigner is an entry of an allowed signers file.
+type allowedSigner struct {
+	principals  string
+	namespaces  []string
+	validAfter  time.Time
+	validBefore time.Time
+	key         ssh.PublicKey
+}
+
+// allows reports whether the signer may sign as the email address at the
+// given time. Like ssh-keygen, it matches the email against the
+// comma-separated principal patterns, where a pattern starting with !
+// excludes the addresses it matches.
+func (s allowedSigner) allows(email string, when time.Time) bool {
+	if !s.validAfter.IsZero() && when.Before(s.validAfter) {
+		return false
+	}
+	if !s.validBefore.IsZero() && !when.Before(s.validBefore) {
+		return false
+	}
+	matched := false
+	for _, pattern := range strings.Split(s.principals, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), strings.ToLower(email)); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// parseSignerTime parses the time of a valid-after or valid-before
+// option, YYYYMMDD[HHMM[SS]] in local time, or in UTC with a Z suffix.
+func parseSignerTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, location = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, location)
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid time %#v", value)
+}
+
+func newSignatureVerifier(s SignaturePolicy) (*signatureVerifier, error) {
+	v := &signatureVerifier{}
+	if s.GPGKeyring != "" {
+		f, err := os.Open(s.GPGKeyring)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading GPG keyring")
+		}
+		defer f.Close()
+		if v.keyring, err = openpgp.ReadArmoredKeyRing(f); err != nil {
+			return nil, errors.Wrapf(err, "Error reading GPG keyring %v", s.GPGKeyring)
+		}
+	}
+	if s.AllowedSigners != "" {
+		var err error
+		if v.signers, err = readAllowedSigners(s.AllowedSigners); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// readAllowedSigners reads an allowed signers file, with lines such as:
+//
+//	alice@example.com,alice@example.org namespaces="git" ssh-ed25519 AAAAC3Nza...
+func readAllowedSigners(name string) ([]allowedSigner, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading allowed signers")
+	}
+	signers := []allowedSigner{}
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("Invalid line %v of %v, expected principals and a public key", n+1, name)
+		}
+		// The rest of the line is in the format of authorized_keys
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid line %v of %v", n+1, name)
+		}
+		signer := allowedSigner{principals: fields[0], key: key}
+		for _, option := range options {
+			opt, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				opt, value = option[:i], strings.Trim(option[i+1:], `"`)
+			}
+			switch strings.ToLower(opt) {
+			case "namespaces":
+				signer.namespaces = strings.Split(value, ",")
+			case "valid-after":
+				signer.validAfter, err = parseSignerTime(value)
+			case "valid-before":
+				signer.validBefore, err = parseSignerTime(value)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid %v on line %v of %v", opt, n+1, name)
+			}
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// verify checks signature, a GPG or SSH signature of payload made by
+// identity, the committer or tagger, and returns who made it. GPG keys
+// must have an identity with the identity's email, and SSH keys must be
+// allowed to sign as it when it signed.
+func (v *signatureVerifier) verify(signature string, payload []byte, identity object.Signature) (string, error) {
+	switch {
+	case signature == "":
+		return "", errors.New("not signed")
+	case strings.HasPrefix(signature, "-----BEGIN PGP SIGNATURE-----"):
+		if len(v.keyring) == 0 {
+			return "", errors.New("signed with GPG, but no gpgKeyring is configured")
+		}
+		entity, err := openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(payload), strings.NewReader(signature), nil)
+		if err != nil {
+			return "", errors.Wrap(err, "untrusted GPG signature")
+		}
+		if !hasEmail(entity, identity.Email) {
+			return "", errors.Errorf("signed by GPG key %X, which has no identity %v", entity.PrimaryKey.Fingerprint, identity.Email)
+		}
+		if id := entity.PrimaryIdentity(); id != nil {
+			return id.Name, nil
+		}
+		return fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint), nil
+	case strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----"):
+		if len(v.signers) == 0 {
+			return "", errors.New("signed with SSH, but no allowedSigners are configured")
+		}
+		return v.verifySSH(signature, payload, identity)
+	}
+	return "", errors.New("signed in an unsupported format")
+}
+
+// sshSignature is an SSH signature, after its magic preamble, as described
+// in OpenSSH's PROTOCOL.sshsig.
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is what an SSH signature signs.
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+const sshSignatureMagic = "SSHSIG"
+
+func (v *signatureVerifier) verifySSH(armored string, payload []byte, identity object.Signature) (string, error) {
+	body := strings.TrimSpace(armored)
+	body = strings.TrimPrefix(body, "-----BEGIN SSH SIGNATURE-----")
+	body = strings.TrimSuffix(body, "-----END SSH SIGNATURE-----")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil || !bytes.HasPrefix(blob, []byte(sshSignatureMagic)) {
+		return "", errors.New("invalid SSH signature")
+	}
+	var sig sshSignature
+	if err := ssh.Unmarshal(blob[len(sshSignatureMagic):], &sig); err != nil || sig.Version != 1 {
+		return "", errors.New("invalid SSH signature")
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return "", errors.Errorf("SSH signature for namespace %#v, not git", sig.Namespace)
+	}
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid SSH signature")
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", errors.Errorf("SSH signature with unsupported hash %v", sig.HashAlgorithm)
+	}
+	h.Write(payload)
+	signed := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return "", errors.New("invalid SSH signature")
+	}
+	if err := key.Verify(signed, &signature); err != nil {
+		return "", errors.Wrap(err, "bad SSH signature")
+	}
+
+	trusted := false
+	for _, signer := range v.signers {
+		if !bytes.Equal(signer.key.Marshal(), key.Marshal()) {
+			continue
+		}
+		if len(signer.namespaces) > 0 && !containsString(signer.namespaces, sshSignatureNamespace) {
+			continue
+		}
+		trusted = true
+		if signer.allows(identity.Email, identity.When) {
+			return identity.Email, nil
+		}
+	}
+	if trusted {
+		return "", errors.Errorf("signed by SSH key %v, which may not sign as %v at %v", ssh.FingerprintSHA256(key), identity.Email, identity.When.Format(time.RFC3339))
+	}
+	return "", errors.Errorf("untrusted SSH key %v", ssh.FingerprintSHA256(key))
+}
+
+// hasEmail reports whether one of the identities of the GPG key entity
+// has the email address.
+func hasEmail(entity *openpgp.Entity, email string) bool {
+	for _, id := range entity.Identities {
+		if id.UserId != nil && strings.EqualFold(id.UserId.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// signedObject is a commit or tag that may be signed.
+type signedObject interface {
+	EncodeWithoutSignature(plumbing.EncodedObject) error
+}
+
+// payload returns what the signature of obj signs.
+func payload(obj signedObject) ([]byte, error) {
+	encoded := &plumbing.MemoryObject{}
+	if err := obj.EncodeWithoutSignature(encoded); err != nil {
+		return nil, err
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// checkSignatures returns the violations of the signature policy in the
+// ref change: an unsigned or untrusted tag, or the unsigned or untrusted
+// new commits of a protected branch.
+func (c *policyChecker) checkSignatures(change RefChange) ([]Violation, error) {
+	s := c.policy.Signatures
+	switch {
+	case change.New == "":
+		return nil, nil
+	case strings.HasPrefix(change.Ref, "refs/tags/") && s.Tags:
+		return c.checkTagSignature(change)
+	case s.protects(change.Ref):
+		return c.checkCommitSignatures(change)
+	}
+	return nil, nil
+}
+
+func (c *policyChecker) checkTagSignature(change RefChange) ([]Violation, error) {
+	name := strings.TrimPrefix(change.Ref, "refs/tags/")
+	tag, err := c.repo.TagObject(plumbing.NewHash(change.New))
+	if err == plumbing.ErrObjectNotFound {
+		return []Violation{c.signatureViolation("tag", change.New, "lightweight tag %v can't be signed", name)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	signed, err := payload(tag)
+	if err != nil {
+		return nil, err
+	}
+	if tag.Name != name {
+		return []Violation{c.signatureViolation("tag", change.New, "tag %v is named %v", name, tag.Name)}, nil
+	}
+	signer, err := c.verifier.verify(tag.PGPSignature, signed, tag.Tagger)
+	if err != nil {
+		return []Violation{c.signatureViolation("tag", change.New, "tag %v is %v", name, err)}, nil
+	}
+	fmt.Fprintf(c.log, "Good signature on tag %v by %v\n", name, signer)
+	return nil, nil
+}
+
+func (c *policyChecker) checkCommitSignatures(change RefChange) ([]Violation, error) {
+	tip, err := c.peel(plumbing.NewHash(change.New))
+	if err != nil || tip.IsZero() {
+		return nil, err
+	}
+
+	commits, err := c.newCommits(tip)
+	if err != nil {
+		return nil, err
+	}
+	violations := []Violation{}
+	signers := map[string]bool{}
+	for _, commit := range commits {
+		signed, err := payload(commit)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := c.verifier.verify(commit.PGPSignature, signed, commit.Committer)
+		if err != nil {
+			violations = append(violations, c.signatureViolation("commit", commit.Hash.String(), "commit %v", err))
+			continue
+		}
+		signers[signer] = true
+	}
+
+	if len(commits) > 0 && len(violations) == 0 {
+		names := []string{}
+		for name := range signers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(c.log, "Good signatures on %v new commits of %v by %v\n", len(commits), change.Ref, strings.Join(names, ", "))
+	}
+	return violations, nil
+}
+
+func (c *policyChecker) signatureViolation(kind, hash, format string, args ...interface{}) Violation {
+	v := Violation{Commit: hash, Rule: signatureRulePrefix + kind, Detail: fmt.Sprintf(format, args...)}
+	v.Action = c.policy.action(v)
+	return v
+}
+
+// isSignature reports whether the violation is an unsigned or untrusted
+// tag or commit.
+func (v Violation) isSignature() bool {
+	return strings.HasPrefix(v.Rule, signatureRulePrefix)
+}
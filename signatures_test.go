@@ -0,0 +1,236 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// sshKey generates an SSH key in the fixture and returns the path of its
+// private key, and its public key.
+func (f *fixture) sshKey(name string) (string, string) {
+	f.t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		f.t.Skip("ssh-keygen executable not found")
+	}
+	key := f.path(name)
+	if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput(); err != nil {
+		f.t.Fatalf("ssh-keygen failed: %v\n%s", err, output)
+	}
+	public, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return key, strings.TrimSpace(string(public))
+}
+
+// sshSign signs payload with the SSH key for the namespace.
+func (f *fixture) sshSign(key, namespace string, payload []byte) string {
+	f.t.Helper()
+	cmd := exec.Command("ssh-keygen", "-q", "-Y", "sign", "-n", namespace, "-f", key)
+	cmd.Stdin = bytes.NewReader(payload)
+	output, err := cmd.Output()
+	if err != nil {
+		f.t.Fatalf("ssh-keygen -Y sign failed: %v", err)
+	}
+	return string(output)
+}
+
+func Test_signatureVerifier_verify(t *testing.T) {
+	f := newFixture(t)
+	payload := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n\nRelease\n")
+
+	alice, alicePublic := f.sshKey("alice")
+	carol, carolPublic := f.sshKey("carol")
+	mallory, _ := f.sshKey("mallory")
+	signers := filepath.Join(f.dir, "allowed_signers")
+	content := "# Maintainers\n" +
+		"alice@example.com namespaces=\"git\" " + alicePublic + "\n" +
+		"*@example.org,!mallory@example.org valid-after=\"20200101Z\",valid-before=\"20300101Z\" " + carolPublic + "\n"
+	if err := ioutil.WriteFile(signers, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("Bob", "", "bob@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := filepath.Join(f.dir, "keyring.asc")
+	var public bytes.Buffer
+	w, err := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(keyring, public.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gpgSign := func(payload []byte) string {
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(payload), nil); err != nil {
+			t.Fatal(err)
+		}
+		return sig.String()
+	}
+
+	v, err := newSignatureVerifier(SignaturePolicy{GPGKeyring: keyring, AllowedSigners: signers})
+	if err != nil {
+		t.Fatalf("newSignatureVerifier() error = %+v", err)
+	}
+	when := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	identity := func(email string, when time.Time) object.Signature {
+		return object.Signature{Name: "Signer", Email: email, When: when}
+	}
+	tests := []struct {
+		name       string
+		signature  string
+		payload    []byte
+		identity   object.Signature
+		wantSigner string
+	}{
+		{"ssh", f.sshSign(alice, "git", payload), payload, identity("alice@example.com", when), "alice@example.com"},
+		{"ssh untrusted key", f.sshSign(mallory, "git", payload), payload, identity("alice@example.com", when), ""},
+		{"ssh other namespace", f.sshSign(alice, "file", payload), payload, identity("alice@example.com", when), ""},
+		{"ssh changed payload", f.sshSign(alice, "git", payload), []byte("Changed"), identity("alice@example.com", when), ""},
+		{"ssh other principal", f.sshSign(alice, "git", payload), payload, identity("bob@example.com", when), ""},
+		{"ssh principal pattern", f.sshSign(carol, "git", payload), payload, identity("Carol@Example.org", when), "Carol@Example.org"},
+		{"ssh excluded principal", f.sshSign(carol, "git", payload), payload, identity("mallory@example.org", when), ""},
+		{"ssh before valid-after", f.sshSign(carol, "git", payload), payload, identity("carol@example.org", time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)), ""},
+		{"ssh after valid-before", f.sshSign(carol, "git", payload), payload, identity("carol@example.org", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)), ""},
+		{"gpg", gpgSign(payload), payload, identity("bob@example.com", when), "Bob <bob@example.com>"},
+		{"gpg email case", gpgSign(payload), payload, identity("Bob@Example.com", when), "Bob <bob@example.com>"},
+		{"gpg other email", gpgSign(payload), payload, identity("mallory@example.com", when), ""},
+		{"gpg changed payload", gpgSign(payload), []byte("Changed"), identity("bob@example.com", when), ""},
+		{"unsigned", "", payload, identity("bob@example.com", when), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := v.verify(tt.signature, tt.payload, tt.identity)
+			if tt.wantSigner == "" {
+				if err == nil {
+					t.Errorf("verify() = %v, want an error", signer)
+				}
+				return
+			}
+			if err != nil || signer != tt.wantSigner {
+				t.Errorf("verify() = %v, %v, want %v", signer, err, tt.wantSigner)
+			}
+		})
+	}
+}
+
+func TestManager_PushMirror_signatures(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	upstream := f.newUpstream("project")
+	dest := f.path("destination", "project.git")
+	m := f.add(mgr, "file://"+upstream, "file://"+dest)
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+
+	// Sign upstream's commits and tags with an SSH key
+	key, public := f.sshKey("maintainer")
+	if err := ioutil.WriteFile(f.path("mirrors", "allowed_signers"), []byte("gomir@example.com "+public+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.git(upstream, "config", "gpg.format", "ssh")
+	f.git(upstream, "config", "user.signingKey", key)
+	mgr.Policy.Signatures = SignaturePolicy{Tags: true, Branches: []string{"master"}, AllowedSigners: "allowed_signers"}
+	update := func() {
+		if !fetch(mgr, m) {
+			t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+		}
+	}
+
+	// Signed commits and tags are pushed
+	f.git(upstream, "commit", "-q", "-S", "--allow-empty", "-m", "Signed")
+	f.git(upstream, "tag", "-s", "v1.1", "-m", "Version 1.1")
+	update()
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(m.GitDir, dest)
+	if log := readLog(t, m); !strings.Contains(log, "Good signature on tag v1.1 by gomir@example.com") {
+		t.Errorf("Log lacks the good signature of v1.1:\n%v", log)
+	}
+
+	// Unsigned tags, signed tags pushed under another name and unsigned
+	// commits of protected branches are held back
+	f.git(upstream, "tag", "v1.2")
+	f.git(upstream, "tag", "-s", "v1.3", "-m", "Version 1.3")
+	f.git(upstream, "update-ref", "refs/tags/v2.0", "refs/tags/v1.3")
+	f.git(upstream, "tag", "-d", "v1.3")
+	f.git(upstream, "checkout", "-q", "feature")
+	f.commit(upstream, "Feature")
+	f.git(upstream, "checkout", "-q", "master")
+	unsigned := f.commit(upstream, "Unsigned")
+	update()
+	err := mgr.PushMirror(m)
+	policyErr, ok := errors.Cause(err).(*PolicyError)
+	if !ok || policyErr.Aborted {
+		t.Fatalf("PushMirror() error = %v, want a *PolicyError", err)
+	}
+	violations := map[string]Violation{}
+	for _, r := range policyErr.Refs {
+		violations[r.Ref] = r.Violations[0]
+	}
+	if v := violations["refs/heads/master"]; len(violations) != 3 || v.Rule != "signatures.commit" || v.Commit != unsigned {
+		t.Errorf("PolicyError.Refs = %+v, want the unsigned commit of master", policyErr.Refs)
+	}
+	if v := violations["refs/tags/v1.2"]; v.Rule != "signatures.tag" || v.Action != PolicyBlock {
+		t.Errorf("PolicyError.Refs = %+v, want the lightweight tag v1.2", policyErr.Refs)
+	}
+	if v := violations["refs/tags/v2.0"]; v.Rule != "signatures.tag" || !strings.Contains(v.Detail, "named v1.3") {
+		t.Errorf("PolicyError.Refs = %+v, want the renamed tag v2.0", policyErr.Refs)
+	}
+	got := f.refs(dest)
+	if _, ok := got["refs/tags/v1.2"]; ok || got["refs/heads/master"] == unsigned {
+		t.Errorf("Destination refs = %v, want master and v1.2 held back", got)
+	}
+	if _, ok := got["refs/tags/v2.0"]; ok {
+		t.Errorf("Destination refs = %v, want v2.0 held back", got)
+	}
+	if got["refs/heads/feature"] != f.refs(m.GitDir)["refs/heads/feature"] {
+		t.Errorf("Destination feature = %v, want it pushed", got["refs/heads/feature"])
+	}
+
+	// With the abort action, nothing is pushed
+	f.git(m.GitDir, "config", "gomir.signatures.action", "abort")
+	f.git(upstream, "checkout", "-q", "feature")
+	f.commit(upstream, "More features")
+	f.git(upstream, "checkout", "-q", "master")
+	update()
+	before := f.refs(dest)
+	err = mgr.PushMirror(m)
+	if policyErr, ok := errors.Cause(err).(*PolicyError); !ok || !policyErr.Aborted {
+		t.Fatalf("PushMirror() error = %v, want an aborted *PolicyError", err)
+	}
+	if after := f.refs(dest); after["refs/heads/feature"] != before["refs/heads/feature"] {
+		t.Errorf("Destination feature = %v, want it kept at %v", after["refs/heads/feature"], before["refs/heads/feature"])
+	}
+
+	// Mirrors may turn the requirements off
+	f.git(m.GitDir, "config", "gomir.signatures.tags", "false")
+	f.git(m.GitDir, "config", "gomir.signatures.branch", "release/*")
+	if !push(mgr, m) {
+		t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+	}
+	f.assertSameRefs(m.GitDir, dest)
+}
@@ -0,0 +1,283 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	formatconfig "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/pkg/errors"
+)
+
+// OriginSource names the source given to Add. It is stored as the URL
+// of the mirror's origin remote.
+const OriginSource = "origin"
+
+// namespacePattern matches ref namespaces, one or more path segments.
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+// Source is a repository that a mirror fetches from. Besides the origin
+// source, a mirror may fetch from any number of named sources stored in
+// the gomir.fetch.<name> subsections of its git config:
+//
+//	git config --file github.com/pkg/errors.git/config gomir.fetch.vendor.url https://git.vendor.com/errors.git
+//	git config --file github.com/pkg/errors.git/config gomir.fetch.vendor.namespace vendor
+//
+// A source with a namespace only contributes its branches and tags,
+// renamed into the namespace: with the namespace "vendor", the branch
+// main becomes refs/heads/vendor/main and the tag v1 becomes
+// refs/tags/vendor/v1. The refs of all sources are pushed together.
+type Source struct {
+	// Name identifies the source within the mirror
+	Name string
+
+	// URL is where the source is fetched from (url)
+	URL string
+
+	// Namespace is the ref namespace the source is fetched into
+	// (namespace). It is required for every source but origin, which
+	// is fetched as-is without one.
+	Namespace string
+
+	// Credentials authenticate to the source, falling back to those
+	// configured for its host in the root's gomir.config
+	Credentials Credentials
+
+	// Network configures the connection to the source. The Manager sets
+	// it from the host settings in the root's gomir.config; it isn't
+	// saved with the mirror.
+	Network Network
+}
+
+func (s Source) validate() error {
+	if !namePattern.MatchString(s.Name) {
+		return errors.Errorf("Invalid source name %#v, use letters, digits, - and _", s.Name)
+	}
+	if s.URL == "" {
+		return errors.Errorf("Source %v has no URL", s.Name)
+	}
+	switch {
+	case s.Namespace == "" && s.Name != OriginSource:
+		return errors.Errorf("Source %v needs a namespace", s.Name)
+	case s.Namespace != "" && !namespacePattern.MatchString(s.Namespace):
+		return errors.Errorf("Invalid namespace %#v for source %v, expected names such as vendor or vendor/acme", s.Namespace, s.Name)
+	}
+	return errors.Wrapf(s.Credentials.validate(), "Invalid credentials for source %v", s.Name)
+}
+
+// refSpecs returns the forced refspecs fetching the source into its
+// namespace.
+func (s Source) refSpecs() []string {
+	if s.Namespace == "" {
+		return []string{"+refs/*:refs/*"}
+	}
+	return []string{
+		fmt.Sprintf("+refs/heads/*:refs/heads/%v/*", s.Namespace),
+		fmt.Sprintf("+refs/tags/*:refs/tags/%v/*", s.Namespace),
+	}
+}
+
+// localRef returns the name of the mirror's ref for the source's ref
+// name, or "" if the source's refs don't include it.
+func (s Source) localRef(name string) string {
+	switch {
+	case !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "^{}"):
+		return ""
+	case s.Namespace == "":
+		return name
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(name, prefix) {
+			return prefix + s.Namespace + "/" + strings.TrimPrefix(name, prefix)
+		}
+	}
+	return ""
+}
+
+// isMirrorSources reports whether sources are just the origin fetched
+// as-is, which `git fetch --prune` handles on its own.
+func isMirrorSources(sources []Source) bool {
+	return len(sources) == 1 && sources[0].Name == OriginSource && sources[0].Namespace == ""
+}
+
+// mapSourceRefs returns the refs the mirror has after fetching sources,
+// given the refs listed on each source. Two sources fetching the same
+// ref are an error, since one would overwrite the other.
+func mapSourceRefs(sources []Source, listed [][]string) (map[string]bool, error) {
+	owners := map[string]string{}
+	collisions := []string{}
+	for i, s := range sources {
+		for _, name := range listed[i] {
+			local := s.localRef(name)
+			if local == "" {
+				continue
+			}
+			if owner, ok := owners[local]; ok && owner != s.Name {
+				collisions = append(collisions, fmt.Sprintf("%v from %v and %v", local, owner, s.Name))
+				continue
+			}
+			owners[local] = s.Name
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return nil, errors.Errorf("Sources fetch the same refs, give them distinct namespaces:\n%v", strings.Join(collisions, "\n"))
+	}
+
+	refs := map[string]bool{}
+	for local := range owners {
+		refs[local] = true
+	}
+	return refs, nil
+}
+
+// staleRefs returns the refs of localRefs that aren't in want.
+func staleRefs(localRefs []string, want map[string]bool) []string {
+	stale := []string{}
+	for _, ref := range localRefs {
+		if !want[ref] {
+			stale = append(stale, ref)
+		}
+	}
+	return stale
+}
+
+// sourceSubsection returns the name of the subsection of the gomir
+// section that stores the source name.
+func sourceSubsection(name string) string {
+	if name == OriginSource {
+		return "fetch"
+	}
+	return "fetch." + name
+}
+
+// Sources returns the sources the mirror fetches from, starting with the
+// origin source.
+func (m *Mirror) Sources() ([]Source, error) {
+	cfg, err := readRawConfig(m.GitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	originURL, err := m.FetchURL()
+	if err != nil {
+		return nil, err
+	}
+	section := cfg.Section("gomir")
+	sources := []Source{readSource(section, OriginSource)}
+	sources[0].URL = originURL
+
+	for _, sub := range section.Subsections {
+		if !strings.HasPrefix(sub.Name, "fetch.") {
+			continue
+		}
+		s := readSource(section, strings.TrimPrefix(sub.Name, "fetch."))
+		s.URL = sub.Option("url")
+		sources = append(sources, s)
+	}
+
+	return sources, validateSources(sources)
+}
+
+func readSource(section *formatconfig.Section, name string) Source {
+	sub := section.Subsection(sourceSubsection(name))
+	return Source{
+		Name:        name,
+		Namespace:   sub.Option("namespace"),
+		Credentials: readCredentials(sub),
+	}
+}
+
+// validateSources checks the sources of a mirror, whose namespaces must
+// not overlap.
+func validateSources(sources []Source) error {
+	for i, s := range sources {
+		if err := s.validate(); err != nil {
+			return err
+		}
+		for _, other := range sources[:i] {
+			if other.Namespace != "" && s.Namespace != "" &&
+				(s.Namespace == other.Namespace || strings.HasPrefix(s.Namespace+"/", other.Namespace+"/") || strings.HasPrefix(other.Namespace+"/", s.Namespace+"/")) {
+				return errors.Errorf("The namespaces of sources %v and %v overlap", other.Name, s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// SetSource adds the source to the mirror, or replaces the source with
+// the same name. Setting the origin source changes the URL of the origin
+// remote.
+func (m *Mirror) SetSource(s Source) error {
+	sources, err := m.Sources()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range sources {
+		if sources[i].Name == s.Name {
+			sources[i], replaced = s, true
+		}
+	}
+	if !replaced {
+		sources = append(sources, s)
+	}
+	if err := validateSources(sources); err != nil {
+		return err
+	}
+
+	return editRawConfig(m.GitDir, func(cfg *formatconfig.Config) {
+		section := cfg.Section("gomir")
+		name := sourceSubsection(s.Name)
+		if s.Name == OriginSource {
+			cfg.Section("remote").Subsection("origin").SetOption("url", s.URL)
+		} else {
+			section.Subsection(name).SetOption("url", s.URL)
+		}
+
+		sub := section.Subsection(name)
+		if s.Namespace != "" {
+			sub.SetOption("namespace", s.Namespace)
+		} else {
+			sub.RemoveOption("namespace")
+		}
+		writeCredentials(section, name, s.Credentials)
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.RemoveSection("gomir")
+		}
+	})
+}
+
+// RemoveSource stops the mirror from fetching from the named source. Its
+// refs are deleted by the next fetch. The origin source can't be
+// removed.
+func (m *Mirror) RemoveSource(name string) error {
+	if name == OriginSource {
+		return errors.New("The origin source can't be removed")
+	}
+
+	sources, err := m.Sources()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, s := range sources {
+		found = found || s.Name == name
+	}
+	if !found {
+		return errors.Errorf("Mirror %v has no source %#v", m, name)
+	}
+
+	return editRawConfig(m.GitDir, func(cfg *formatconfig.Config) {
+		section := cfg.Section("gomir")
+		section.RemoveSubsection(sourceSubsection(name))
+		if len(section.Options) == 0 && len(section.Subsections) == 0 {
+			cfg.RemoveSection("gomir")
+		}
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_mapSourceRefs(t *testing.T) {
+	origin := Source{Name: OriginSource}
+	upstream := Source{Name: OriginSource, Namespace: "upstream"}
+	vendor := Source{Name: "vendor", Namespace: "vendor"}
+
+	tests := []struct {
+		sources []Source
+		listed  [][]string
+		want    []string
+		wantErr bool
+	}{
+		{
+			[]Source{origin, vendor},
+			[][]string{
+				{"HEAD", "refs/heads/master", "refs/tags/v1", "refs/tags/v1^{}", "refs/pull/1/head"},
+				{"HEAD", "refs/heads/master", "refs/tags/v2", "refs/pull/2/head"},
+			},
+			[]string{"refs/heads/master", "refs/heads/vendor/master", "refs/pull/1/head", "refs/tags/v1", "refs/tags/vendor/v2"},
+			false,
+		},
+		{
+			[]Source{upstream, vendor},
+			[][]string{{"refs/heads/master"}, {"refs/heads/master"}},
+			[]string{"refs/heads/upstream/master", "refs/heads/vendor/master"},
+			false,
+		},
+		{
+			[]Source{origin, vendor},
+			[][]string{{"refs/heads/vendor/master"}, {"refs/heads/master"}},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := mapSourceRefs(tt.sources, tt.listed)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mapSourceRefs(%v) error = %v, wantErr %v", tt.listed, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		want := map[string]bool{}
+		for _, ref := range tt.want {
+			want[ref] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("mapSourceRefs(%v) = %v, want %v", tt.listed, got, want)
+		}
+	}
+}
+
+func TestMirror_SetSource(t *testing.T) {
+	f := newFixture(t)
+	mgr := f.manager("exec")
+	m := f.add(mgr, "file://"+f.newUpstream("project"), f.path("destination", "project.git"))
+	if err := m.SetOptions(MirrorOptions{FetchCredentials: Credentials{SSHKey: "/keys/upstream"}}); err != nil {
+		t.Fatalf("SetOptions() error = %+v", err)
+	}
+
+	vendor := Source{Name: "vendor", URL: "https://git.vendor.com/project.git", Namespace: "vendor", Credentials: Credentials{TokenEnv: "VENDOR_TOKEN"}}
+	if err := m.SetSource(vendor); err != nil {
+		t.Fatalf("SetSource() error = %+v", err)
+	}
+	origin := Source{Name: OriginSource, URL: "https://git.example.com/project.git", Namespace: "upstream", Credentials: Credentials{SSHKey: "/keys/upstream"}}
+	if err := m.SetSource(origin); err != nil {
+		t.Fatalf("SetSource() error = %+v", err)
+	}
+
+	want := []Source{origin, vendor}
+	if got, err := m.Sources(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Sources() = %+v, %v, want %+v", got, err, want)
+	}
+	if got := f.git(m.GitDir, "config", "gomir.fetch.vendor.namespace"); got != "vendor" {
+		t.Errorf("gomir.fetch.vendor.namespace = %#v, want it readable by git", got)
+	}
+
+	for _, invalid := range []Source{
+		{Name: "fork", URL: "https://git.fork.com/project.git"},
+		{Name: "fork", URL: "https://git.fork.com/project.git", Namespace: "vendor/fork"},
+		{Name: "fork", URL: "https://git.fork.com/project.git", Namespace: "../fork"},
+		{Name: "fork", Namespace: "fork"},
+	} {
+		if err := m.SetSource(invalid); err == nil {
+			t.Errorf("SetSource() accepted %+v", invalid)
+		}
+	}
+
+	if err := m.RemoveSource("vendor"); err != nil {
+		t.Fatalf("RemoveSource() error = %+v", err)
+	}
+	if err := m.RemoveSource(OriginSource); err == nil {
+		t.Errorf("RemoveSource() removed the origin source")
+	}
+	if err := m.SetSource(Source{Name: OriginSource, URL: origin.URL}); err != nil {
+		t.Fatalf("SetSource() error = %+v", err)
+	}
+	if strings.Contains(f.git(m.GitDir, "config", "--list"), "gomir.") {
+		t.Errorf("Removed sources left gomir settings behind")
+	}
+}
+
+func TestManager_FetchMirror_sources(t *testing.T) {
+	for _, backendName := range backendNames() {
+		t.Run(backendName, func(t *testing.T) {
+			f := newFixture(t)
+			mgr := f.manager(backendName)
+			upstream := f.newUpstream("project")
+			vendor := f.newUpstream("vendor")
+			// Sources usually have commits the others don't
+			f.commit(vendor, "Vendor changes")
+			dest := f.path("destination", "project.git")
+			m := f.add(mgr, "file://"+upstream, "file://"+dest)
+			if err := m.SetSource(Source{Name: "vendor", URL: "file://" + vendor, Namespace: "vendor"}); err != nil {
+				t.Fatalf("SetSource() error = %+v", err)
+			}
+
+			if !fetch(mgr, m) {
+				t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+			}
+			want := f.refs(upstream)
+			for name, hash := range f.refs(vendor) {
+				want[strings.Replace(strings.Replace(name, "refs/heads/", "refs/heads/vendor/", 1), "refs/tags/", "refs/tags/vendor/", 1)] = hash
+			}
+			if got := f.refs(m.GitDir); !reflect.DeepEqual(got, want) {
+				t.Errorf("Mirror refs = %v, want %v", got, want)
+			}
+			if !push(mgr, m) {
+				t.Fatalf("PushMirror() failed:\n%v", readLog(t, m))
+			}
+			f.assertSameRefs(m.GitDir, dest)
+
+			// Deleted refs are pruned from their namespace only
+			f.git(vendor, "branch", "-D", "feature")
+			if !fetch(mgr, m) {
+				t.Fatalf("FetchMirror() failed:\n%v", readLog(t, m))
+			}
+			got := f.refs(m.GitDir)
+			if _, ok := got["refs/heads/vendor/feature"]; ok {
+				t.Errorf("Mirror kept the deleted branch vendor/feature")
+			}
+			if _, ok := got["refs/heads/feature"]; !ok {
+				t.Errorf("Mirror lost the upstream branch feature")
+			}
+
+			// Refs fetched by two sources are rejected
+			f.git(upstream, "branch", "vendor/master")
+			err := mgr.FetchMirror(m)
+			if err == nil || !strings.Contains(err.Error(), "refs/heads/vendor/master from origin and vendor") {
+				t.Errorf("FetchMirror() error = %v, want a collision", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2017 Brian Lachniet. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package gomir
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxWebhookBody limits the size of the webhook payloads read.
+const maxWebhookBody = 5 << 20
+
+// WebhookHandler receives push events from GitHub, GitLab and Gitea and
+// queues a fetch of the mirrors whose origin matches the pushed
+// repository. Run performs the queued fetches.
+type WebhookHandler struct {
+	Manager *Manager
+
+	// Secret validates the events: GitHub and Gitea sign them with it,
+	// GitLab sends it as a token
+	Secret string
+
+	// Push makes Run push a mirror after fetching it successfully
+	Push bool
+
+	queue chan *Mirror
+
+	mu     sync.Mutex
+	queued map[string]bool
+}
+
+// NewWebhookHandler returns a WebhookHandler for the mirrors of mgr that
+// accepts events validated by secret.
+func NewWebhookHandler(mgr *Manager, secret string) *WebhookHandler {
+	return &WebhookHandler{
+		Manager: mgr,
+		Secret:  secret,
+		queue:   make(chan *Mirror, 100),
+		queued:  map[string]bool{},
+	}
+}
+
+// webhookEvent is what gomir needs from a push event.
+type webhookEvent struct {
+	// push is false for events other than pushes, which are ignored
+	push bool
+	// urls are the URLs of the pushed repository
+	urls []string
+}
+
+// ServeHTTP validates a push event and queues a fetch of the matching
+// mirrors. It responds with 202 Accepted once the fetches are queued.
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Error reading payload", http.StatusBadRequest)
+		return
+	}
+
+	event, err := h.parseEvent(r.Header, body)
+	if err == errUnauthorized {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !event.push {
+		fmt.Fprintln(w, "Ignoring event")
+		return
+	}
+
+	mirrors, err := h.findMirrors(event.urls)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(mirrors) == 0 {
+		http.Error(w, fmt.Sprintf("No mirror fetches %v", strings.Join(event.urls, ", ")), http.StatusNotFound)
+		return
+	}
+
+	for _, m := range mirrors {
+		if !h.enqueue(m) {
+			http.Error(w, "Too many fetches queued", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	for _, m := range mirrors {
+		fmt.Fprintf(w, "Queued fetch of %v\n", m)
+	}
+}
+
+// Run performs the queued fetches until ctx is done, finishing the batch
+// in progress. The fetches queued by then run together as a batch, like
+// the daemon's: holding the root lock, recorded in the checkpoint and
+// reported on as Fetch does. With Push, the mirrors fetched successfully
+// are then pushed as another batch.
+func (h *WebhookHandler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-h.queue:
+			batch := h.dequeue(m)
+			results, err := h.Manager.runBatch(OpFetch, batch)
+			if err != nil {
+				h.Manager.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Skipping fetch of %v mirrors: %v", len(batch), err)})
+				continue
+			}
+			if !h.Push {
+				continue
+			}
+			fetched := []*Mirror{}
+			for _, r := range results {
+				if r.Err == nil {
+					fetched = append(fetched, r.Mirror)
+				}
+			}
+			if len(fetched) == 0 {
+				continue
+			}
+			if _, err := h.Manager.runBatch(OpPush, fetched); err != nil {
+				h.Manager.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Skipping push of %v mirrors: %v", len(fetched), err)})
+			}
+		}
+	}
+}
+
+// dequeue returns m and the other queued mirrors, removing them from the
+// queue.
+func (h *WebhookHandler) dequeue(m *Mirror) []*Mirror {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	batch := []*Mirror{m}
+	for more := true; more; {
+		select {
+		case next := <-h.queue:
+			batch = append(batch, next)
+		default:
+			more = false
+		}
+	}
+	// Events arriving from now on need another fetch
+	for _, m := range batch {
+		delete(h.queued, m.Path)
+	}
+	return batch
+}
+
+// enqueue queues a fetch of m unless one is already queued. It returns
+// false if the queue is full.
+func (h *WebhookHandler) enqueue(m *Mirror) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queued[m.Path] {
+		return true
+	}
+
+	select {
+	case h.queue <- m:
+		h.queued[m.Path] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// findMirrors returns the mirrors with a source whose URL matches one of
+// urls.
+func (h *WebhookHandler) findMirrors(urls []string) ([]*Mirror, error) {
+	want := map[string]bool{}
+	for _, u := range urls {
+		if u != "" {
+			want[normalizeRepoURL(u)] = true
+		}
+	}
+
+	mirrors, err := h.Manager.List()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Mirror
+	for _, m := range mirrors {
+		sources, err := m.Sources()
+		if err != nil {
+			continue
+		}
+		for _, s := range sources {
+			if want[normalizeRepoURL(s.URL)] {
+				found = append(found, m)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+var errUnauthorized = errors.New("Invalid webhook signature or token")
+
+// parseEvent validates and parses an event from the service identified
+// by its headers.
+func (h *WebhookHandler) parseEvent(header http.Header, body []byte) (webhookEvent, error) {
+	switch {
+	// Gitea also sends GitHub's headers, so check for it first
+	case header.Get("X-Gitea-Event") != "":
+		if !validHMAC(h.Secret, body, header.Get("X-Gitea-Signature")) {
+			return webhookEvent{}, errUnauthorized
+		}
+		return parseRepositoryEvent(header.Get("X-Gitea-Event") == "push", body)
+
+	case header.Get("X-GitHub-Event") != "":
+		signature := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") || !validHMAC(h.Secret, body, strings.TrimPrefix(signature, "sha256=")) {
+			return webhookEvent{}, errUnauthorized
+		}
+		return parseRepositoryEvent(header.Get("X-GitHub-Event") == "push", body)
+
+	case header.Get("X-Gitlab-Event") != "":
+		token := header.Get("X-Gitlab-Token")
+		if h.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.Secret)) != 1 {
+			return webhookEvent{}, errUnauthorized
+		}
+		kind := header.Get("X-Gitlab-Event")
+		return parseGitLabEvent(kind == "Push Hook" || kind == "Tag Push Hook", body)
+	}
+	return webhookEvent{}, errors.New("Unknown webhook sender, expected GitHub, GitLab or Gitea")
+}
+
+// validHMAC reports whether signature is the hex encoded HMAC-SHA256 of
+// body keyed with secret.
+func validHMAC(secret string, body []byte, signature string) bool {
+	if secret == "" {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// parseRepositoryEvent parses a GitHub or Gitea event.
+func parseRepositoryEvent(push bool, body []byte) (webhookEvent, error) {
+	var payload struct {
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			GitURL   string `json:"git_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return webhookEvent{}, errors.Wrap(err, "Error parsing payload")
+	}
+	repo := payload.Repository
+	return webhookEvent{push: push, urls: nonEmpty(repo.CloneURL, repo.SSHURL, repo.GitURL, repo.HTMLURL)}, nil
+}
+
+// parseGitLabEvent parses a GitLab event.
+func parseGitLabEvent(push bool, body []byte) (webhookEvent, error) {
+	var payload struct {
+		Project struct {
+			HTTPURL string `json:"git_http_url"`
+			SSHURL  string `json:"git_ssh_url"`
+			WebURL  string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return webhookEvent{}, errors.Wrap(err, "Error parsing payload")
+	}
+	project := payload.Project
+	return webhookEvent{push: push, urls: nonEmpty(project.HTTPURL, project.SSHURL, project.WebURL)}, nil
+}
+
+func nonEmpty(values ...string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// normalizeRepoURL reduces the different URLs of a repository to the
+// same lower case host and path, so that https://github.com/pkg/errors.git,
+// git@github.com:pkg/errors.git and ssh://git@GitHub.com/Pkg/Errors all
+// match.
+func normalizeRepoURL(s string) string {
+	host, path := splitRepoURL(s)
+	path = strings.Trim(strings.ToLower(path), "/")
+	path = strings.TrimSuffix(path, ".git")
+	return host + "/" + path
+}
+
+// repoURLHost returns the lower case host name of a repository URL, or ""
+// for local paths.
+func repoURLHost(s string) string {
+	host, _ := splitRepoURL(s)
+	return host
+}
+
+// splitRepoURL splits a repository URL into its lower case host name and
+// its path.
+func splitRepoURL(s string) (host, path string) {
+	s = strings.TrimSpace(s)
+	host, path = "", s
+	if u, err := url.Parse(s); err == nil && strings.Contains(s, "://") {
+		host, path = u.Hostname(), u.Path
+	} else if i := strings.Index(s, ":"); i > 0 && !strings.Contains(s[:i], "/") {
+		// scp-like syntax: [user@]host:path
+		host, path = s[:i], s[i+1:]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	}
+	return strings.ToLower(host), path
+}